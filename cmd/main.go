@@ -1,22 +1,55 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	flags "github.com/thought-machine/go-flags"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/cache"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
-	util "github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/config"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/web"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var opts struct {
-	MetricsEndpoint    string   `short:"p" long:"endpoint" description:"The endpoint the metrics are exposing to." default:"/metrics"`
-	ExportMetricsPort  int      `short:"e" long:"export_to" description:"The port the metrics are exposing to." default:"13434"`
-	ContainerLabelName string   `short:"n" long:"container_label" description:"The name of the container label which will be appended to multiplexed metrics." default:"container"`
-	ScrapeInterval     int      `short:"i" long:"scrape_interval" description:"The time interval for the scraping process in milliseconds." default:"200"`
-	ExcludedContainers []string `short:"x" long:"exclude_containers" description:"Containers that can be excluded from the scraping process." default:""`
-	ContainerToPortMap []string `short:"m" long:"container_to_port_map" description:"The mapping between container and ports, formatted as <container>:<port>." required:"true"`
+	MetricsEndpoint               string   `short:"p" long:"endpoint" description:"The endpoint the metrics are exposing to." default:"/metrics"`
+	ExportMetricsPort             int      `short:"e" long:"export_to" description:"The port the metrics are exposing to." default:"13434"`
+	ProbePort                     int      `long:"probe_port" description:"The port the probes are served on over plain HTTP, so that they keep working when the web configuration file requires client certificates. The probes are served with the metrics when 0." default:"0"`
+	ContainerLabelName            string   `short:"n" long:"container_label" description:"The name of the container label which will be appended to multiplexed metrics." default:"container"`
+	ScrapeInterval                int      `short:"i" long:"scrape_interval" description:"The time interval for the scraping process in milliseconds." default:"200"`
+	ScrapeJitter                  int      `long:"scrape_jitter" description:"The maximum offset in milliseconds of each container's first scrape, so that the scrapes of different containers don't align." default:"0"`
+	ScrapeSpread                  bool     `long:"scrape_spread" description:"Spread the first scrapes of the containers over their whole scrape interval, in place of the scrape jitter."`
+	ExcludedContainers            []string `short:"x" long:"exclude_containers" description:"Containers that can be excluded from the scraping process, as globs such as istio-* or as regular expressions prefixed with regex:." default:""`
+	ContainerToPortMap            []string `short:"m" long:"container_to_port_map" description:"The mapping between container and where its metrics are scraped from, formatted as <container>:<port>[<path>] or <container>=<scheme>://<host>:<port>[<path>]. Required unless the configuration file lists the targets."`
+	DefaultScrapePath             string   `long:"default_scrape_path" description:"The path containers are scraped on when their mapping has none. Defaults to the endpoint the metrics are exposing to."`
+	TelemetryEndpoint             string   `long:"telemetry_endpoint" description:"The endpoint the metrics of the sidecar itself are exposing to." default:"/multiplexer/metrics"`
+	AdminEndpoint                 string   `long:"admin_endpoint" description:"The endpoint under which scraping a single container is paused and resumed. Disabled when empty."`
+	TypeConflictPolicy            string   `long:"type_conflict_policy" description:"What to do with a metric family whose type differs from the same family of another container." choice:"drop" choice:"rename" choice:"fail" default:"drop"`
+	LabelCollisionPolicy          string   `long:"label_collision_policy" description:"What to do with a series that already has a label named like the container label: rename it to exported_<name>, keep it, or overwrite it." choice:"rename" choice:"keep" choice:"overwrite" default:"rename"`
+	ExtraLabels                   []string `long:"extra_labels" description:"Labels added to the metrics of every container, formatted as <name>=<value>. A value given as env:<variable> is read from the environment variable, and one given as file:<path> from the file, such as a file of the Downward API."`
+	CacheReadMode                 string   `long:"cache_read_mode" description:"Whether serving the metrics removes them from the cache (invalidate), or serves the latest scrape to every caller (retain)." choice:"invalidate" choice:"retain" default:"invalidate"`
+	MaxCacheAge                   int      `long:"max_cache_age" description:"The age in milliseconds after which a cached scrape is treated as missing, 0 for no limit." default:"0"`
+	ScrapeMode                    string   `long:"scrape_mode" description:"Whether the containers are scraped every scrape interval (poll), or in parallel whenever the metrics are requested (on_demand)." choice:"poll" choice:"on_demand" default:"poll"`
+	ScrapeTimeout                 int      `long:"scrape_timeout" description:"The timeout in milliseconds of on-demand scrapes when the request doesn't carry the X-Prometheus-Scrape-Timeout-Seconds header." default:"10000"`
+	RequiredContainers            []string `long:"required_containers" description:"The containers, as globs or as regular expressions prefixed with regex:, that have to be scraped successfully before the sidecar is ready. All containers if none are given."`
+	ReadinessDropsOnFailure       bool     `long:"readiness_drops_on_failure" description:"Make the sidecar unready whenever the latest scrape of a required container failed, rather than staying ready once every required container has been scraped successfully."`
+	NativeHistogramClassicBuckets bool     `long:"native_histogram_classic_buckets" description:"Also expose the native histograms of the containers with classic buckets, for Prometheus servers that don't support native histograms."`
+	SampleLimit                   int      `long:"sample_limit" description:"The number of samples the metrics of a container may not exceed, 0 for no limit." default:"0"`
+	LabelLimit                    int      `long:"label_limit" description:"The number of labels a series of a container may not exceed, 0 for no limit." default:"0"`
+	LabelNameLengthLimit          int      `long:"label_name_length_limit" description:"The length the label names of a container may not exceed, 0 for no limit." default:"0"`
+	LabelValueLengthLimit         int      `long:"label_value_length_limit" description:"The length the label values of a container may not exceed, 0 for no limit." default:"0"`
+	BodySizeLimit                 int64    `long:"body_size_limit" description:"The size in bytes the uncompressed metrics of a container may not exceed, 0 for no limit." default:"0"`
+	ShutdownDelay                 int      `long:"shutdown_delay" description:"The time in milliseconds the last scraped metrics are still served for after SIGTERM, so that Prometheus gets a final scrape." default:"0"`
+	ShutdownGracePeriod           int      `long:"shutdown_grace_period" description:"The time in milliseconds requests in flight are given to finish when shutting down." default:"5000"`
+	ConfigFile                    string   `long:"config.file" description:"The YAML configuration file, whose settings take precedence over the flags. It is reloaded on SIGHUP and whenever it changes."`
+	ConfigReloadInterval          int      `long:"config.reload_interval" description:"The time interval in milliseconds between checks of the configuration file for changes, 0 to only reload on SIGHUP." default:"5000"`
+	WebConfigFile                 string   `long:"web.config.file" description:"The web configuration file, in the format of the Prometheus exporter toolkit, giving the TLS settings and the credentials the metrics are served with. It is read again once it changed."`
 }
 
 func main() {
@@ -25,20 +58,105 @@ func main() {
 		log.Fatalf("Could not parse flags: %v", err)
 	}
 
-	containerToPortMap, err := util.GenerateContainerToPortMap(opts.ContainerToPortMap)
+	extraLabels, err := utils.ParseLabels(opts.ExtraLabels)
 	if err != nil {
-		log.Fatalf("Failed to generate container:port map: %s", err)
+		log.Fatalf("Could not parse the extra labels: %v", err)
 	}
+	flagConfig := config.Config{
+		Endpoint:                      opts.MetricsEndpoint,
+		ExportTo:                      opts.ExportMetricsPort,
+		ContainerLabel:                opts.ContainerLabelName,
+		ScrapeInterval:                time.Duration(opts.ScrapeInterval) * time.Millisecond,
+		ScrapeJitter:                  time.Duration(opts.ScrapeJitter) * time.Millisecond,
+		ScrapeSpread:                  opts.ScrapeSpread,
+		ExcludeContainers:             opts.ExcludedContainers,
+		ContainerToPortMap:            opts.ContainerToPortMap,
+		DefaultScrapePath:             opts.DefaultScrapePath,
+		TelemetryEndpoint:             opts.TelemetryEndpoint,
+		AdminEndpoint:                 opts.AdminEndpoint,
+		TypeConflictPolicy:            opts.TypeConflictPolicy,
+		LabelCollisionPolicy:          opts.LabelCollisionPolicy,
+		CacheReadMode:                 opts.CacheReadMode,
+		MaxCacheAge:                   time.Duration(opts.MaxCacheAge) * time.Millisecond,
+		ScrapeMode:                    opts.ScrapeMode,
+		ScrapeTimeout:                 time.Duration(opts.ScrapeTimeout) * time.Millisecond,
+		RequiredContainers:            opts.RequiredContainers,
+		ReadinessDropsOnFailure:       opts.ReadinessDropsOnFailure,
+		NativeHistogramClassicBuckets: opts.NativeHistogramClassicBuckets,
+		ExtraLabels:                   extraLabels,
+		Limits: config.Limits{
+			SampleLimit:           opts.SampleLimit,
+			LabelLimit:            opts.LabelLimit,
+			LabelNameLengthLimit:  opts.LabelNameLengthLimit,
+			LabelValueLengthLimit: opts.LabelValueLengthLimit,
+			BodySizeLimit:         opts.BodySizeLimit,
+		},
+	}
+	cfg := &flagConfig
+	var reloader *config.Reloader
+	if opts.ConfigFile != "" {
+		reloader = config.NewReloader(opts.ConfigFile, flagConfig, time.Duration(opts.ConfigReloadInterval)*time.Millisecond)
+		if cfg, err = reloader.Load(); err != nil {
+			log.Fatalf("Failed to load the configuration file: %v", err)
+		}
+	}
+
+	serverOpts, targets, err := cfg.Resolve()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if opts.ProbePort != 0 && opts.ProbePort == cfg.ExportTo {
+		log.Fatalf("Invalid configuration: the probe port %d is the port the metrics are exposing to", opts.ProbePort)
+	}
+	serverOpts.ProbePort = opts.ProbePort
+	if opts.WebConfigFile != "" {
+		if serverOpts.TLSConfig, err = web.NewTLSConfig(opts.WebConfigFile); err != nil {
+			log.Fatalf("Invalid web configuration: %v", err)
+		}
+		authenticator, err := web.NewAuthenticator(opts.WebConfigFile)
+		if err != nil {
+			log.Fatalf("Invalid web configuration: %v", err)
+		}
+		serverOpts.Authenticate = authenticator.Wrap
+	}
+
+	// The first SIGTERM or interrupt starts the graceful shutdown, a second one terminates the sidecar straight away.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	if err := util.ValidateLabelName(opts.ContainerLabelName); err != nil {
-		log.Fatalf("Invalid container label name %s : %w", opts.ContainerLabelName, err)
+	metricCache := cache.NewMetricCache(cfg.MaxCacheAge)
+	metricClient := client.NewClient()
+	svr := server.NewServer(serverOpts, metricCache, metricClient, targets)
+	svr.Start(ctx)
+	if reloader != nil {
+		reloadSignals := make(chan os.Signal, 1)
+		signal.Notify(reloadSignals, syscall.SIGHUP)
+		go reloader.Run(ctx, reloadSignals, func(opts server.Options, targets map[string]utils.Target) {
+			svr.Reload(opts, targets)
+			metricClient.PruneTLSClients(targets)
+		})
 	}
+	served := make(chan error, 1)
+	go func() {
+		served <- svr.ServeOnPort()
+	}()
+	fmt.Printf("start the server on port: %d", cfg.ExportTo)
 
-	svr := server.NewServer(opts.ExportMetricsPort, cache.NewMetricCache(), client.NewClient(), containerToPortMap, opts.MetricsEndpoint)
-	defer svr.Close()
-	svr.Start(opts.ScrapeInterval, opts.ContainerLabelName)
-	fmt.Printf("start the server on port: %d", opts.ExportMetricsPort)
-	if err := svr.ServeOnPort(); err != nil {
+	select {
+	case err := <-served:
 		log.Panicf("Unable to start the server: %v", err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Scraping has stopped, but the last scraped metrics are still served for the shutdown delay, so that Prometheus
+	// gets a final scrape of containers that shut down before the sidecar.
+	shutdownDelay := time.Duration(opts.ShutdownDelay) * time.Millisecond
+	log.Printf("Shutting down, serving the last scraped metrics for %s", shutdownDelay)
+	time.Sleep(shutdownDelay)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(opts.ShutdownGracePeriod)*time.Millisecond)
+	defer cancel()
+	if err := svr.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down gracefully: %v", err)
 	}
 }
@@ -1,6 +1,13 @@
 package cache
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+)
 
 // Cache is the interface for a cache.
 type Cache interface {
@@ -9,31 +16,63 @@ type Cache interface {
 	Load(key any) (value any, ok bool)
 }
 
-// RawMetricCache is the cache to store the raw metrics and their corresponding container names.
-type RawMetricCache struct {
+// entry is a cached scrape result together with the time it was stored.
+type entry struct {
+	metricFamilies map[string]*promclient.MetricFamily
+	storedAt       time.Time
+}
+
+// MetricFamilyCache is the cache to store the parsed metric families and their corresponding container names.
+type MetricFamilyCache struct {
 	cachedMetrics Cache
+	maxAge        time.Duration
+	now           func() time.Time
 }
 
-// NewMetricCache returns a new RawMetricCache pointer.
-func NewMetricCache() *RawMetricCache {
-	return &RawMetricCache{
-		&sync.Map{},
+// NewMetricCache returns a new MetricFamilyCache pointer. Entries older than maxAge are treated as missing, unless
+// maxAge is zero.
+func NewMetricCache(maxAge time.Duration) *MetricFamilyCache {
+	return &MetricFamilyCache{
+		cachedMetrics: &sync.Map{},
+		maxAge:        maxAge,
+		now:           time.Now,
 	}
 }
 
-// GetAndInvalidate get and invalidate the metric if the metric is stored in the cache.
-func (c *RawMetricCache) GetAndInvalidate(containerName string) ([]byte, bool) {
-	metric, ok := c.cachedMetrics.LoadAndDelete(containerName)
+// GetAndInvalidate get and invalidate the metric families if they are stored in the cache.
+func (c *MetricFamilyCache) GetAndInvalidate(containerName string) (map[string]*promclient.MetricFamily, bool) {
+	cached, ok := c.cachedMetrics.LoadAndDelete(containerName)
+	if !ok {
+		return nil, false
+	}
+	telemetry.CachedSamples.DeleteLabelValues(containerName)
+	return c.fresh(cached.(entry))
+}
 
+// Get gets the metric families if they are stored in the cache, leaving them in place for later readers.
+func (c *MetricFamilyCache) Get(containerName string) (map[string]*promclient.MetricFamily, bool) {
+	cached, ok := c.cachedMetrics.Load(containerName)
 	if !ok {
 		return nil, false
 	}
-	return metric.([]byte), true
+	metricFamilies, ok := c.fresh(cached.(entry))
+	if !ok {
+		telemetry.CachedSamples.DeleteLabelValues(containerName)
+	}
+	return metricFamilies, ok
 }
 
-// Set sets the value of target metric within the metric cache.
-func (c *RawMetricCache) Set(containerName string, metrics []byte) {
-	if len(metrics) != 0 {
-		c.cachedMetrics.Store(containerName, metrics)
+// Set sets the metric families of the target container within the metric cache. A container without metrics is
+// cached as well, so that it replaces the metrics the container exposed before.
+func (c *MetricFamilyCache) Set(containerName string, metricFamilies map[string]*promclient.MetricFamily) {
+	c.cachedMetrics.Store(containerName, entry{metricFamilies, c.now()})
+	telemetry.CachedSamples.WithLabelValues(containerName).Set(float64(parse.CountSamples(metricFamilies)))
+}
+
+// fresh returns the metric families of the entry unless the entry is older than the maximum age.
+func (c *MetricFamilyCache) fresh(e entry) (map[string]*promclient.MetricFamily, bool) {
+	if c.maxAge != 0 && c.now().Sub(e.storedAt) > c.maxAge {
+		return nil, false
 	}
+	return e.metricFamilies, true
 }
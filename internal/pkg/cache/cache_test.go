@@ -2,42 +2,75 @@ package cache
 
 import (
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	promclient "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
 
 	mock_cache "github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/cache/mocks"
 )
 
-func TestGetAndInvalidate(t *testing.T) {
-	testCases := []struct {
-		name          string
-		key           string
-		ok            bool
-		expectedValue []byte
-	}{
-		{
-			"test if returns nil when couldn't find the associated key",
-			"random",
-			false,
-			nil,
-		},
-		{
-			"test if returns correct metric when find the associated key",
-			"container1",
-			true,
-			[]byte("this is metric"),
+const maxAge = 10 * time.Second
+
+var (
+	now            = time.Unix(1000, 0)
+	metricFamilies = map[string]*promclient.MetricFamily{
+		"metric1": {
+			Name: proto.String("metric1"),
+			Type: promclient.MetricType_UNTYPED.Enum(),
+			Metric: []*promclient.Metric{
+				{
+					Untyped: &promclient.Untyped{
+						Value: proto.Float64(1.234),
+					},
+				},
+			},
 		},
 	}
+)
 
-	for _, tc := range testCases {
+// readTestCases are shared by the tests of both ways of reading from the cache.
+var readTestCases = []struct {
+	name          string
+	key           string
+	cachedValue   any
+	ok            bool
+	expectedValue map[string]*promclient.MetricFamily
+}{
+	{
+		"test if returns nil when couldn't find the associated key",
+		"random",
+		nil,
+		false,
+		nil,
+	},
+	{
+		"test if returns correct metric when find the associated key",
+		"container1",
+		entry{metricFamilies, now.Add(-time.Second)},
+		true,
+		metricFamilies,
+	},
+	{
+		"test if returns nil when the associated entry is stale",
+		"container1",
+		entry{metricFamilies, now.Add(-maxAge - time.Second)},
+		false,
+		nil,
+	},
+}
+
+func TestGetAndInvalidate(t *testing.T) {
+	for _, tc := range readTestCases {
 		t.Run(tc.name, func(t *testing.T) {
 			ctr := gomock.NewController(t)
 			defer ctr.Finish()
 			mc := mock_cache.NewMockCache(ctr)
-			mc.EXPECT().LoadAndDelete(tc.key).Return(tc.expectedValue, tc.ok)
+			mc.EXPECT().LoadAndDelete(tc.key).Return(tc.cachedValue, tc.cachedValue != nil)
 
-			cache := RawMetricCache{mc}
+			cache := MetricFamilyCache{mc, maxAge, func() time.Time { return now }}
 			metric, ok := cache.GetAndInvalidate(tc.key)
 			assert.Equal(t, tc.expectedValue, metric)
 			assert.Equal(t, tc.ok, ok)
@@ -45,21 +78,50 @@ func TestGetAndInvalidate(t *testing.T) {
 	}
 }
 
+func TestGet(t *testing.T) {
+	for _, tc := range readTestCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mc := mock_cache.NewMockCache(ctr)
+			mc.EXPECT().Load(tc.key).Return(tc.cachedValue, tc.cachedValue != nil)
+
+			cache := MetricFamilyCache{mc, maxAge, func() time.Time { return now }}
+			metric, ok := cache.Get(tc.key)
+			assert.Equal(t, tc.expectedValue, metric)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestGetWithoutMaxAge(t *testing.T) {
+	cache := NewMetricCache(0)
+	cache.now = func() time.Time { return now }
+	cache.Set("container1", metricFamilies)
+
+	cache.now = func() time.Time { return now.Add(24 * time.Hour) }
+	for i := 0; i < 2; i++ {
+		metric, ok := cache.Get("container1")
+		assert.True(t, ok)
+		assert.Equal(t, metricFamilies, metric)
+	}
+}
+
 func TestSet(t *testing.T) {
 	testCases := []struct {
 		name   string
 		key    string
-		metric []byte
+		metric map[string]*promclient.MetricFamily
 	}{
 		{
 			"test if it can handle empty input",
 			"random",
-			make([]byte, 0),
+			map[string]*promclient.MetricFamily{},
 		},
 		{
 			"test if it can handle correct input",
 			"container1",
-			[]byte("this is metric"),
+			metricFamilies,
 		},
 	}
 
@@ -68,10 +130,8 @@ func TestSet(t *testing.T) {
 			ctr := gomock.NewController(t)
 			defer ctr.Finish()
 			mc := mock_cache.NewMockCache(ctr)
-			if len(tc.metric) != 0 {
-				mc.EXPECT().Store(tc.key, tc.metric)
-			}
-			cache := RawMetricCache{mc}
+			mc.EXPECT().Store(tc.key, entry{tc.metric, now})
+			cache := MetricFamilyCache{mc, maxAge, func() time.Time { return now }}
 			cache.Set(tc.key, tc.metric)
 		})
 	}
@@ -0,0 +1,38 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+)
+
+// authenticate adds the headers and the credentials of the target to the request.
+func (client *Client) authenticate(req *http.Request, auth utils.AuthConfig) error {
+	for name, value := range auth.Headers {
+		req.Header.Set(name, value)
+	}
+	switch {
+	case auth.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+auth.BearerToken)
+	case auth.BearerTokenFile != "":
+		token, err := client.files.Read(auth.BearerTokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read the bearer token file: %w", err)
+		}
+		// The files usually end with a newline, which is not part of the credentials.
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(token))
+	case auth.BasicAuth != (utils.BasicAuth{}):
+		password := auth.BasicAuth.Password
+		if auth.BasicAuth.PasswordFile != "" {
+			var err error
+			if password, err = client.files.Read(auth.BasicAuth.PasswordFile); err != nil {
+				return fmt.Errorf("failed to read the basic auth password file: %w", err)
+			}
+			password = strings.TrimSpace(password)
+		}
+		req.SetBasicAuth(auth.BasicAuth.Username, password)
+	}
+	return nil
+}
@@ -2,26 +2,38 @@ package client
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/filecache"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
 )
 
 const (
-	localPath      = "http://localhost"
 	defaultTimeout = 20 * time.Second
 	acceptEncoding = "gzip"
-	accept         = "application/openmetrics-text; version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`"
+	// accept prefers the delimited protobuf format, which is cheaper to decode than text.
+	accept = "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7," +
+		"application/openmetrics-text;version=1.0.0;q=0.6,application/openmetrics-text;version=0.0.1;q=0.55," +
+		"text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
 )
 
 var errStatusNotOK = errors.New("received a non-OK status")
 
+// ErrBodySizeLimit is returned when the metrics of a container are larger than the body size limit of its target.
+var ErrBodySizeLimit = errors.New("body size limit exceeded")
+
 // HTTPClient is a client interface that implements functionality for doing HTTP requests.
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -30,52 +42,111 @@ type HTTPClient interface {
 // Client is a thin wrapper around an HTTP client used to scrape the raw metrics from different containers in a pod.
 type Client struct {
 	httpClient HTTPClient
+	// mu guards tlsClients, the HTTP clients of the targets with TLS settings, one for each distinct setting.
+	mu         sync.Mutex
+	tlsClients map[utils.TLSConfig]*http.Client
+	files      filecache.Reader
 }
 
 // NewClient instantiates a new client.
 func NewClient() *Client {
-	return &Client{&http.Client{Timeout: defaultTimeout}}
+	return &Client{httpClient: &http.Client{Timeout: defaultTimeout}}
 }
 
-// ScrapeRawMetrics scrapes the metrics on the given port and returns raw metrics.
-func (client *Client) ScrapeRawMetrics(ctx context.Context, port int, endpoint string) (*bytes.Buffer, error) {
+// ScrapeRawMetrics scrapes the metrics of the given target and returns raw metrics, along with the exposition format
+// they are in according to the Content-Type of the response.
+func (client *Client) ScrapeRawMetrics(ctx context.Context, target utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+	start := time.Now()
+	defer func() {
+		telemetry.ScrapeDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	var rawMetrics bytes.Buffer
-	url := fmt.Sprintf("%s:%d%s", localPath, port, endpoint)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequest("GET", target.URL(), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GET request: %w", err)
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonRequest).Inc()
+		return nil, expfmt.FmtUnknown, fmt.Errorf("failed to create GET request: %w", err)
 	}
 	req.Header.Add("Accept-Encoding", acceptEncoding)
 	req.Header.Add("Accept", accept)
-	resp, err := client.httpClient.Do(req.WithContext(ctx))
+	if err := client.authenticate(req, target.Auth); err != nil {
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonAuth).Inc()
+		return nil, expfmt.FmtUnknown, err
+	}
+	resp, err := client.httpClientFor(target.TLS).Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf("failed to do GET request: %w", err)
+		telemetry.ScrapeErrors.WithLabelValues(doErrorReason(ctx, err)).Inc()
+		return nil, expfmt.FmtUnknown, fmt.Errorf("failed to do GET request: %w", err)
 	}
 	defer resp.Body.Close()
+	format := responseFormat(resp.Header)
 	if resp.StatusCode != http.StatusOK {
-
-		return nil, fmt.Errorf("server returned HTTP status %s: %w", resp.Status, errStatusNotOK)
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonStatus).Inc()
+		return nil, expfmt.FmtUnknown, fmt.Errorf("server returned HTTP status %s: %w", resp.Status, errStatusNotOK)
 	}
 
+	body := io.Reader(resp.Body)
+	copyReason := telemetry.ReasonRead
 	if resp.Header.Get("Content-Encoding") == "gzip" {
-		data, err := ioutil.ReadAll(resp.Body)
+		// The body is decompressed as it is read, so that a body exceeding the limit is never held whole.
+		gz, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			return nil, fmt.Errorf("unable to read response body: %w", err)
+			telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonDecompress).Inc()
+			return nil, expfmt.FmtUnknown, fmt.Errorf("failed to unzip gzip data: %w", err)
 		}
+		defer gz.Close()
+		body, copyReason = gz, telemetry.ReasonDecompress
+	}
 
-		data, err = utils.GzipToCompressData(data)
-		if err != nil {
-			return nil, fmt.Errorf("failed to unzip gzip data: %w", err)
-		}
-		rawMetrics = *bytes.NewBuffer(data)
-		return &rawMetrics, nil
+	// The limit applies to the decompressed body, since a small compressed body can expand to many times its size.
+	if _, err := io.Copy(&rawMetrics, limitReader(body, target.BodySizeLimit)); err != nil {
+		telemetry.ScrapeErrors.WithLabelValues(copyReason).Inc()
+		return nil, expfmt.FmtUnknown, fmt.Errorf("unable to copy raw metrics from response body: %w", err)
+	}
+	if exceedsLimit(int64(rawMetrics.Len()), target.BodySizeLimit) {
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonBodySizeLimit).Inc()
+		return nil, expfmt.FmtUnknown, fmt.Errorf("response body exceeds %d bytes: %w", target.BodySizeLimit, ErrBodySizeLimit)
 	}
 
-	if _, err := io.Copy(&rawMetrics, resp.Body); err != nil {
-		return nil, fmt.Errorf("unable to copy raw metrics from response body: %w", err)
+	return &rawMetrics, format, nil
+}
+
+// limitReader reads at most one byte more than the limit from the reader, which is enough to tell that a body
+// exceeds the limit without reading all of it. A limit of 0 leaves the reader unlimited.
+func limitReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
 	}
+	return io.LimitReader(r, limit+1)
+}
+
+// exceedsLimit reports whether the size exceeds the limit, if there is one.
+func exceedsLimit(size int64, limit int64) bool {
+	return limit > 0 && size > limit
+}
 
-	return &rawMetrics, nil
+// responseFormat returns the exposition format of the response according to its Content-Type. OpenMetrics, which
+// expfmt.ResponseFormat doesn't recognise, is told apart here whatever its version.
+func responseFormat(header http.Header) expfmt.Format {
+	mediatype, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && mediatype == expfmt.OpenMetricsType {
+		return expfmt.FmtOpenMetrics
+	}
+	return expfmt.ResponseFormat(header)
+}
+
+// doErrorReason tells a scrape that timed out or was cancelled from one that couldn't connect to the container.
+func doErrorReason(ctx context.Context, err error) string {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return telemetry.ReasonCanceled
+	}
+	var netErr net.Error
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return telemetry.ReasonTimeout
+	}
+	if isTLSError(err) {
+		return telemetry.ReasonTLS
+	}
+	return telemetry.ReasonConnection
 }
@@ -4,23 +4,27 @@ import (
 	"bytes"
 	"context"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"testing"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	mock_client "github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client/mocks"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
 )
 
-const (
-	metricPort = 13434
-	endpoint   = "/metrics"
-)
+var target = utils.Target{
+	Scheme: "http",
+	Host:   "localhost",
+	Port:   13434,
+	Path:   "/metrics",
+}
 
 func TestScrapeRawMetrics(t *testing.T) {
 
@@ -30,19 +34,26 @@ func TestScrapeRawMetrics(t *testing.T) {
 		response       *http.Response
 		err            error
 		expectedResult *bytes.Buffer
+		expectedFormat expfmt.Format
 		expectedErr    error
+		expectedReason string
 	}{
 		{
 			"reads a gzip response",
 			&http.Response{
-				Header:     map[string][]string{"Content-Encoding": {"gzip"}},
+				Header: map[string][]string{
+					"Content-Encoding": {"gzip"},
+					"Content-Type":     {"text/plain; version=0.0.4; charset=utf-8"},
+				},
 				Body:       ioutil.NopCloser(bytes.NewReader(utils.CompressDataToGzip([]byte("This is test 1234.")))),
 				Status:     "200 OK",
 				StatusCode: 200,
 			},
 			nil,
 			bytes.NewBuffer([]byte("This is test 1234.")),
+			expfmt.FmtText,
 			nil,
+			"",
 		},
 		{
 			"reads a compress response",
@@ -54,7 +65,42 @@ func TestScrapeRawMetrics(t *testing.T) {
 			},
 			nil,
 			bytes.NewBuffer([]byte("This is test 1234.")),
+			expfmt.FmtUnknown,
 			nil,
+			"",
+		},
+		{
+			"reads a delimited protobuf response",
+			&http.Response{
+				Header: map[string][]string{
+					"Content-Type": {"application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"},
+				},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte("\x00"))),
+				Status:     "200 OK",
+				StatusCode: 200,
+			},
+			nil,
+			bytes.NewBuffer([]byte("\x00")),
+			expfmt.FmtProtoDelim,
+			nil,
+			"",
+		},
+
+		{
+			"reads an OpenMetrics response",
+			&http.Response{
+				Header: map[string][]string{
+					"Content-Type": {"application/openmetrics-text; version=1.0.0; charset=utf-8"},
+				},
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte("# EOF\n"))),
+				Status:     "200 OK",
+				StatusCode: 200,
+			},
+			nil,
+			bytes.NewBuffer([]byte("# EOF\n")),
+			expfmt.FmtOpenMetrics,
+			nil,
+			"",
 		},
 
 		// 'Do' error test.
@@ -63,7 +109,9 @@ func TestScrapeRawMetrics(t *testing.T) {
 			nil,
 			doerr,
 			nil,
+			expfmt.FmtUnknown,
 			doerr,
+			telemetry.ReasonConnection,
 		},
 
 		{
@@ -75,7 +123,9 @@ func TestScrapeRawMetrics(t *testing.T) {
 			},
 			nil,
 			nil,
+			expfmt.FmtUnknown,
 			errStatusNotOK,
+			telemetry.ReasonStatus,
 		},
 	}
 
@@ -85,16 +135,85 @@ func TestScrapeRawMetrics(t *testing.T) {
 			ctr := gomock.NewController(t)
 			defer ctr.Finish()
 			mc := mock_client.NewMockHTTPClient(ctr)
-			req, err := http.NewRequest("GET", fmt.Sprintf("%s:%d%s", localPath, metricPort, endpoint), nil)
+			req, err := http.NewRequest("GET", "http://localhost:13434/metrics", nil)
 			require.NoError(t, err)
 			req.Header.Add("Accept-Encoding", acceptEncoding)
 			req.Header.Add("Accept", accept)
 
 			mc.EXPECT().Do(req).Return(tc.response, tc.err)
 			client := Client{httpClient: mc}
-			metric, err := client.ScrapeRawMetrics(context.Background(), metricPort, endpoint)
+			errorsBefore := testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(tc.expectedReason))
+			metric, format, err := client.ScrapeRawMetrics(context.Background(), target)
+			assert.ErrorIs(t, err, tc.expectedErr)
+			assert.Equal(t, tc.expectedResult, metric)
+			assert.Equal(t, tc.expectedFormat, format)
+			if tc.expectedReason != "" {
+				assert.Equal(t, errorsBefore+1, testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(tc.expectedReason)))
+			}
+		})
+	}
+}
+
+func TestScrapeRawMetricsBodySizeLimit(t *testing.T) {
+	limitedTarget := target
+	limitedTarget.BodySizeLimit = 18
+
+	testCases := []struct {
+		name           string
+		header         http.Header
+		body           []byte
+		expectedResult *bytes.Buffer
+		expectedErr    error
+	}{
+		{
+			"reads a body of the size of the limit",
+			nil,
+			[]byte("This is test 1234."),
+			bytes.NewBuffer([]byte("This is test 1234.")),
+			nil,
+		},
+		{
+			"returns an error when the body exceeds the limit",
+			nil,
+			[]byte("This is test 12345."),
+			nil,
+			ErrBodySizeLimit,
+		},
+		{
+			"reads a gzip body decompressing to the size of the limit",
+			http.Header{"Content-Encoding": {"gzip"}},
+			utils.CompressDataToGzip([]byte("This is test 1234.")),
+			bytes.NewBuffer([]byte("This is test 1234.")),
+			nil,
+		},
+		{
+			"returns an error when a gzip body decompresses beyond the limit",
+			http.Header{"Content-Encoding": {"gzip"}},
+			utils.CompressDataToGzip(bytes.Repeat([]byte("a"), 1000)),
+			nil,
+			ErrBodySizeLimit,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mc := mock_client.NewMockHTTPClient(ctr)
+			mc.EXPECT().Do(gomock.Any()).Return(&http.Response{
+				Header:     tc.header,
+				Body:       ioutil.NopCloser(bytes.NewReader(tc.body)),
+				Status:     "200 OK",
+				StatusCode: 200,
+			}, nil)
+			client := Client{httpClient: mc}
+			errorsBefore := testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonBodySizeLimit))
+			metric, _, err := client.ScrapeRawMetrics(context.Background(), limitedTarget)
 			assert.ErrorIs(t, err, tc.expectedErr)
 			assert.Equal(t, tc.expectedResult, metric)
+			if tc.expectedErr != nil {
+				assert.Equal(t, errorsBefore+1, testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonBodySizeLimit)))
+			}
 		})
 	}
 }
@@ -0,0 +1,183 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/filecache"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+)
+
+// tlsConfigError is a scrape failing because the TLS settings of its target couldn't be loaded.
+type tlsConfigError struct {
+	err error
+}
+
+func (e *tlsConfigError) Error() string {
+	return fmt.Sprintf("invalid TLS settings: %v", e.err)
+}
+
+func (e *tlsConfigError) Unwrap() error {
+	return e.err
+}
+
+// httpClientFor returns the HTTP client of the targets with the given TLS settings, creating it on first use. Targets
+// without TLS settings share the default client.
+func (client *Client) httpClientFor(config utils.TLSConfig) HTTPClient {
+	if config == (utils.TLSConfig{}) {
+		return client.httpClient
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if httpClient, ok := client.tlsClients[config]; ok {
+		return httpClient
+	}
+	if client.tlsClients == nil {
+		client.tlsClients = make(map[utils.TLSConfig]*http.Client)
+	}
+	httpClient := &http.Client{
+		Timeout:   defaultTimeout,
+		Transport: &tlsRoundTripper{config: config, files: &client.files},
+	}
+	client.tlsClients[config] = httpClient
+	return httpClient
+}
+
+// PruneTLSClients drops the HTTP clients of the TLS settings that none of the given targets has any more, closing
+// their idle connections, so that changing the TLS settings of a target doesn't leave the client of its previous
+// settings behind.
+func (client *Client) PruneTLSClients(targets map[string]utils.Target) {
+	inUse := make(map[utils.TLSConfig]bool, len(targets))
+	for _, target := range targets {
+		inUse[target.TLS] = true
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	for config, httpClient := range client.tlsClients {
+		if !inUse[config] {
+			httpClient.CloseIdleConnections()
+			delete(client.tlsClients, config)
+		}
+	}
+}
+
+// tlsRoundTripper does requests with the TLS settings of a target. The CA bundle is read again once it changed, and
+// the transport rebuilt with it, while the client certificate is parsed again on the first handshake after its
+// certificate or key file changed, so that rotated files are picked up without a restart.
+type tlsRoundTripper struct {
+	config utils.TLSConfig
+	files  *filecache.Reader
+
+	mu        sync.Mutex
+	ca        string
+	transport *http.Transport
+
+	certMu      sync.Mutex
+	cert        string
+	key         string
+	certificate *tls.Certificate
+}
+
+func (rt *tlsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport, err := rt.currentTransport()
+	if err != nil {
+		return nil, err
+	}
+	return transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the transport.
+func (rt *tlsRoundTripper) CloseIdleConnections() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.transport != nil {
+		rt.transport.CloseIdleConnections()
+	}
+}
+
+// currentTransport returns the transport for the current content of the CA bundle.
+func (rt *tlsRoundTripper) currentTransport() (*http.Transport, error) {
+	var ca string
+	if rt.config.CAFile != "" {
+		var err error
+		if ca, err = rt.files.Read(rt.config.CAFile); err != nil {
+			return nil, &tlsConfigError{fmt.Errorf("failed to read the CA file: %w", err)}
+		}
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.transport != nil && ca == rt.ca {
+		return rt.transport, nil
+	}
+	tlsConfig, err := newTLSConfig(rt.config, []byte(ca))
+	if err != nil {
+		return nil, err
+	}
+	if rt.config.CertFile != "" {
+		tlsConfig.GetClientCertificate = rt.clientCertificate
+	}
+	if rt.transport != nil {
+		// Connections verified with the previous CA bundle are not reused.
+		rt.transport.CloseIdleConnections()
+	}
+	rt.transport = http.DefaultTransport.(*http.Transport).Clone()
+	rt.transport.TLSClientConfig = tlsConfig
+	rt.ca = ca
+	return rt.transport, nil
+}
+
+// newTLSConfig builds the TLS configuration of the settings with the given CA bundle, which is empty to verify the
+// target with the system roots.
+func newTLSConfig(config utils.TLSConfig, ca []byte) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if len(ca) != 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, &tlsConfigError{fmt.Errorf("no certificates found in the CA file %s", config.CAFile)}
+		}
+	}
+	return tlsConfig, nil
+}
+
+// clientCertificate returns the client certificate for the current content of the certificate and key files.
+func (rt *tlsRoundTripper) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := rt.files.Read(rt.config.CertFile)
+	if err != nil {
+		return nil, &tlsConfigError{fmt.Errorf("failed to load the client certificate: %w", err)}
+	}
+	key, err := rt.files.Read(rt.config.KeyFile)
+	if err != nil {
+		return nil, &tlsConfigError{fmt.Errorf("failed to load the client certificate: %w", err)}
+	}
+
+	rt.certMu.Lock()
+	defer rt.certMu.Unlock()
+	if rt.certificate != nil && cert == rt.cert && key == rt.key {
+		return rt.certificate, nil
+	}
+	certificate, err := tls.X509KeyPair([]byte(cert), []byte(key))
+	if err != nil {
+		return nil, &tlsConfigError{fmt.Errorf("failed to load the client certificate: %w", err)}
+	}
+	rt.cert, rt.key, rt.certificate = cert, key, &certificate
+	return rt.certificate, nil
+}
+
+// isTLSError tells a scrape that failed because of the TLS settings of its target, or because the certificate of the
+// target couldn't be verified.
+func isTLSError(err error) bool {
+	var configErr *tlsConfigError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &configErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr)
+}
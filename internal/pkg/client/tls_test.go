@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/certtest"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/filecache"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+)
+
+// newTLSServer starts a server serving metrics with the certificate, requiring a client certificate signed by the
+// client CA when one is given.
+func newTLSServer(t *testing.T, cert *certtest.Certificate, clientCA *certtest.Certificate) (*httptest.Server, utils.Target) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = w.Write([]byte("requests 1\n"))
+	}))
+	keyPair, err := tls.X509KeyPair(cert.CertPEM, cert.KeyPEM)
+	require.NoError(t, err)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{keyPair}}
+	if clientCA != nil {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = x509.NewCertPool()
+		server.TLS.ClientCAs.AddCert(clientCA.Cert)
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+	return server, utils.Target{Scheme: "https", Host: "localhost", Port: port, Path: "/metrics"}
+}
+
+func TestScrapeRawMetricsTLS(t *testing.T) {
+	ca := certtest.New(t, nil)
+	otherCA := certtest.New(t, nil)
+	serverCert := certtest.New(t, ca)
+	clientCert := certtest.New(t, ca)
+
+	dir := t.TempDir()
+	caFile := certtest.WriteFile(t, dir, "ca.pem", ca.CertPEM)
+	otherCAFile := certtest.WriteFile(t, dir, "other-ca.pem", otherCA.CertPEM)
+	certFile := certtest.WriteFile(t, dir, "cert.pem", clientCert.CertPEM)
+	keyFile := certtest.WriteFile(t, dir, "key.pem", clientCert.KeyPEM)
+	invalidCAFile := certtest.WriteFile(t, dir, "invalid-ca.pem", []byte("not a certificate"))
+
+	testCases := []struct {
+		name              string
+		tlsConfig         utils.TLSConfig
+		requireClientCert bool
+		expectedErr       string
+		expectedReason    string
+	}{
+		{"scrapes a target trusted by the CA file", utils.TLSConfig{CAFile: caFile}, false, "", ""},
+		{"rejects a target the CA file doesn't trust", utils.TLSConfig{CAFile: otherCAFile}, false, "certificate signed by unknown authority", telemetry.ReasonTLS},
+		{"rejects a target the system roots don't trust", utils.TLSConfig{ServerName: "localhost"}, false, "certificate signed by unknown authority", telemetry.ReasonTLS},
+		{"skips the verification of the target", utils.TLSConfig{InsecureSkipVerify: true}, false, "", ""},
+		{"verifies the server name", utils.TLSConfig{CAFile: caFile, ServerName: "metrics.example.com"}, false, "not metrics.example.com", telemetry.ReasonTLS},
+		{"presents the client certificate", utils.TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, true, "", ""},
+		{"fails without the client certificate the target requires", utils.TLSConfig{CAFile: caFile}, true, "failed to do GET request", ""},
+		{"fails on a missing CA file", utils.TLSConfig{CAFile: filepath.Join(dir, "missing.pem")}, false, "failed to read the CA file", telemetry.ReasonTLS},
+		{"fails on a CA file without certificates", utils.TLSConfig{CAFile: invalidCAFile}, false, "no certificates found", telemetry.ReasonTLS},
+		{"fails on a missing client certificate", utils.TLSConfig{CAFile: caFile, CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}, true, "failed to load the client certificate", telemetry.ReasonTLS},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var clientCA *certtest.Certificate
+			if tc.requireClientCert {
+				clientCA = ca
+			}
+			_, target := newTLSServer(t, serverCert, clientCA)
+			target.TLS = tc.tlsConfig
+
+			errorsBefore := testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(tc.expectedReason))
+			metric, _, err := NewClient().ScrapeRawMetrics(context.Background(), target)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, "requests 1\n", metric.String())
+			}
+			if tc.expectedReason != "" {
+				assert.Equal(t, errorsBefore+1, testutil.ToFloat64(telemetry.ScrapeErrors.WithLabelValues(tc.expectedReason)))
+			}
+		})
+	}
+}
+
+func TestScrapeRawMetricsTLSRotation(t *testing.T) {
+	oldCA := certtest.New(t, nil)
+	newCA := certtest.New(t, nil)
+	oldClientCert := certtest.New(t, oldCA)
+	newClientCert := certtest.New(t, newCA)
+	_, target := newTLSServer(t, certtest.New(t, newCA), newCA)
+
+	dir := t.TempDir()
+	target.TLS = utils.TLSConfig{
+		CAFile:   certtest.WriteFile(t, dir, "ca.pem", oldCA.CertPEM),
+		CertFile: certtest.WriteFile(t, dir, "cert.pem", oldClientCert.CertPEM),
+		KeyFile:  certtest.WriteFile(t, dir, "key.pem", oldClientCert.KeyPEM),
+	}
+	client := NewClient()
+
+	_, _, err := client.ScrapeRawMetrics(context.Background(), target)
+	assert.ErrorContains(t, err, "certificate signed by unknown authority")
+
+	certtest.WriteFile(t, dir, "ca.pem", newCA.CertPEM)
+	_, _, err = client.ScrapeRawMetrics(context.Background(), target)
+	assert.Error(t, err, "the target should reject the old client certificate")
+
+	certtest.WriteFile(t, dir, "cert.pem", newClientCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", newClientCert.KeyPEM)
+	metric, _, err := client.ScrapeRawMetrics(context.Background(), target)
+	require.NoError(t, err)
+	assert.Equal(t, "requests 1\n", metric.String())
+}
+
+func TestClientCertificateCachesKeyPair(t *testing.T) {
+	ca := certtest.New(t, nil)
+	oldClientCert := certtest.New(t, ca)
+	newClientCert := certtest.New(t, ca)
+
+	dir := t.TempDir()
+	rt := &tlsRoundTripper{
+		config: utils.TLSConfig{
+			CertFile: certtest.WriteFile(t, dir, "cert.pem", oldClientCert.CertPEM),
+			KeyFile:  certtest.WriteFile(t, dir, "key.pem", oldClientCert.KeyPEM),
+		},
+		files: &filecache.Reader{},
+	}
+
+	first, err := rt.clientCertificate(nil)
+	require.NoError(t, err)
+	second, err := rt.clientCertificate(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, second, "the key pair is parsed once while its files are unchanged")
+
+	certtest.WriteFile(t, dir, "cert.pem", newClientCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", newClientCert.KeyPEM)
+	rotated, err := rt.clientCertificate(nil)
+	require.NoError(t, err)
+	assert.NotSame(t, first, rotated, "the key pair is parsed again once its files changed")
+	assert.Equal(t, newClientCert.Cert.Raw, rotated.Certificate[0])
+}
+
+func TestPruneTLSClients(t *testing.T) {
+	_, target := newTLSServer(t, certtest.New(t, certtest.New(t, nil)), nil)
+	target.TLS = utils.TLSConfig{InsecureSkipVerify: true}
+	client := NewClient()
+	_, _, err := client.ScrapeRawMetrics(context.Background(), target)
+	require.NoError(t, err)
+
+	client.PruneTLSClients(map[string]utils.Target{"container1": target})
+	assert.Contains(t, client.tlsClients, target.TLS, "the client of settings still in use is kept")
+
+	otherTarget := target
+	otherTarget.TLS = utils.TLSConfig{InsecureSkipVerify: true, ServerName: "localhost"}
+	client.PruneTLSClients(map[string]utils.Target{"container1": otherTarget})
+	assert.NotContains(t, client.tlsClients, target.TLS, "the client of settings no longer in use is dropped")
+}
@@ -0,0 +1,469 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/relabel"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server"
+)
+
+// Config is the configuration of the sidecar. It is built from the flags, and the settings of the configuration file
+// given with --config.file take precedence over them.
+type Config struct {
+	Endpoint                      string         `yaml:"endpoint"`
+	ExportTo                      int            `yaml:"export_to"`
+	ContainerLabel                string         `yaml:"container_label"`
+	ScrapeInterval                time.Duration  `yaml:"scrape_interval"`
+	ScrapeJitter                  time.Duration  `yaml:"scrape_jitter"`
+	ScrapeSpread                  bool           `yaml:"scrape_spread"`
+	ExcludeContainers             []string       `yaml:"exclude_containers"`
+	ContainerToPortMap            []string       `yaml:"container_to_port_map"`
+	Targets                       []TargetConfig `yaml:"targets"`
+	DefaultScrapePath             string         `yaml:"default_scrape_path"`
+	TelemetryEndpoint             string         `yaml:"telemetry_endpoint"`
+	AdminEndpoint                 string         `yaml:"admin_endpoint"`
+	TypeConflictPolicy            string         `yaml:"type_conflict_policy"`
+	LabelCollisionPolicy          string         `yaml:"label_collision_policy"`
+	CacheReadMode                 string         `yaml:"cache_read_mode"`
+	MaxCacheAge                   time.Duration  `yaml:"max_cache_age"`
+	ScrapeMode                    string         `yaml:"scrape_mode"`
+	ScrapeTimeout                 time.Duration  `yaml:"scrape_timeout"`
+	RequiredContainers            []string       `yaml:"required_containers"`
+	ReadinessDropsOnFailure       bool           `yaml:"readiness_drops_on_failure"`
+	NativeHistogramClassicBuckets bool           `yaml:"native_histogram_classic_buckets"`
+	// ExtraLabels are added to the metrics of every container. The labels of the file are merged into those of the
+	// flags.
+	ExtraLabels map[string]string `yaml:"extra_labels"`
+	// MetricRelabelConfigs are applied to the metrics of every container, before the rules of its target.
+	MetricRelabelConfigs []relabel.Config `yaml:"metric_relabel_configs"`
+	// Limits are the limits of every container, unless its target sets its own.
+	Limits `yaml:",inline"`
+}
+
+// Limits are the limits the metrics of a container are held to, 0 meaning no limit.
+type Limits struct {
+	SampleLimit           int   `yaml:"sample_limit"`
+	LabelLimit            int   `yaml:"label_limit"`
+	LabelNameLengthLimit  int   `yaml:"label_name_length_limit"`
+	LabelValueLengthLimit int   `yaml:"label_value_length_limit"`
+	BodySizeLimit         int64 `yaml:"body_size_limit"`
+}
+
+// TargetLimits are the limits of a single container. Limits that are left unset keep the limits of every container,
+// while those set to 0 lift them.
+type TargetLimits struct {
+	SampleLimit           *int   `yaml:"sample_limit"`
+	LabelLimit            *int   `yaml:"label_limit"`
+	LabelNameLengthLimit  *int   `yaml:"label_name_length_limit"`
+	LabelValueLengthLimit *int   `yaml:"label_value_length_limit"`
+	BodySizeLimit         *int64 `yaml:"body_size_limit"`
+}
+
+// TargetConfig is a container to scrape, given either by the URL its metrics are scraped from, or by a port on
+// localhost and an optional path.
+type TargetConfig struct {
+	Name           string        `yaml:"name"`
+	URL            string        `yaml:"url"`
+	Port           int           `yaml:"port"`
+	Path           string        `yaml:"path"`
+	ScrapeInterval time.Duration `yaml:"scrape_interval"`
+	// Labels are added to the metrics of the container, taking precedence over the extra labels of every container.
+	Labels map[string]string `yaml:"labels"`
+	// MetricRelabelConfigs are applied to the metrics of the container.
+	MetricRelabelConfigs []relabel.Config `yaml:"metric_relabel_configs"`
+	// Limits override the limits of every container where they are set.
+	Limits TargetLimits `yaml:",inline"`
+	// TLSConfig are the TLS settings of a container scraped over https.
+	TLSConfig utils.TLSConfig `yaml:"tls_config"`
+	// Auth is how the scrapes of the container are authenticated.
+	Auth utils.AuthConfig `yaml:",inline"`
+}
+
+const (
+	// envPrefix marks a label value that is read from an environment variable.
+	envPrefix = "env:"
+	// filePrefix marks a label value that is read from a file, such as a file of the Downward API.
+	filePrefix = "file:"
+)
+
+// Parse parses the YAML configuration on top of the base configuration and validates the result. Settings missing
+// from the YAML keep their value in the base configuration, and unknown settings are rejected.
+func Parse(data []byte, base Config) (*Config, error) {
+	config := base
+	// Decoding a map merges into it, so the map of the base configuration is copied first.
+	config.ExtraLabels = make(map[string]string, len(base.ExtraLabels))
+	for name, value := range base.ExtraLabels {
+		config.ExtraLabels[name] = value
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	// An empty file leaves the base configuration as it is.
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse the configuration: %w", err)
+	}
+	if _, _, err := config.Resolve(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Resolve validates the configuration and returns the options of the server and the targets of the containers to
+// scrape, leaving out the excluded containers.
+func (c *Config) Resolve() (server.Options, map[string]utils.Target, error) {
+	if err := utils.ValidateLabelName(c.ContainerLabel); err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid container label name %s: %w", c.ContainerLabel, err)
+	}
+	if c.ScrapeInterval <= 0 {
+		return server.Options{}, nil, fmt.Errorf("invalid scrape interval %s: must be positive", c.ScrapeInterval)
+	}
+	if c.ScrapeJitter < 0 {
+		return server.Options{}, nil, fmt.Errorf("invalid scrape jitter %s: must not be negative", c.ScrapeJitter)
+	}
+	if c.ScrapeTimeout <= 0 {
+		return server.Options{}, nil, fmt.Errorf("invalid scrape timeout %s: must be positive", c.ScrapeTimeout)
+	}
+	if c.MaxCacheAge < 0 {
+		return server.Options{}, nil, fmt.Errorf("invalid maximum cache age %s: must not be negative", c.MaxCacheAge)
+	}
+	typeConflictPolicy, err := mutate.ParseConflictPolicy(c.TypeConflictPolicy)
+	if err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid type conflict policy: %w", err)
+	}
+	labelCollisionPolicy, err := mutate.ParseLabelCollisionPolicy(c.LabelCollisionPolicy)
+	if err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid label collision policy: %w", err)
+	}
+	switch server.CacheReadMode(c.CacheReadMode) {
+	case server.CacheReadModeInvalidate, server.CacheReadModeRetain:
+	default:
+		return server.Options{}, nil, fmt.Errorf("unknown cache read mode %q", c.CacheReadMode)
+	}
+	switch server.ScrapeMode(c.ScrapeMode) {
+	case server.ScrapeModePoll, server.ScrapeModeOnDemand:
+	default:
+		return server.Options{}, nil, fmt.Errorf("unknown scrape mode %q", c.ScrapeMode)
+	}
+
+	extraLabels, err := resolveLabels(c.ExtraLabels, c.ContainerLabel)
+	if err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid extra labels: %w", err)
+	}
+	if err := c.Limits.validate(); err != nil {
+		return server.Options{}, nil, err
+	}
+	relabelRules, err := relabel.Compile(c.MetricRelabelConfigs)
+	if err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid metric relabel configs: %w", err)
+	}
+
+	if len(c.ContainerToPortMap) == 0 && len(c.Targets) == 0 {
+		return server.Options{}, nil, fmt.Errorf("no containers to scrape: neither container_to_port_map nor targets are set")
+	}
+	defaultScrapePath := c.DefaultScrapePath
+	if defaultScrapePath == "" {
+		defaultScrapePath = c.Endpoint
+	}
+	targets := make(map[string]utils.Target)
+	if len(c.ContainerToPortMap) != 0 {
+		if targets, err = utils.GenerateTargets(c.ContainerToPortMap, defaultScrapePath); err != nil {
+			return server.Options{}, nil, fmt.Errorf("failed to generate container targets: %w", err)
+		}
+	}
+	intervals := make(map[string]time.Duration)
+	targetLabels := make(map[string]map[string]string)
+	targetRelabelRules := make(map[string][]*relabel.Rule)
+	targetLimits := make(map[string]TargetLimits)
+	targetTLS := make(map[string]utils.TLSConfig)
+	targetAuth := make(map[string]utils.AuthConfig)
+	for i, target := range c.Targets {
+		containerTarget, err := target.target(defaultScrapePath)
+		if err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid target %d: %w", i, err)
+		}
+		if _, ok := targets[target.Name]; ok {
+			return server.Options{}, nil, fmt.Errorf("duplicate container name %s", target.Name)
+		}
+		targets[target.Name] = containerTarget
+		if target.ScrapeInterval < 0 {
+			return server.Options{}, nil, fmt.Errorf("invalid scrape interval %s of target %s: must not be negative", target.ScrapeInterval, target.Name)
+		}
+		if target.ScrapeInterval > 0 {
+			intervals[target.Name] = target.ScrapeInterval
+		}
+		if targetLabels[target.Name], err = resolveLabels(target.Labels, c.ContainerLabel); err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid labels of target %s: %w", target.Name, err)
+		}
+		if err := target.Limits.validate(); err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid target %s: %w", target.Name, err)
+		}
+		targetLimits[target.Name] = target.Limits
+		if err := target.TLSConfig.Validate(); err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid TLS config of target %s: %w", target.Name, err)
+		}
+		targetTLS[target.Name] = target.TLSConfig
+		if err := target.Auth.Validate(); err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid authentication of target %s: %w", target.Name, err)
+		}
+		targetAuth[target.Name] = target.Auth
+		if targetRelabelRules[target.Name], err = relabel.Compile(target.MetricRelabelConfigs); err != nil {
+			return server.Options{}, nil, fmt.Errorf("invalid metric relabel configs of target %s: %w", target.Name, err)
+		}
+	}
+	excluded, err := utils.NewContainerFilter(c.ExcludeContainers)
+	if err != nil {
+		return server.Options{}, nil, fmt.Errorf("invalid excluded containers: %w", err)
+	}
+	for containerName := range targets {
+		if excluded.Matches(containerName) {
+			delete(targets, containerName)
+			delete(intervals, containerName)
+		}
+	}
+	if len(targets) == 0 {
+		return server.Options{}, nil, fmt.Errorf("no containers are left to scrape once the excluded containers are left out")
+	}
+	required, err := requiredContainers(c.RequiredContainers, targets)
+	if err != nil {
+		return server.Options{}, nil, err
+	}
+	containerLabels := make(map[string]map[string]string)
+	for containerName := range targets {
+		labels := make(map[string]string, len(extraLabels)+len(targetLabels[containerName]))
+		for name, value := range extraLabels {
+			labels[name] = value
+		}
+		for name, value := range targetLabels[containerName] {
+			labels[name] = value
+		}
+		if len(labels) != 0 {
+			containerLabels[containerName] = labels
+		}
+	}
+	containerLimits := make(map[string]server.Limits)
+	for containerName, target := range targets {
+		if tlsConfig := targetTLS[containerName]; tlsConfig != (utils.TLSConfig{}) {
+			if target.Scheme != "https" {
+				return server.Options{}, nil, fmt.Errorf("target %s has TLS settings but is not scraped over https", containerName)
+			}
+			target.TLS = tlsConfig
+		}
+		target.Auth = targetAuth[containerName]
+		limits := c.Limits.override(targetLimits[containerName])
+		target.BodySizeLimit = limits.BodySizeLimit
+		targets[containerName] = target
+		if serverLimits := limits.server(); serverLimits != (server.Limits{}) {
+			containerLimits[containerName] = serverLimits
+		}
+	}
+	containerRelabelRules := make(map[string][]*relabel.Rule)
+	for containerName := range targets {
+		rules := append(append([]*relabel.Rule{}, relabelRules...), targetRelabelRules[containerName]...)
+		if len(rules) != 0 {
+			containerRelabelRules[containerName] = rules
+		}
+	}
+
+	return server.Options{
+		MetricPort:                    c.ExportTo,
+		Endpoint:                      c.Endpoint,
+		TelemetryEndpoint:             c.TelemetryEndpoint,
+		AdminEndpoint:                 c.AdminEndpoint,
+		TypeConflictPolicy:            typeConflictPolicy,
+		LabelCollisionPolicy:          labelCollisionPolicy,
+		CacheReadMode:                 server.CacheReadMode(c.CacheReadMode),
+		ContainerLabelName:            c.ContainerLabel,
+		ScrapeInterval:                c.ScrapeInterval,
+		ContainerScrapeIntervals:      intervals,
+		ScrapeJitter:                  c.ScrapeJitter,
+		ScrapeSpread:                  c.ScrapeSpread,
+		ScrapeMode:                    server.ScrapeMode(c.ScrapeMode),
+		ScrapeTimeout:                 c.ScrapeTimeout,
+		RequiredContainers:            required,
+		ReadinessDropsOnFailure:       c.ReadinessDropsOnFailure,
+		NativeHistogramClassicBuckets: c.NativeHistogramClassicBuckets,
+		ContainerExtraLabels:          containerLabels,
+		ContainerMetricRelabelRules:   containerRelabelRules,
+		ContainerLimits:               containerLimits,
+	}, targets, nil
+}
+
+// validate checks that none of the limits is negative.
+func (l Limits) validate() error {
+	if l.SampleLimit < 0 || l.LabelLimit < 0 || l.LabelNameLengthLimit < 0 || l.LabelValueLengthLimit < 0 || l.BodySizeLimit < 0 {
+		return fmt.Errorf("invalid limits: must not be negative")
+	}
+	return nil
+}
+
+// override returns the limits, with those the target limits set taking precedence.
+func (l Limits) override(other TargetLimits) Limits {
+	if other.SampleLimit != nil {
+		l.SampleLimit = *other.SampleLimit
+	}
+	if other.LabelLimit != nil {
+		l.LabelLimit = *other.LabelLimit
+	}
+	if other.LabelNameLengthLimit != nil {
+		l.LabelNameLengthLimit = *other.LabelNameLengthLimit
+	}
+	if other.LabelValueLengthLimit != nil {
+		l.LabelValueLengthLimit = *other.LabelValueLengthLimit
+	}
+	if other.BodySizeLimit != nil {
+		l.BodySizeLimit = *other.BodySizeLimit
+	}
+	return l
+}
+
+// validate checks that none of the limits that are set is negative.
+func (l TargetLimits) validate() error {
+	return Limits{}.override(l).validate()
+}
+
+// server returns the limits the server holds the metrics to once they are scraped.
+func (l Limits) server() server.Limits {
+	return server.Limits{
+		SampleLimit:           l.SampleLimit,
+		LabelLimit:            l.LabelLimit,
+		LabelNameLengthLimit:  l.LabelNameLengthLimit,
+		LabelValueLengthLimit: l.LabelValueLengthLimit,
+	}
+}
+
+// resolveLabels validates the names of the labels and resolves their values. A value given as env:<variable> is read
+// from the environment variable, and a value given as file:<path> from the file, so that labels such as the pod, the
+// namespace and the node can be taken from the Downward API. Labels whose value is empty are left out, since
+// Prometheus treats them as missing.
+func resolveLabels(labels map[string]string, containerLabel string) (map[string]string, error) {
+	resolved := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if err := utils.ValidateLabelName(name); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("label name %s is reserved", name)
+		}
+		if name == containerLabel {
+			return nil, fmt.Errorf("label %s is the container label", name)
+		}
+		switch {
+		case strings.HasPrefix(value, envPrefix):
+			variable := strings.TrimPrefix(value, envPrefix)
+			v, ok := os.LookupEnv(variable)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %s of label %s is not set", variable, name)
+			}
+			value = v
+		case strings.HasPrefix(value, filePrefix):
+			data, err := os.ReadFile(strings.TrimPrefix(value, filePrefix))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the value of label %s: %w", name, err)
+			}
+			value = strings.TrimSpace(string(data))
+		}
+		if value != "" {
+			resolved[name] = value
+		}
+	}
+	return resolved, nil
+}
+
+// requiredContainers returns the containers matching the patterns of the required containers, or nil if every
+// container is required.
+func requiredContainers(patterns []string, targets map[string]utils.Target) (map[string]bool, error) {
+	filter, err := utils.NewContainerFilter(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid required containers: %w", err)
+	}
+	if filter.Empty() {
+		return nil, nil
+	}
+	required := make(map[string]bool)
+	for containerName := range targets {
+		if filter.Matches(containerName) {
+			required[containerName] = true
+		}
+	}
+	return required, nil
+}
+
+// target returns the target the container is scraped from. Targets given by a port without a path are scraped on the
+// default path.
+func (t TargetConfig) target(defaultPath string) (utils.Target, error) {
+	if len(t.Name) == 0 {
+		return utils.Target{}, fmt.Errorf("missing container name")
+	}
+	if strings.ContainsAny(t.Name, ":=") {
+		return utils.Target{}, fmt.Errorf("invalid container name %s", t.Name)
+	}
+	var target utils.Target
+	switch {
+	case len(t.URL) != 0:
+		if t.Port != 0 || len(t.Path) != 0 {
+			return utils.Target{}, fmt.Errorf("container %s has both a url and a port or path", t.Name)
+		}
+		var err error
+		if target, err = utils.ParseTargetURL(t.URL, defaultPath); err != nil {
+			return utils.Target{}, fmt.Errorf("invalid url of container %s: %w", t.Name, err)
+		}
+	case t.Port == 0:
+		return utils.Target{}, fmt.Errorf("container %s has neither a url nor a port", t.Name)
+	default:
+		path := t.Path
+		if len(path) == 0 {
+			path = defaultPath
+		}
+		target = utils.NewLocalTarget(t.Port, path)
+	}
+	if err := target.Validate(); err != nil {
+		return utils.Target{}, fmt.Errorf("invalid target of container %s: %w", t.Name, err)
+	}
+	return target, nil
+}
+
+// CheckReloadable checks that the next configuration only differs from the previous one in settings that can be
+// changed while the sidecar is running.
+func CheckReloadable(previous *Config, next *Config) error {
+	var changed []string
+	if previous.ExportTo != next.ExportTo {
+		changed = append(changed, "export_to")
+	}
+	if previous.Endpoint != next.Endpoint {
+		changed = append(changed, "endpoint")
+	}
+	if previous.TelemetryEndpoint != next.TelemetryEndpoint {
+		changed = append(changed, "telemetry_endpoint")
+	}
+	if previous.AdminEndpoint != next.AdminEndpoint {
+		changed = append(changed, "admin_endpoint")
+	}
+	if previous.ScrapeJitter != next.ScrapeJitter {
+		changed = append(changed, "scrape_jitter")
+	}
+	if previous.ScrapeSpread != next.ScrapeSpread {
+		changed = append(changed, "scrape_spread")
+	}
+	if previous.CacheReadMode != next.CacheReadMode {
+		changed = append(changed, "cache_read_mode")
+	}
+	if previous.MaxCacheAge != next.MaxCacheAge {
+		changed = append(changed, "max_cache_age")
+	}
+	if previous.ScrapeMode != next.ScrapeMode {
+		changed = append(changed, "scrape_mode")
+	}
+	if len(changed) != 0 {
+		return fmt.Errorf("%s cannot be changed without a restart", strings.Join(changed, ", "))
+	}
+	return nil
+}
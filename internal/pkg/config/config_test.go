@@ -0,0 +1,524 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/relabel"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server"
+)
+
+// baseConfig is the configuration built from the default flags and a single container.
+var baseConfig = Config{
+	Endpoint:             "/metrics",
+	ExportTo:             13434,
+	ContainerLabel:       "container",
+	ScrapeInterval:       200 * time.Millisecond,
+	ContainerToPortMap:   []string{"container1:1"},
+	TelemetryEndpoint:    "/multiplexer/metrics",
+	TypeConflictPolicy:   "drop",
+	LabelCollisionPolicy: "rename",
+	CacheReadMode:        "invalidate",
+	ScrapeMode:           "poll",
+	ScrapeTimeout:        10 * time.Second,
+}
+
+// relabelRules compiles relabelling rules given in YAML.
+func relabelRules(rules ...string) []*relabel.Rule {
+	configs := make([]relabel.Config, len(rules))
+	for i, rule := range rules {
+		if err := yaml.Unmarshal([]byte(rule), &configs[i]); err != nil {
+			panic(err)
+		}
+	}
+	compiled, err := relabel.Compile(configs)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		name            string
+		yaml            string
+		expectedOpts    server.Options
+		expectedTargets map[string]utils.Target
+		expectedErr     string
+	}{
+		{
+			"test empty file keeps the flags",
+			"",
+			server.Options{
+				MetricPort:                  13434,
+				Endpoint:                    "/metrics",
+				TelemetryEndpoint:           "/multiplexer/metrics",
+				TypeConflictPolicy:          mutate.ConflictPolicyDrop,
+				LabelCollisionPolicy:        mutate.LabelCollisionPolicyRename,
+				CacheReadMode:               server.CacheReadModeInvalidate,
+				ContainerLabelName:          "container",
+				ScrapeInterval:              200 * time.Millisecond,
+				ContainerScrapeIntervals:    map[string]time.Duration{},
+				ContainerExtraLabels:        map[string]map[string]string{},
+				ContainerMetricRelabelRules: map[string][]*relabel.Rule{},
+				ContainerLimits:             map[string]server.Limits{},
+				ScrapeMode:                  server.ScrapeModePoll,
+				ScrapeTimeout:               10 * time.Second,
+			},
+			map[string]utils.Target{
+				"container1": {Scheme: "http", Host: "localhost", Port: 1, Path: "/metrics"},
+			},
+			"",
+		},
+		{
+			"test file settings take precedence over the flags",
+			`
+container_label: pod_container
+scrape_interval: 5s
+type_conflict_policy: rename
+label_collision_policy: keep
+exclude_containers: ["istio-*", "regex:container[3-9]"]
+required_containers: [container1]
+readiness_drops_on_failure: true
+native_histogram_classic_buckets: true
+container_to_port_map: []
+extra_labels:
+  namespace: payments
+  team: platform
+metric_relabel_configs:
+  - source_labels: [__name__]
+    regex: go_.*
+    action: drop
+sample_limit: 1000
+body_size_limit: 1048576
+targets:
+  - name: container1
+    port: 8080
+    path: /stats
+    scrape_interval: 30s
+    labels:
+      component: api
+      team: payments
+    metric_relabel_configs:
+      - regex: path
+        action: labeldrop
+    sample_limit: 5000
+    label_limit: 30
+    bearer_token_file: /var/run/secrets/tokens/metrics
+    headers:
+      X-Tenant: payments
+  - name: container2
+    url: https://10.0.0.1:9090/metrics?format=text
+    tls_config:
+      ca_file: /etc/tls/ca.pem
+      cert_file: /etc/tls/cert.pem
+      key_file: /etc/tls/key.pem
+      server_name: exporter.payments.svc
+  - name: container3
+    port: 3
+  - name: istio-proxy
+    port: 15090
+`,
+			server.Options{
+				MetricPort:                    13434,
+				Endpoint:                      "/metrics",
+				TelemetryEndpoint:             "/multiplexer/metrics",
+				TypeConflictPolicy:            mutate.ConflictPolicyRename,
+				LabelCollisionPolicy:          mutate.LabelCollisionPolicyKeep,
+				CacheReadMode:                 server.CacheReadModeInvalidate,
+				ContainerLabelName:            "pod_container",
+				ScrapeInterval:                5 * time.Second,
+				ContainerScrapeIntervals:      map[string]time.Duration{"container1": 30 * time.Second},
+				ScrapeMode:                    server.ScrapeModePoll,
+				ScrapeTimeout:                 10 * time.Second,
+				RequiredContainers:            map[string]bool{"container1": true},
+				ReadinessDropsOnFailure:       true,
+				NativeHistogramClassicBuckets: true,
+				ContainerExtraLabels: map[string]map[string]string{
+					"container1": {"namespace": "payments", "team": "payments", "component": "api"},
+					"container2": {"namespace": "payments", "team": "platform"},
+				},
+				ContainerMetricRelabelRules: map[string][]*relabel.Rule{
+					"container1": relabelRules(
+						"{source_labels: [__name__], regex: go_.*, action: drop}",
+						"{regex: path, action: labeldrop}",
+					),
+					"container2": relabelRules("{source_labels: [__name__], regex: go_.*, action: drop}"),
+				},
+				ContainerLimits: map[string]server.Limits{
+					"container1": {SampleLimit: 5000, LabelLimit: 30},
+					"container2": {SampleLimit: 1000},
+				},
+			},
+			map[string]utils.Target{
+				"container1": {
+					Scheme:        "http",
+					Host:          "localhost",
+					Port:          8080,
+					Path:          "/stats",
+					BodySizeLimit: 1048576,
+					Auth: utils.AuthConfig{
+						BearerTokenFile: "/var/run/secrets/tokens/metrics",
+						Headers:         map[string]string{"X-Tenant": "payments"},
+					},
+				},
+				"container2": {
+					Scheme:        "https",
+					Host:          "10.0.0.1",
+					Port:          9090,
+					Path:          "/metrics?format=text",
+					BodySizeLimit: 1048576,
+					TLS: utils.TLSConfig{
+						CAFile:     "/etc/tls/ca.pem",
+						CertFile:   "/etc/tls/cert.pem",
+						KeyFile:    "/etc/tls/key.pem",
+						ServerName: "exporter.payments.svc",
+					},
+				},
+			},
+			"",
+		},
+		{
+			"test unknown setting",
+			"scrape_intreval: 5s",
+			server.Options{},
+			nil,
+			"field scrape_intreval not found",
+		},
+		{
+			"test target with both a url and a port",
+			`
+targets:
+  - name: container2
+    url: http://localhost:2/metrics
+    port: 2
+`,
+			server.Options{},
+			nil,
+			"container container2 has both a url and a port or path",
+		},
+		{
+			"test target without a name",
+			`
+targets:
+  - port: 2
+`,
+			server.Options{},
+			nil,
+			"missing container name",
+		},
+		{
+			"test target with a path containing a colon",
+			`
+targets:
+  - name: container2
+    port: 2
+    path: /metrics:prometheus
+`,
+			server.Options{
+				MetricPort:                  13434,
+				Endpoint:                    "/metrics",
+				TelemetryEndpoint:           "/multiplexer/metrics",
+				TypeConflictPolicy:          mutate.ConflictPolicyDrop,
+				LabelCollisionPolicy:        mutate.LabelCollisionPolicyRename,
+				CacheReadMode:               server.CacheReadModeInvalidate,
+				ContainerLabelName:          "container",
+				ScrapeInterval:              200 * time.Millisecond,
+				ContainerScrapeIntervals:    map[string]time.Duration{},
+				ContainerExtraLabels:        map[string]map[string]string{},
+				ContainerMetricRelabelRules: map[string][]*relabel.Rule{},
+				ContainerLimits:             map[string]server.Limits{},
+				ScrapeMode:                  server.ScrapeModePoll,
+				ScrapeTimeout:               10 * time.Second,
+			},
+			map[string]utils.Target{
+				"container1": {Scheme: "http", Host: "localhost", Port: 1, Path: "/metrics"},
+				"container2": {Scheme: "http", Host: "localhost", Port: 2, Path: "/metrics:prometheus"},
+			},
+			"",
+		},
+		{
+			"test target lifting the limits of every container",
+			`
+sample_limit: 1000
+body_size_limit: 1048576
+targets:
+  - name: container2
+    port: 2
+    sample_limit: 0
+    body_size_limit: 0
+`,
+			server.Options{
+				MetricPort:                  13434,
+				Endpoint:                    "/metrics",
+				TelemetryEndpoint:           "/multiplexer/metrics",
+				TypeConflictPolicy:          mutate.ConflictPolicyDrop,
+				LabelCollisionPolicy:        mutate.LabelCollisionPolicyRename,
+				CacheReadMode:               server.CacheReadModeInvalidate,
+				ContainerLabelName:          "container",
+				ScrapeInterval:              200 * time.Millisecond,
+				ContainerScrapeIntervals:    map[string]time.Duration{},
+				ContainerExtraLabels:        map[string]map[string]string{},
+				ContainerMetricRelabelRules: map[string][]*relabel.Rule{},
+				ContainerLimits:             map[string]server.Limits{"container1": {SampleLimit: 1000}},
+				ScrapeMode:                  server.ScrapeModePoll,
+				ScrapeTimeout:               10 * time.Second,
+			},
+			map[string]utils.Target{
+				"container1": {Scheme: "http", Host: "localhost", Port: 1, Path: "/metrics", BodySizeLimit: 1048576},
+				"container2": {Scheme: "http", Host: "localhost", Port: 2, Path: "/metrics"},
+			},
+			"",
+		},
+		{
+			"test target with a relative path",
+			`
+targets:
+  - name: container2
+    port: 2
+    path: metrics
+`,
+			server.Options{},
+			nil,
+			`invalid target of container container2: path "metrics" must start with /`,
+		},
+		{
+			"test duplicate container between the flags and the file",
+			`
+targets:
+  - name: container1
+    port: 2
+`,
+			server.Options{},
+			nil,
+			"duplicate container name",
+		},
+		{
+			"test every container excluded",
+			"exclude_containers: [container1]",
+			server.Options{},
+			nil,
+			"no containers are left to scrape",
+		},
+		{
+			"test invalid excluded container pattern",
+			"exclude_containers: [\"regex:container(\"]",
+			server.Options{},
+			nil,
+			"invalid excluded containers",
+		},
+		{
+			"test invalid type conflict policy",
+			"type_conflict_policy: merge",
+			server.Options{},
+			nil,
+			"unknown type conflict policy",
+		},
+		{
+			"test extra label named like the container label",
+			"extra_labels: {container: api}",
+			server.Options{},
+			nil,
+			"label container is the container label",
+		},
+		{
+			"test reserved extra label name",
+			"extra_labels: {__address__: localhost}",
+			server.Options{},
+			nil,
+			"label name __address__ is reserved",
+		},
+		{
+			"test invalid metric relabel config",
+			"metric_relabel_configs: [{action: hashmod, target_label: shard}]",
+			server.Options{},
+			nil,
+			"requires non-zero modulus",
+		},
+		{
+			"test negative limit",
+			"label_limit: -1",
+			server.Options{},
+			nil,
+			"invalid limits: must not be negative",
+		},
+		{
+			"test negative target limit",
+			`
+targets:
+  - name: container2
+    port: 2
+    body_size_limit: -1
+`,
+			server.Options{},
+			nil,
+			"invalid target container2: invalid limits",
+		},
+		{
+			"test target with a client certificate without a key",
+			`
+targets:
+  - name: container2
+    url: https://localhost:2/metrics
+    tls_config: {cert_file: /etc/tls/cert.pem}
+`,
+			server.Options{},
+			nil,
+			"invalid TLS config of target container2",
+		},
+		{
+			"test target with both a bearer token and basic auth",
+			`
+targets:
+  - name: container2
+    port: 2
+    bearer_token: token
+    basic_auth: {username: prometheus, password_file: /etc/auth/password}
+`,
+			server.Options{},
+			nil,
+			"invalid authentication of target container2",
+		},
+		{
+			"test target with TLS settings scraped over http",
+			`
+targets:
+  - name: container2
+    port: 2
+    tls_config: {insecure_skip_verify: true}
+`,
+			server.Options{},
+			nil,
+			"target container2 has TLS settings but is not scraped over https",
+		},
+		{
+			"test invalid label collision policy",
+			"label_collision_policy: drop",
+			server.Options{},
+			nil,
+			"unknown label collision policy",
+		},
+		{
+			"test invalid scrape mode",
+			"scrape_mode: push",
+			server.Options{},
+			nil,
+			"unknown scrape mode",
+		},
+		{
+			"test invalid scrape interval",
+			"scrape_interval: 0s",
+			server.Options{},
+			nil,
+			"invalid scrape interval",
+		},
+		{
+			"test negative scrape jitter",
+			"scrape_jitter: -1ms",
+			server.Options{},
+			nil,
+			"invalid scrape jitter -1ms: must not be negative",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := Parse([]byte(tc.yaml), baseConfig)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			opts, targets, err := config.Resolve()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedOpts, opts)
+			assert.Equal(t, tc.expectedTargets, targets)
+		})
+	}
+}
+
+func TestResolveLabels(t *testing.T) {
+	t.Setenv("POD_NAME", "pod-1")
+	file := filepath.Join(t.TempDir(), "namespace")
+	require.NoError(t, os.WriteFile(file, []byte("payments\n"), 0o644))
+
+	testCases := []struct {
+		name           string
+		labels         map[string]string
+		expectedLabels map[string]string
+		errString      string
+	}{
+		{
+			"resolve literal values",
+			map[string]string{"team": "platform"},
+			map[string]string{"team": "platform"},
+			"",
+		},
+		{
+			"read a value from an environment variable",
+			map[string]string{"pod": "env:POD_NAME"},
+			map[string]string{"pod": "pod-1"},
+			"",
+		},
+		{
+			"read a value from a file",
+			map[string]string{"namespace": "file:" + file},
+			map[string]string{"namespace": "payments"},
+			"",
+		},
+		{
+			"leave out labels with an empty value",
+			map[string]string{"team": ""},
+			map[string]string{},
+			"",
+		},
+		{
+			"return an error when the environment variable is not set",
+			map[string]string{"node": "env:NODE_NAME_UNSET"},
+			nil,
+			"environment variable NODE_NAME_UNSET of label node is not set",
+		},
+		{
+			"return an error when the file is missing",
+			map[string]string{"node": "file:" + file + ".missing"},
+			nil,
+			"failed to read the value of label node",
+		},
+		{
+			"return an error for an invalid label name",
+			map[string]string{"pod-name": "pod-1"},
+			nil,
+			"invalid label name pod-name",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, err := resolveLabels(tc.labels, "container")
+			assert.Equal(t, tc.expectedLabels, labels)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckReloadable(t *testing.T) {
+	next := baseConfig
+	next.ScrapeInterval = time.Second
+	next.ContainerToPortMap = []string{"container1:1", "container2:2"}
+	assert.NoError(t, CheckReloadable(&baseConfig, &next))
+
+	next.ExportTo = 8080
+	next.ScrapeSpread = true
+	next.ScrapeMode = "on_demand"
+	assert.EqualError(t, CheckReloadable(&baseConfig, &next), "export_to, scrape_spread, scrape_mode cannot be changed without a restart")
+}
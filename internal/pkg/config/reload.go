@@ -0,0 +1,148 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server"
+)
+
+// ApplyFunc applies a reloaded configuration, such as server.Server.Reload.
+type ApplyFunc func(opts server.Options, targets map[string]utils.Target)
+
+// Reloader reloads the configuration file when asked to, and whenever its content changes. A configuration is only
+// applied once it has been validated, so a broken file leaves the sidecar running with the last good configuration.
+type Reloader struct {
+	filename string
+	base     Config
+	interval time.Duration
+
+	mu      sync.Mutex
+	current *Config
+	hash    [sha256.Size]byte
+}
+
+// NewReloader returns a new Reloader pointer, reading the configuration file on top of the base configuration and
+// checking it for changes every interval. A zero interval disables checking for changes.
+func NewReloader(filename string, base Config, interval time.Duration) *Reloader {
+	return &Reloader{
+		filename: filename,
+		base:     base,
+		interval: interval,
+	}
+}
+
+// Load loads the initial configuration, which later reloads are checked against.
+func (r *Reloader) Load() (*Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := os.ReadFile(r.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the configuration file %s: %w", r.filename, err)
+	}
+	config, err := Parse(data, r.base)
+	if err != nil {
+		return nil, err
+	}
+	r.current = config
+	r.hash = sha256.Sum256(data)
+	telemetry.ConfigLastReloadSuccessful.Set(1)
+	telemetry.ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+	return config, nil
+}
+
+// Run reloads the configuration on every signal received on reloadSignals, typically SIGHUP, and whenever the content
+// of the file changes, until the context is done. Every valid configuration is passed to apply.
+func (r *Reloader) Run(ctx context.Context, reloadSignals <-chan os.Signal, apply ApplyFunc) {
+	var tick <-chan time.Time
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reloadSignals:
+			if err := r.Reload(apply); err != nil {
+				log.Errorf("Failed to reload the configuration file %s: %v", r.filename, err)
+			}
+		case <-tick:
+			if err := r.reloadIfChanged(apply); err != nil {
+				log.Errorf("Failed to reload the configuration file %s: %v", r.filename, err)
+			}
+		}
+	}
+}
+
+// Reload reloads the configuration file, whether or not its content changed, and passes it to apply if it is valid.
+func (r *Reloader) Reload(apply ApplyFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := os.ReadFile(r.filename)
+	if err != nil {
+		recordReload(err)
+		return fmt.Errorf("failed to read the configuration file: %w", err)
+	}
+	return r.reload(data, apply)
+}
+
+// reloadIfChanged reloads the configuration file if its content changed since it was last read. A file that can't be
+// read is only logged, since it may be in the middle of being replaced.
+func (r *Reloader) reloadIfChanged(apply ApplyFunc) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data, err := os.ReadFile(r.filename)
+	if err != nil {
+		log.Warningf("Failed to read the configuration file %s: %v", r.filename, err)
+		return nil
+	}
+	if sha256.Sum256(data) == r.hash {
+		return nil
+	}
+	return r.reload(data, apply)
+}
+
+// reload validates the configuration and applies it. The content is remembered even if it is invalid, so that a
+// broken file is reported once rather than on every check for changes. The caller must hold mu.
+func (r *Reloader) reload(data []byte, apply ApplyFunc) error {
+	r.hash = sha256.Sum256(data)
+	config, err := Parse(data, r.base)
+	if err == nil && r.current != nil {
+		err = CheckReloadable(r.current, config)
+	}
+	var opts server.Options
+	var targets map[string]utils.Target
+	if err == nil {
+		opts, targets, err = config.Resolve()
+	}
+	recordReload(err)
+	if err != nil {
+		return err
+	}
+	apply(opts, targets)
+	r.current = config
+	log.Infof("Reloaded the configuration file %s", r.filename)
+	return nil
+}
+
+// recordReload reports the result of a reload through the telemetry metrics.
+func recordReload(err error) {
+	if err != nil {
+		telemetry.ConfigReloads.WithLabelValues("failure").Inc()
+		telemetry.ConfigLastReloadSuccessful.Set(0)
+		return
+	}
+	telemetry.ConfigReloads.WithLabelValues("success").Inc()
+	telemetry.ConfigLastReloadSuccessful.Set(1)
+	telemetry.ConfigLastReloadSuccessTimestamp.SetToCurrentTime()
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server"
+)
+
+// applied records the configurations applied by a Reloader.
+type applied chan map[string]utils.Target
+
+func (a applied) apply(_ server.Options, targets map[string]utils.Target) {
+	a <- targets
+}
+
+func writeConfig(t *testing.T, filename string, content string) {
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0600))
+}
+
+func TestReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, filename, "scrape_interval: 1s")
+	reloads := make(applied, 10)
+	reloader := NewReloader(filename, baseConfig, 0)
+	config, err := reloader.Load()
+	require.NoError(t, err)
+	assert.Equal(t, time.Second, config.ScrapeInterval)
+
+	writeConfig(t, filename, "container_to_port_map: [container1:1, container2:2]")
+	require.NoError(t, reloader.Reload(reloads.apply))
+	assert.Len(t, <-reloads, 2)
+	assert.Equal(t, float64(1), testutil.ToFloat64(telemetry.ConfigLastReloadSuccessful))
+
+	// An invalid configuration is never applied.
+	failures := testutil.ToFloat64(telemetry.ConfigReloads.WithLabelValues("failure"))
+	writeConfig(t, filename, "container_to_port_map: [container1]")
+	assert.Error(t, reloader.Reload(reloads.apply))
+	writeConfig(t, filename, "export_to: 8080")
+	assert.ErrorContains(t, reloader.Reload(reloads.apply), "export_to cannot be changed without a restart")
+	assert.Empty(t, reloads)
+	assert.Equal(t, failures+2, testutil.ToFloat64(telemetry.ConfigReloads.WithLabelValues("failure")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(telemetry.ConfigLastReloadSuccessful))
+}
+
+func TestRunReloads(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, filename, "")
+	reloads := make(applied, 10)
+	reloader := NewReloader(filename, baseConfig, 10*time.Millisecond)
+	_, err := reloader.Load()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloadSignals := make(chan os.Signal)
+	go reloader.Run(ctx, reloadSignals, reloads.apply)
+
+	// A change of the file is picked up without a signal.
+	writeConfig(t, filename, "container_to_port_map: [container1:1, container2:2]")
+	assert.Len(t, <-reloads, 2)
+
+	// A signal reloads the file even if it didn't change.
+	reloadSignals <- syscall.SIGHUP
+	assert.Len(t, <-reloads, 2)
+}
@@ -0,0 +1,46 @@
+// Package filecache reads files that are read over and over, such as credentials and certificates, reading each file
+// again only once it changed, so that rotated files are picked up without reading them on every use.
+package filecache
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// Reader reads files, reading each file again only once its modification time or size changed. The zero value is
+// ready to use.
+type Reader struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+// cachedFile is the content of a file along with the modification time and size it had when it was read.
+type cachedFile struct {
+	modTime time.Time
+	size    int64
+	content string
+}
+
+// Read returns the content of the file.
+func (r *Reader) Read(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if file, ok := r.files[path]; ok && file.modTime.Equal(info.ModTime()) && file.size == info.Size() {
+		return file.content, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if r.files == nil {
+		r.files = make(map[string]cachedFile)
+	}
+	file := cachedFile{modTime: info.ModTime(), size: info.Size(), content: string(data)}
+	r.files[path] = file
+	return file.content, nil
+}
@@ -0,0 +1,47 @@
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRead(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	modTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// write writes the content to the file and sets its modification time.
+	write := func(content string, modTime time.Time) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	testCases := []struct {
+		name            string
+		content         string
+		modTime         time.Time
+		expectedContent string
+	}{
+		{"reads the file", "first\n", modTime, "first\n"},
+		{"keeps the content while the file is unchanged", "other\n", modTime, "first\n"},
+		{"reads the file again once its size changed", "second content\n", modTime, "second content\n"},
+		{"reads the file again once its modification time changed", "third content\n", modTime.Add(time.Second), "third content\n"},
+	}
+
+	var reader Reader
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.content, tc.modTime)
+			content, err := reader.Read(path)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedContent, content)
+		})
+	}
+
+	_, err := reader.Read(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
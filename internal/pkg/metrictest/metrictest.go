@@ -0,0 +1,12 @@
+// Package metrictest builds the metrics the tests of the parsing and the relabelling of metrics expect.
+package metrictest
+
+import (
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// LabelPair returns a label with the given name and value.
+func LabelPair(name string, value string) *promclient.LabelPair {
+	return &promclient.LabelPair{Name: proto.String(name), Value: proto.String(value)}
+}
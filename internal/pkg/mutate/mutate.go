@@ -2,13 +2,46 @@ package mutate
 
 import (
 	"fmt"
+	"sort"
+	"time"
 
 	promclient "github.com/prometheus/client_model/go"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 	"google.golang.org/protobuf/proto"
 )
 
-// AppendLabelToMetrics appends a label to the metrics in order to indicate which container the given metric came from.
-func AppendLabelToMetrics(labelName string, containerName string, metricFamilies map[string]*promclient.MetricFamily) error {
+// LabelCollisionPolicy is the way the container label is added to a series that already has a label of the same name,
+// like the honor_labels option of Prometheus.
+type LabelCollisionPolicy string
+
+const (
+	// LabelCollisionPolicyRename renames the label of the series to exported_<name>, as Prometheus does unless
+	// honor_labels is set.
+	LabelCollisionPolicyRename LabelCollisionPolicy = "rename"
+	// LabelCollisionPolicyKeep keeps the label of the series, as Prometheus does when honor_labels is set.
+	LabelCollisionPolicyKeep LabelCollisionPolicy = "keep"
+	// LabelCollisionPolicyOverwrite replaces the value of the label of the series with the container name.
+	LabelCollisionPolicyOverwrite LabelCollisionPolicy = "overwrite"
+)
+
+// ParseLabelCollisionPolicy returns the LabelCollisionPolicy with the given name.
+func ParseLabelCollisionPolicy(policy string) (LabelCollisionPolicy, error) {
+	switch p := LabelCollisionPolicy(policy); p {
+	case LabelCollisionPolicyRename, LabelCollisionPolicyKeep, LabelCollisionPolicyOverwrite:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown label collision policy %q", policy)
+}
+
+// AppendLabelsToMetrics appends the container label, along with the extra labels of the container, to the metrics in
+// order to indicate which container the given metric came from. A series that already has a label of the same name as
+// one of them is handled according to the given policy. The labels of every series are sorted by name afterwards, as
+// the exposition formats expect. A container without metrics has nothing to label, which isn't an error.
+func AppendLabelsToMetrics(labelName string, containerName string, extraLabels map[string]string, policy LabelCollisionPolicy, metricFamilies map[string]*promclient.MetricFamily) error {
+	start := time.Now()
+	defer func() {
+		telemetry.LabelDuration.Observe(time.Since(start).Seconds())
+	}()
 
 	if len(labelName) == 0 {
 		return fmt.Errorf("empty container label name input")
@@ -16,20 +49,202 @@ func AppendLabelToMetrics(labelName string, containerName string, metricFamilies
 	if len(containerName) == 0 {
 		return fmt.Errorf("empty container name input")
 	}
-	if len(metricFamilies) == 0 {
-		return fmt.Errorf("empty MetricFamily map input")
+
+	added := make(map[string]string, len(extraLabels)+1)
+	for name, value := range extraLabels {
+		added[name] = value
+	}
+	added[labelName] = containerName
+	names := make([]string, 0, len(added))
+	for name := range added {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
 	for _, mf := range metricFamilies {
 		metrics := mf.GetMetric()
 
 		for _, m := range metrics {
-			label := promclient.LabelPair{
-				Name:  proto.String(labelName),
-				Value: proto.String(containerName),
-			}
-			m.Label = append(m.Label, &label)
+			m.Label = appendLabels(m.Label, names, added, policy)
 		}
 	}
 	return nil
 }
+
+// appendLabels adds the labels with the given names to the labels of a series according to the policy, and sorts
+// them by name.
+func appendLabels(labels []*promclient.LabelPair, names []string, added map[string]string, policy LabelCollisionPolicy) []*promclient.LabelPair {
+	for _, name := range names {
+		label := &promclient.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(added[name]),
+		}
+		switch i := labelIndex(labels, name); {
+		case i < 0:
+			labels = append(labels, label)
+		case policy == LabelCollisionPolicyKeep:
+		case policy == LabelCollisionPolicyOverwrite:
+			labels[i] = label
+		default:
+			// Like Prometheus, keep prefixing the name until it collides with no other label of the series.
+			exported := "exported_" + name
+			for isAdded(added, exported) || labelIndex(labels, exported) >= 0 {
+				exported = "exported_" + exported
+			}
+			labels[i] = &promclient.LabelPair{
+				Name:  proto.String(exported),
+				Value: labels[i].Value,
+			}
+			labels = append(labels, label)
+		}
+	}
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].GetName() < labels[j].GetName()
+	})
+	return labels
+}
+
+// isAdded reports whether a label with the given name is being added.
+func isAdded(added map[string]string, name string) bool {
+	_, ok := added[name]
+	return ok
+}
+
+// labelIndex returns the index of the label with the given name, or -1 if there is none.
+func labelIndex(labels []*promclient.LabelPair, name string) int {
+	for i, label := range labels {
+		if label.GetName() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ConflictPolicy is the way a type conflict between the metric families of two containers is resolved.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyDrop leaves the conflicting family of the later container out of the merged families.
+	ConflictPolicyDrop ConflictPolicy = "drop"
+	// ConflictPolicyRename prefixes the conflicting family of the later container with the container name.
+	ConflictPolicyRename ConflictPolicy = "rename"
+	// ConflictPolicyFail fails the scrape of the later container, leaving all of its families out of the merged families.
+	ConflictPolicyFail ConflictPolicy = "fail"
+)
+
+// ParseConflictPolicy returns the ConflictPolicy with the given name.
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(policy); p {
+	case ConflictPolicyDrop, ConflictPolicyRename, ConflictPolicyFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown type conflict policy %q", policy)
+}
+
+// ContainerMetricFamilies are the metric families scraped from a single container.
+type ContainerMetricFamilies struct {
+	ContainerName  string
+	MetricFamilies map[string]*promclient.MetricFamily
+}
+
+// TypeConflict describes a metric family whose type in a container differs from the type it was first merged with.
+type TypeConflict struct {
+	ContainerName string
+	FamilyName    string
+	MergedType    promclient.MetricType
+	ConflictType  promclient.MetricType
+	Policy        ConflictPolicy
+}
+
+// MergeMetricFamilies merges the metric families of several containers by family name, so that every family is
+// exposed with a single HELP and TYPE header. The first container that exposes a family decides its type; families
+// of later containers with a different type are resolved according to the given policy and reported as conflicts.
+// The given maps are not modified, since they may still be cached.
+func MergeMetricFamilies(containerMetricFamilies []ContainerMetricFamilies, policy ConflictPolicy) (map[string]*promclient.MetricFamily, []TypeConflict) {
+	merged := make(map[string]*promclient.MetricFamily)
+	var conflicts []TypeConflict
+	for _, c := range containerMetricFamilies {
+		containerConflicts := findTypeConflicts(merged, c, policy)
+		conflicts = append(conflicts, containerConflicts...)
+		if policy == ConflictPolicyFail && len(containerConflicts) != 0 {
+			continue
+		}
+
+		conflicting := make(map[string]bool, len(containerConflicts))
+		for _, conflict := range containerConflicts {
+			conflicting[conflict.FamilyName] = true
+		}
+		for name, mf := range c.MetricFamilies {
+			if !conflicting[name] {
+				mergeMetricFamily(merged, name, mf)
+				continue
+			}
+			if policy != ConflictPolicyRename {
+				continue
+			}
+			renamed := containerPrefix(c.ContainerName) + name
+			if existing, ok := merged[renamed]; ok && existing.GetType() != mf.GetType() {
+				// The renamed family conflicts as well, so there is nothing left to do but drop it.
+				continue
+			}
+			mergeMetricFamily(merged, renamed, &promclient.MetricFamily{
+				Name:   proto.String(renamed),
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Metric: mf.Metric,
+				Unit:   mf.Unit,
+			})
+		}
+	}
+	return merged, conflicts
+}
+
+// findTypeConflicts returns the families of the container whose type differs from the already merged families.
+func findTypeConflicts(merged map[string]*promclient.MetricFamily, c ContainerMetricFamilies, policy ConflictPolicy) []TypeConflict {
+	var conflicts []TypeConflict
+	for name, mf := range c.MetricFamilies {
+		existing, ok := merged[name]
+		if !ok || existing.GetType() == mf.GetType() {
+			continue
+		}
+		conflicts = append(conflicts, TypeConflict{
+			ContainerName: c.ContainerName,
+			FamilyName:    name,
+			MergedType:    existing.GetType(),
+			ConflictType:  mf.GetType(),
+			Policy:        policy,
+		})
+	}
+	return conflicts
+}
+
+// mergeMetricFamily adds the series of the given family to the merged family of the same name. The unit of the family
+// is kept from the first container that exposes it.
+func mergeMetricFamily(merged map[string]*promclient.MetricFamily, name string, mf *promclient.MetricFamily) {
+	existing, ok := merged[name]
+	if !ok {
+		merged[name] = &promclient.MetricFamily{
+			Name:   mf.Name,
+			Help:   mf.Help,
+			Type:   mf.Type,
+			Metric: append([]*promclient.Metric{}, mf.GetMetric()...),
+			Unit:   mf.Unit,
+		}
+		return
+	}
+	if existing.GetHelp() == "" {
+		existing.Help = mf.Help
+	}
+	existing.Metric = append(existing.Metric, mf.GetMetric()...)
+}
+
+// containerPrefix turns the container name into a prefix that is valid at the start of a metric name.
+func containerPrefix(containerName string) string {
+	prefix := []rune(containerName)
+	for i, r := range prefix {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '_' || r == ':' || (r >= '0' && r <= '9' && i > 0)) {
+			prefix[i] = '_'
+		}
+	}
+	return string(prefix) + "_"
+}
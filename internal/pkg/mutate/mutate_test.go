@@ -15,7 +15,7 @@ const (
 	labelName     = "multiplexed_container"
 )
 
-func TestAppendLabelToMetrics(t *testing.T) {
+func TestAppendLabelsToMetrics(t *testing.T) {
 	testCases := []struct {
 		name                   string
 		labelName              string
@@ -41,12 +41,12 @@ func TestAppendLabelToMetrics(t *testing.T) {
 			nil,
 		},
 		{
-			"return an error when input empty MetricFamily map",
+			"accept an empty MetricFamily map",
 			labelName,
 			containerName,
+			map[string]*promclient.MetricFamily{},
 			nil,
-			errors.New("empty MetricFamily map input"),
-			nil,
+			map[string]*promclient.MetricFamily{},
 		},
 		{
 			"get the expected result after appending",
@@ -153,11 +153,26 @@ func TestAppendLabelToMetrics(t *testing.T) {
 				},
 			},
 		},
+		{
+			"keep the exemplars and the metadata of the families",
+			labelName,
+			containerName,
+			map[string]*promclient.MetricFamily{
+				"requests_total": withUnit(exemplarFamily(), "requests"),
+			},
+			nil,
+			map[string]*promclient.MetricFamily{
+				"requests_total": withUnit(exemplarFamily(&promclient.LabelPair{
+					Name:  proto.String(labelName),
+					Value: proto.String(containerName),
+				}), "requests"),
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			err := AppendLabelToMetrics(tc.labelName, tc.containerName, tc.metricFamilies)
+			err := AppendLabelsToMetrics(tc.labelName, tc.containerName, nil, LabelCollisionPolicyRename, tc.metricFamilies)
 			assert.True(t, reflect.DeepEqual(tc.expectedMetricFamilies, tc.metricFamilies))
 			if tc.err != nil {
 				assert.ErrorContains(t, err, tc.err.Error())
@@ -167,3 +182,368 @@ func TestAppendLabelToMetrics(t *testing.T) {
 		})
 	}
 }
+
+// seriesLabels returns the labels of a series, given as alternating names and values.
+func seriesLabels(namesAndValues ...string) []*promclient.LabelPair {
+	labels := make([]*promclient.LabelPair, 0, len(namesAndValues)/2)
+	for i := 0; i < len(namesAndValues); i += 2 {
+		labels = append(labels, &promclient.LabelPair{
+			Name:  proto.String(namesAndValues[i]),
+			Value: proto.String(namesAndValues[i+1]),
+		})
+	}
+	return labels
+}
+
+func TestAppendLabelsToMetricsCollision(t *testing.T) {
+	testCases := []struct {
+		name           string
+		extraLabels    map[string]string
+		policy         LabelCollisionPolicy
+		labels         []*promclient.LabelPair
+		expectedLabels []*promclient.LabelPair
+	}{
+		{
+			"sort the labels after appending",
+			nil,
+			LabelCollisionPolicyRename,
+			seriesLabels("zone", "a", "app", "web"),
+			seriesLabels("app", "web", labelName, containerName, "zone", "a"),
+		},
+		{
+			"rename the existing label to exported_<name>",
+			nil,
+			LabelCollisionPolicyRename,
+			seriesLabels(labelName, "nested", "zone", "a"),
+			seriesLabels("exported_"+labelName, "nested", labelName, containerName, "zone", "a"),
+		},
+		{
+			"keep prefixing the existing label until it is unique",
+			nil,
+			LabelCollisionPolicyRename,
+			seriesLabels(labelName, "nested", "exported_"+labelName, "outer"),
+			seriesLabels("exported_exported_"+labelName, "nested", "exported_"+labelName, "outer", labelName, containerName),
+		},
+		{
+			"keep the existing label",
+			nil,
+			LabelCollisionPolicyKeep,
+			seriesLabels("zone", "a", labelName, "nested"),
+			seriesLabels(labelName, "nested", "zone", "a"),
+		},
+		{
+			"overwrite the existing label",
+			nil,
+			LabelCollisionPolicyOverwrite,
+			seriesLabels("zone", "a", labelName, "nested"),
+			seriesLabels(labelName, containerName, "zone", "a"),
+		},
+		{
+			"append the extra labels along with the container label",
+			map[string]string{"team": "payments", "component": "api"},
+			LabelCollisionPolicyRename,
+			seriesLabels("zone", "a"),
+			seriesLabels("component", "api", labelName, containerName, "team", "payments", "zone", "a"),
+		},
+		{
+			"apply the policy to the extra labels",
+			map[string]string{"team": "payments"},
+			LabelCollisionPolicyOverwrite,
+			seriesLabels("team", "search"),
+			seriesLabels(labelName, containerName, "team", "payments"),
+		},
+		{
+			"rename the existing label past the names of the extra labels",
+			map[string]string{"exported_team": "platform", "team": "payments"},
+			LabelCollisionPolicyRename,
+			seriesLabels("team", "search"),
+			seriesLabels("exported_exported_team", "search", "exported_team", "platform", labelName, containerName, "team", "payments"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metricFamilies := map[string]*promclient.MetricFamily{
+				"metric1": {
+					Name: proto.String("metric1"),
+					Type: promclient.MetricType_GAUGE.Enum(),
+					Metric: []*promclient.Metric{
+						{Label: tc.labels, Gauge: &promclient.Gauge{Value: proto.Float64(1)}},
+					},
+				},
+			}
+			assert.NoError(t, AppendLabelsToMetrics(labelName, containerName, tc.extraLabels, tc.policy, metricFamilies))
+			assert.Equal(t, tc.expectedLabels, metricFamilies["metric1"].Metric[0].Label)
+		})
+	}
+}
+
+// gaugeFamily returns a gauge MetricFamily with one series per given container.
+func gaugeFamily(name string, help string, containerNames ...string) *promclient.MetricFamily {
+	mf := &promclient.MetricFamily{
+		Name: proto.String(name),
+		Type: promclient.MetricType_GAUGE.Enum(),
+	}
+	if help != "" {
+		mf.Help = proto.String(help)
+	}
+	for _, c := range containerNames {
+		mf.Metric = append(mf.Metric, &promclient.Metric{
+			Label: []*promclient.LabelPair{
+				{
+					Name:  proto.String(labelName),
+					Value: proto.String(c),
+				},
+			},
+			Gauge: &promclient.Gauge{
+				Value: proto.Float64(1),
+			},
+		})
+	}
+	return mf
+}
+
+// exemplarFamily returns a counter MetricFamily whose single series has the given labels and an exemplar.
+func exemplarFamily(labels ...*promclient.LabelPair) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name: proto.String("requests_total"),
+		Type: promclient.MetricType_COUNTER.Enum(),
+		Metric: []*promclient.Metric{
+			{
+				Label: labels,
+				Counter: &promclient.Counter{
+					Value: proto.Float64(1),
+					Exemplar: &promclient.Exemplar{
+						Label: []*promclient.LabelPair{{Name: proto.String("trace_id"), Value: proto.String("abc")}},
+						Value: proto.Float64(1),
+					},
+				},
+			},
+		},
+	}
+}
+
+// withUnit sets the unit of the MetricFamily.
+func withUnit(mf *promclient.MetricFamily, unit string) *promclient.MetricFamily {
+	mf.Unit = proto.String(unit)
+	return mf
+}
+
+// counterFamily returns a counter MetricFamily with one series for the given container.
+func counterFamily(name string, containerName string) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name: proto.String(name),
+		Type: promclient.MetricType_COUNTER.Enum(),
+		Metric: []*promclient.Metric{
+			{
+				Label: []*promclient.LabelPair{
+					{
+						Name:  proto.String(labelName),
+						Value: proto.String(containerName),
+					},
+				},
+				Counter: &promclient.Counter{
+					Value: proto.Float64(1),
+				},
+			},
+		},
+	}
+}
+
+func TestMergeMetricFamilies(t *testing.T) {
+	testCases := []struct {
+		name                    string
+		containerMetricFamilies []ContainerMetricFamilies
+		policy                  ConflictPolicy
+		expectedMetricFamilies  map[string]*promclient.MetricFamily
+		expectedConflicts       []TypeConflict
+	}{
+		{
+			"return an empty map when there is nothing to merge",
+			nil,
+			ConflictPolicyDrop,
+			map[string]*promclient.MetricFamily{},
+			nil,
+		},
+		{
+			"merge same-named families into one family",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"go_goroutines": gaugeFamily("go_goroutines", "Number of goroutines.", "container1"),
+					"only_in_first": gaugeFamily("only_in_first", "", "container1"),
+				}},
+				{"container2", map[string]*promclient.MetricFamily{
+					"go_goroutines": gaugeFamily("go_goroutines", "Number of goroutines.", "container2"),
+				}},
+			},
+			ConflictPolicyDrop,
+			map[string]*promclient.MetricFamily{
+				"go_goroutines": gaugeFamily("go_goroutines", "Number of goroutines.", "container1", "container2"),
+				"only_in_first": gaugeFamily("only_in_first", "", "container1"),
+			},
+			nil,
+		},
+		{
+			"take the help text of the first container that has one",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"requests": gaugeFamily("requests", "", "container1"),
+				}},
+				{"container2", map[string]*promclient.MetricFamily{
+					"requests": gaugeFamily("requests", "Number of requests.", "container2"),
+				}},
+			},
+			ConflictPolicyDrop,
+			map[string]*promclient.MetricFamily{
+				"requests": gaugeFamily("requests", "Number of requests.", "container1", "container2"),
+			},
+			nil,
+		},
+		{
+			"keep the unit of the first container that exposes a family",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"latency_seconds": withUnit(gaugeFamily("latency_seconds", "", "container1"), "seconds"),
+				}},
+				{"container2", map[string]*promclient.MetricFamily{
+					"latency_seconds": gaugeFamily("latency_seconds", "", "container2"),
+				}},
+			},
+			ConflictPolicyDrop,
+			map[string]*promclient.MetricFamily{
+				"latency_seconds": withUnit(gaugeFamily("latency_seconds", "", "container1", "container2"), "seconds"),
+			},
+			nil,
+		},
+		{
+			"drop the conflicting family of the later container",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"requests": counterFamily("requests", "container1"),
+				}},
+				{"container2", map[string]*promclient.MetricFamily{
+					"requests":      gaugeFamily("requests", "", "container2"),
+					"go_goroutines": gaugeFamily("go_goroutines", "", "container2"),
+				}},
+			},
+			ConflictPolicyDrop,
+			map[string]*promclient.MetricFamily{
+				"requests":      counterFamily("requests", "container1"),
+				"go_goroutines": gaugeFamily("go_goroutines", "", "container2"),
+			},
+			[]TypeConflict{
+				{"container2", "requests", promclient.MetricType_COUNTER, promclient.MetricType_GAUGE, ConflictPolicyDrop},
+			},
+		},
+		{
+			"rename the conflicting family of the later container",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"requests": counterFamily("requests", "container1"),
+				}},
+				{"istio-proxy", map[string]*promclient.MetricFamily{
+					"requests":      gaugeFamily("requests", "", "istio-proxy"),
+					"go_goroutines": gaugeFamily("go_goroutines", "", "istio-proxy"),
+				}},
+			},
+			ConflictPolicyRename,
+			map[string]*promclient.MetricFamily{
+				"requests":             counterFamily("requests", "container1"),
+				"istio_proxy_requests": gaugeFamily("istio_proxy_requests", "", "istio-proxy"),
+				"go_goroutines":        gaugeFamily("go_goroutines", "", "istio-proxy"),
+			},
+			[]TypeConflict{
+				{"istio-proxy", "requests", promclient.MetricType_COUNTER, promclient.MetricType_GAUGE, ConflictPolicyRename},
+			},
+		},
+		{
+			"leave out all families of a conflicting container",
+			[]ContainerMetricFamilies{
+				{"container1", map[string]*promclient.MetricFamily{
+					"requests": counterFamily("requests", "container1"),
+				}},
+				{"container2", map[string]*promclient.MetricFamily{
+					"requests":      gaugeFamily("requests", "", "container2"),
+					"go_goroutines": gaugeFamily("go_goroutines", "", "container2"),
+				}},
+				{"container3", map[string]*promclient.MetricFamily{
+					"go_goroutines": gaugeFamily("go_goroutines", "", "container3"),
+				}},
+			},
+			ConflictPolicyFail,
+			map[string]*promclient.MetricFamily{
+				"requests":      counterFamily("requests", "container1"),
+				"go_goroutines": gaugeFamily("go_goroutines", "", "container3"),
+			},
+			[]TypeConflict{
+				{"container2", "requests", promclient.MetricType_COUNTER, promclient.MetricType_GAUGE, ConflictPolicyFail},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			merged, conflicts := MergeMetricFamilies(tc.containerMetricFamilies, tc.policy)
+			assert.True(t, reflect.DeepEqual(tc.expectedMetricFamilies, merged))
+			assert.ElementsMatch(t, tc.expectedConflicts, conflicts)
+			for _, c := range tc.containerMetricFamilies {
+				for name, mf := range c.MetricFamilies {
+					assert.Equal(t, name, mf.GetName(), "the input families must not be modified")
+					assert.Len(t, mf.GetMetric(), 1, "the input families must not be modified")
+				}
+			}
+		})
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		expectedPolicy ConflictPolicy
+		errString      string
+	}{
+		{"parse the drop policy", "drop", ConflictPolicyDrop, ""},
+		{"parse the rename policy", "rename", ConflictPolicyRename, ""},
+		{"parse the fail policy", "fail", ConflictPolicyFail, ""},
+		{"return an error for an unknown policy", "ignore", "", "unknown type conflict policy"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := ParseConflictPolicy(tc.policy)
+			assert.Equal(t, tc.expectedPolicy, policy)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseLabelCollisionPolicy(t *testing.T) {
+	testCases := []struct {
+		name           string
+		policy         string
+		expectedPolicy LabelCollisionPolicy
+		errString      string
+	}{
+		{"parse the rename policy", "rename", LabelCollisionPolicyRename, ""},
+		{"parse the keep policy", "keep", LabelCollisionPolicyKeep, ""},
+		{"parse the overwrite policy", "overwrite", LabelCollisionPolicyOverwrite, ""},
+		{"return an error for an unknown policy", "drop", "", "unknown label collision policy"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := ParseLabelCollisionPolicy(tc.policy)
+			assert.Equal(t, tc.expectedPolicy, policy)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package mutate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// TypeTracker keeps the types of the metric families of every container as of its latest scrape, so that type
+// conflicts between containers are detected and resolved when a container is scraped rather than every time the
+// metrics are served.
+type TypeTracker struct {
+	mu sync.Mutex
+	// types are the family types of each container, and conflicts the conflicting families of its latest scrape.
+	types     map[string]map[string]promclient.MetricType
+	conflicts map[string]map[string]bool
+}
+
+// NewTypeTracker returns a new TypeTracker pointer.
+func NewTypeTracker() *TypeTracker {
+	return &TypeTracker{
+		types:     make(map[string]map[string]promclient.MetricType),
+		conflicts: make(map[string]map[string]bool),
+	}
+}
+
+// Resolve checks the metric families of a freshly scraped container against those of the other containers. As when
+// merging, the first container in alphabetical order that exposes a family decides its type. The conflicting families
+// of the container are dropped from or renamed in the given map according to the policy, while ConflictPolicyFail
+// returns an error, failing the scrape, and keeps the types the container had before. Only the conflicts the previous
+// scrape of the container didn't have are returned, so that each conflict is reported once rather than on every scrape.
+func (t *TypeTracker) Resolve(containerName string, metricFamilies map[string]*promclient.MetricFamily, policy ConflictPolicy) ([]TypeConflict, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var conflicts []TypeConflict
+	for _, name := range names {
+		mf := metricFamilies[name]
+		if mergedType, ok := t.ownerType(containerName, name); ok && mergedType != mf.GetType() {
+			conflicts = append(conflicts, TypeConflict{
+				ContainerName: containerName,
+				FamilyName:    name,
+				MergedType:    mergedType,
+				ConflictType:  mf.GetType(),
+				Policy:        policy,
+			})
+		}
+	}
+	newConflicts := t.recordConflicts(containerName, conflicts)
+
+	if policy == ConflictPolicyFail && len(conflicts) != 0 {
+		familyNames := make([]string, 0, len(conflicts))
+		for _, conflict := range conflicts {
+			familyNames = append(familyNames, conflict.FamilyName)
+		}
+		return newConflicts, fmt.Errorf("the types of metric families %s conflict with other containers", strings.Join(familyNames, ", "))
+	}
+	for _, conflict := range conflicts {
+		mf := metricFamilies[conflict.FamilyName]
+		delete(metricFamilies, conflict.FamilyName)
+		if policy != ConflictPolicyRename {
+			continue
+		}
+		renamed := containerPrefix(containerName) + conflict.FamilyName
+		if _, ok := metricFamilies[renamed]; ok {
+			// The renamed family clashes with another family of the container, so there is nothing left to do but
+			// drop it.
+			continue
+		}
+		mf.Name = proto.String(renamed)
+		metricFamilies[renamed] = mf
+	}
+
+	types := make(map[string]promclient.MetricType, len(metricFamilies))
+	for name, mf := range metricFamilies {
+		types[name] = mf.GetType()
+	}
+	t.types[containerName] = types
+	return newConflicts, nil
+}
+
+// Forget removes the types of a container that is no longer scraped, so that it no longer decides the type of its
+// families.
+func (t *TypeTracker) Forget(containerName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.types, containerName)
+	delete(t.conflicts, containerName)
+}
+
+// ownerType returns the type of the family in the first container before the given one in alphabetical order that
+// exposes it, if there is one. The caller must hold mu.
+func (t *TypeTracker) ownerType(containerName string, familyName string) (promclient.MetricType, bool) {
+	owner := containerName
+	var ownerType promclient.MetricType
+	for other, types := range t.types {
+		if other >= owner {
+			continue
+		}
+		if familyType, ok := types[familyName]; ok {
+			owner, ownerType = other, familyType
+		}
+	}
+	return ownerType, owner != containerName
+}
+
+// recordConflicts records the conflicts of the latest scrape of the container, and returns those its previous scrape
+// didn't have. The caller must hold mu.
+func (t *TypeTracker) recordConflicts(containerName string, conflicts []TypeConflict) []TypeConflict {
+	previous := t.conflicts[containerName]
+	current := make(map[string]bool, len(conflicts))
+	var newConflicts []TypeConflict
+	for _, conflict := range conflicts {
+		current[conflict.FamilyName] = true
+		if !previous[conflict.FamilyName] {
+			newConflicts = append(newConflicts, conflict)
+		}
+	}
+	t.conflicts[containerName] = current
+	return newConflicts
+}
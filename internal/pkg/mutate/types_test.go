@@ -0,0 +1,124 @@
+package mutate
+
+import (
+	"testing"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypeTrackerResolve(t *testing.T) {
+	// scrape is a scrape of a container, resolved against the containers scraped before it.
+	type scrape struct {
+		containerName     string
+		metricFamilies    map[string]*promclient.MetricFamily
+		expectedFamilies  []string
+		expectedConflicts []string
+		expectedErr       string
+	}
+	testCases := []struct {
+		name    string
+		policy  ConflictPolicy
+		scrapes []scrape
+	}{
+		{
+			"keep families of the same type",
+			ConflictPolicyDrop,
+			[]scrape{
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container2")}, []string{"requests"}, nil, ""},
+			},
+		},
+		{
+			"drop the family of the later container, reporting the conflict once",
+			ConflictPolicyDrop,
+			[]scrape{
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{}, []string{"requests"}, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{}, nil, ""},
+			},
+		},
+		{
+			"let the earlier container decide the type whichever is scraped first",
+			ConflictPolicyDrop,
+			[]scrape{
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{"requests"}, nil, ""},
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{}, []string{"requests"}, ""},
+			},
+		},
+		{
+			"rename the family of the later container",
+			ConflictPolicyRename,
+			[]scrape{
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{"istio-proxy", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "istio-proxy")}, []string{"istio_proxy_requests"}, []string{"requests"}, ""},
+			},
+		},
+		{
+			"fail the scrape of the later container",
+			ConflictPolicyFail,
+			[]scrape{
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{
+					"container2",
+					map[string]*promclient.MetricFamily{
+						"requests":   counterFamily("requests", "container2"),
+						"go_threads": gaugeFamily("go_threads", "", "container2"),
+					},
+					[]string{"go_threads", "requests"},
+					[]string{"requests"},
+					"the types of metric families requests conflict with other containers",
+				},
+			},
+		},
+		{
+			"report a conflict again once it was resolved in between",
+			ConflictPolicyDrop,
+			[]scrape{
+				{"container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, []string{"requests"}, nil, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{}, []string{"requests"}, ""},
+				{"container2", map[string]*promclient.MetricFamily{}, []string{}, nil, ""},
+				{"container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, []string{}, []string{"requests"}, ""},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tracker := NewTypeTracker()
+			for _, s := range tc.scrapes {
+				conflicts, err := tracker.Resolve(s.containerName, s.metricFamilies, tc.policy)
+				if s.expectedErr != "" {
+					assert.EqualError(t, err, s.expectedErr)
+				} else {
+					assert.NoError(t, err)
+				}
+				families := []string{}
+				for name := range s.metricFamilies {
+					families = append(families, name)
+				}
+				assert.ElementsMatch(t, s.expectedFamilies, families)
+				var conflictingFamilies []string
+				for _, conflict := range conflicts {
+					assert.Equal(t, s.containerName, conflict.ContainerName)
+					assert.Equal(t, tc.policy, conflict.Policy)
+					conflictingFamilies = append(conflictingFamilies, conflict.FamilyName)
+				}
+				assert.Equal(t, s.expectedConflicts, conflictingFamilies)
+			}
+		})
+	}
+}
+
+func TestTypeTrackerForget(t *testing.T) {
+	tracker := NewTypeTracker()
+	_, err := tracker.Resolve("container1", map[string]*promclient.MetricFamily{"requests": gaugeFamily("requests", "", "container1")}, ConflictPolicyFail)
+	assert.NoError(t, err)
+	tracker.Forget("container1")
+
+	// Once the earlier container is gone, the later container decides the type.
+	conflicts, err := tracker.Resolve("container2", map[string]*promclient.MetricFamily{"requests": counterFamily("requests", "container2")}, ConflictPolicyFail)
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+}
@@ -0,0 +1,79 @@
+package parse
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Encoder encodes metric families into raw metrics in an exposition format.
+type Encoder interface {
+	// Encode writes a single metric family.
+	Encode(mf *promclient.MetricFamily) error
+	// Close writes whatever the format needs after the last metric family, such as the # EOF line of OpenMetrics.
+	Close() error
+}
+
+// NewEncoder returns an Encoder writing raw metrics in the given exposition format, or in the text format if the
+// format is unknown.
+func NewEncoder(w io.Writer, format expfmt.Format) Encoder {
+	// Every Encoder of expfmt implements Close as well.
+	switch format {
+	case expfmt.FmtOpenMetrics:
+		return &openMetricsEncoder{w: w}
+	case expfmt.FmtProtoDelim, expfmt.FmtProtoText, expfmt.FmtProtoCompact:
+		return expfmt.NewEncoder(w, format).(Encoder)
+	}
+	return expfmt.NewEncoder(w, expfmt.FmtText).(Encoder)
+}
+
+// openMetricsEncoder writes raw metrics in the OpenMetrics format. On top of what expfmt writes, which includes the
+// exemplars, it writes the unit of the metric families.
+type openMetricsEncoder struct {
+	w io.Writer
+}
+
+func (e *openMetricsEncoder) Encode(mf *promclient.MetricFamily) error {
+	buff := &bytes.Buffer{}
+	if _, err := expfmt.MetricFamilyToOpenMetrics(buff, mf); err != nil {
+		return err
+	}
+	rawMetrics := buff.Bytes()
+	if unit := mf.GetUnit(); unit != "" {
+		rawMetrics = insertUnit(rawMetrics, unit)
+	}
+	_, err := e.w.Write(rawMetrics)
+	return err
+}
+
+func (e *openMetricsEncoder) Close() error {
+	_, err := expfmt.FinalizeOpenMetrics(e.w)
+	return err
+}
+
+// insertUnit adds the UNIT line of a metric family after its TYPE line. The unit is left out if the name of the family
+// doesn't end with it, which OpenMetrics requires.
+func insertUnit(rawMetrics []byte, unit string) []byte {
+	const typePrefix = "# TYPE "
+	// The TYPE line either comes first or follows the HELP line, whose text can't contain a line break.
+	start := 0
+	if !bytes.HasPrefix(rawMetrics, []byte(typePrefix)) {
+		start = bytes.Index(rawMetrics, []byte("\n"+typePrefix)) + 1
+		if start == 0 {
+			return rawMetrics
+		}
+	}
+	end := start + bytes.IndexByte(rawMetrics[start:], '\n') + 1
+	fields := strings.Fields(string(rawMetrics[start+len(typePrefix) : end]))
+	if len(fields) != 2 || !strings.HasSuffix(fields[0], "_"+unit) {
+		return rawMetrics
+	}
+	unitLine := "# UNIT " + fields[0] + " " + unit + "\n"
+	withUnit := make([]byte, 0, len(rawMetrics)+len(unitLine))
+	withUnit = append(withUnit, rawMetrics[:end]...)
+	withUnit = append(withUnit, unitLine...)
+	return append(withUnit, rawMetrics[end:]...)
+}
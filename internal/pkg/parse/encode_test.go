@@ -0,0 +1,99 @@
+package parse
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/metrictest"
+)
+
+// latencyFamily returns a counter family with a unit and an exemplar.
+func latencyFamily() *promclient.MetricFamily {
+	mf := &promclient.MetricFamily{
+		Name: proto.String("latency_seconds_total"),
+		Help: proto.String("Time spent serving requests."),
+		Type: promclient.MetricType_COUNTER.Enum(),
+		Metric: []*promclient.Metric{
+			{
+				Label: []*promclient.LabelPair{metrictest.LabelPair("container", "container1")},
+				Counter: &promclient.Counter{
+					Value: proto.Float64(17.5),
+					Exemplar: &promclient.Exemplar{
+						Label:     []*promclient.LabelPair{metrictest.LabelPair("trace_id", "abc")},
+						Value:     proto.Float64(0.5),
+						Timestamp: timestamppb.New(time.Unix(1600000000, 0)),
+					},
+				},
+			},
+		},
+	}
+	mf.Unit = proto.String("seconds")
+	return mf
+}
+
+func TestMarshal(t *testing.T) {
+	testCases := []struct {
+		name      string
+		format    expfmt.Format
+		rawMetric string
+	}{
+		{
+			"encode the text format without the exemplars and the unit",
+			expfmt.FmtText,
+			`# HELP latency_seconds_total Time spent serving requests.
+# TYPE latency_seconds_total counter
+latency_seconds_total{container="container1"} 17.5
+`,
+		},
+		{
+			"encode the text format when the format is unknown",
+			expfmt.FmtUnknown,
+			`# HELP latency_seconds_total Time spent serving requests.
+# TYPE latency_seconds_total counter
+latency_seconds_total{container="container1"} 17.5
+`,
+		},
+		{
+			"encode the OpenMetrics format with the exemplars, the unit and # EOF",
+			expfmt.FmtOpenMetrics,
+			`# HELP latency_seconds Time spent serving requests.
+# TYPE latency_seconds counter
+# UNIT latency_seconds seconds
+latency_seconds_total{container="container1"} 17.5 # {trace_id="abc"} 0.5 1.6e+09
+# EOF
+`,
+		},
+		{
+			"encode the delimited protobuf format",
+			expfmt.FmtProtoDelim,
+			protoDelimited(latencyFamily()).String(),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rm, err := Marshal(map[string]*promclient.MetricFamily{"latency_seconds_total": latencyFamily()}, tc.format)
+			require.NoError(t, err)
+			assert.Equal(t, tc.rawMetric, rm.String())
+		})
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	for _, format := range []expfmt.Format{expfmt.FmtOpenMetrics, expfmt.FmtProtoDelim} {
+		t.Run(string(format), func(t *testing.T) {
+			rm, err := Marshal(map[string]*promclient.MetricFamily{"latency_seconds_total": latencyFamily()}, format)
+			require.NoError(t, err)
+			mf, err := Unmarshal(bytes.NewBuffer(rm.Bytes()), format)
+			require.NoError(t, err)
+			assertMetricFamiliesEqual(t, map[string]*promclient.MetricFamily{"latency_seconds_total": latencyFamily()}, mf)
+		})
+	}
+}
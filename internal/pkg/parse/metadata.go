@@ -0,0 +1,38 @@
+package parse
+
+import (
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Created returns the time the counter, summary or histogram of the metric was created, if it is known.
+func Created(m *promclient.Metric) (time.Time, bool) {
+	var created *timestamppb.Timestamp
+	switch {
+	case m.Counter != nil:
+		created = m.Counter.CreatedTimestamp
+	case m.Summary != nil:
+		created = m.Summary.CreatedTimestamp
+	case m.Histogram != nil:
+		created = m.Histogram.CreatedTimestamp
+	}
+	if created == nil {
+		return time.Time{}, false
+	}
+	return created.AsTime(), true
+}
+
+// SetCreated sets the time the counter, summary or histogram of the metric was created. Other metrics are left
+// unchanged.
+func SetCreated(m *promclient.Metric, created time.Time) {
+	switch {
+	case m.Counter != nil:
+		m.Counter.CreatedTimestamp = timestamppb.New(created)
+	case m.Summary != nil:
+		m.Summary.CreatedTimestamp = timestamppb.New(created)
+	case m.Histogram != nil:
+		m.Histogram.CreatedTimestamp = timestamppb.New(created)
+	}
+}
@@ -0,0 +1,68 @@
+package parse
+
+import (
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCreated(t *testing.T) {
+	created := time.Unix(1500000000, 250000000)
+	testCases := []struct {
+		name    string
+		metric  *promclient.Metric
+		created bool
+	}{
+		{
+			"keep the created timestamp of a counter",
+			&promclient.Metric{Counter: &promclient.Counter{Value: proto.Float64(1)}},
+			true,
+		},
+		{
+			"keep the created timestamp of a summary",
+			&promclient.Metric{Summary: &promclient.Summary{SampleCount: proto.Uint64(1)}},
+			true,
+		},
+		{
+			"keep the created timestamp of a histogram",
+			&promclient.Metric{Histogram: &promclient.Histogram{SampleCount: proto.Uint64(1)}},
+			true,
+		},
+		{
+			"ignore the created timestamp of a gauge",
+			&promclient.Metric{Gauge: &promclient.Gauge{Value: proto.Float64(1)}},
+			false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, ok := Created(tc.metric)
+			assert.False(t, ok)
+			SetCreated(tc.metric, created)
+			actual, ok := Created(tc.metric)
+			assert.Equal(t, tc.created, ok)
+			if tc.created {
+				assert.True(t, created.Equal(actual))
+			}
+		})
+	}
+}
+
+func TestMetadataSurvivesProtobuf(t *testing.T) {
+	created := time.Unix(1500000000, 0)
+	mf := requestsFamily("GET")
+	mf.Unit = proto.String("requests")
+	SetCreated(mf.Metric[0], created)
+
+	decoded, err := Unmarshal(protoDelimited(mf), expfmt.FmtProtoDelim)
+	require.NoError(t, err)
+	assert.Equal(t, "requests", decoded["requests_total"].GetUnit())
+	actual, ok := Created(decoded["requests_total"].Metric[0])
+	assert.True(t, ok)
+	assert.True(t, created.Equal(actual))
+}
@@ -0,0 +1,116 @@
+package parse
+
+import (
+	"math"
+	"sort"
+
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// IsNativeHistogram reports whether the histogram has a native part.
+func IsNativeHistogram(h *promclient.Histogram) bool {
+	return h.Schema != nil || h.ZeroThreshold != nil || h.ZeroCount != nil || h.ZeroCountFloat != nil ||
+		len(h.NegativeSpan) != 0 || len(h.PositiveSpan) != 0
+}
+
+// AddClassicBuckets adds classic buckets to the histograms that only have native buckets, so that Prometheus servers
+// that don't support native histograms, and scrapers of the text formats, get their distribution as well. The native
+// buckets are kept, so the histograms are served to Prometheus servers that do support them unchanged. Histograms
+// that have classic buckets already are left alone.
+func AddClassicBuckets(metricFamilies map[string]*promclient.MetricFamily) {
+	for _, mf := range metricFamilies {
+		if mf.GetType() != promclient.MetricType_HISTOGRAM {
+			continue
+		}
+		for _, m := range mf.Metric {
+			h := m.GetHistogram()
+			if h == nil || len(h.Bucket) != 0 {
+				continue
+			}
+			if IsNativeHistogram(h) {
+				h.Bucket = classicBuckets(h)
+			}
+		}
+	}
+}
+
+// classicBuckets returns the cumulative classic buckets the native buckets add up to, from the most negative upper
+// bound to +Inf.
+func classicBuckets(h *promclient.Histogram) []*promclient.Bucket {
+	type bucket struct {
+		upperBound float64
+		count      float64
+	}
+	schema := h.GetSchema()
+	// A negative bucket ranges from -base^index to -base^(index-1), a positive one from base^(index-1) to base^index.
+	var buckets []bucket
+	eachNativeBucket(h.NegativeSpan, h.NegativeDelta, h.NegativeCount, func(index int32, count float64) {
+		buckets = append(buckets, bucket{-bound(schema, index-1), count})
+	})
+	zeroCount := float64(h.GetZeroCount())
+	if h.ZeroCountFloat != nil {
+		zeroCount = h.GetZeroCountFloat()
+	}
+	buckets = append(buckets, bucket{h.GetZeroThreshold(), zeroCount})
+	eachNativeBucket(h.PositiveSpan, h.PositiveDelta, h.PositiveCount, func(index int32, count float64) {
+		buckets = append(buckets, bucket{bound(schema, index), count})
+	})
+	sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].upperBound < buckets[j].upperBound })
+
+	sampleCount := float64(h.GetSampleCount())
+	if h.SampleCountFloat != nil {
+		sampleCount = h.GetSampleCountFloat()
+	}
+	classic := make([]*promclient.Bucket, 0, len(buckets)+1)
+	cumulative := 0.0
+	for _, b := range buckets {
+		cumulative += b.count
+		if len(classic) != 0 && classic[len(classic)-1].GetUpperBound() == b.upperBound {
+			classic[len(classic)-1].CumulativeCount = proto.Uint64(uint64(math.Round(cumulative)))
+			continue
+		}
+		classic = append(classic, &promclient.Bucket{
+			UpperBound:      proto.Float64(b.upperBound),
+			CumulativeCount: proto.Uint64(uint64(math.Round(cumulative))),
+		})
+	}
+	return append(classic, &promclient.Bucket{
+		UpperBound:      proto.Float64(math.Inf(+1)),
+		CumulativeCount: proto.Uint64(uint64(math.Round(sampleCount))),
+	})
+}
+
+// bound returns the upper bound of the positive bucket with the given index, base^index where the base is
+// 2^(2^-schema).
+func bound(schema int32, index int32) float64 {
+	return math.Exp2(float64(index) * math.Exp2(-float64(schema)))
+}
+
+// eachNativeBucket calls f with the index and the absolute count of every bucket on one side of the zero bucket.
+// Integer histograms carry the counts as deltas to the previous bucket, float histograms as absolute counts.
+func eachNativeBucket(spans []*promclient.BucketSpan, deltas []int64, counts []float64, f func(index int32, count float64)) {
+	i := 0
+	count := 0.0
+	var index int32
+	for s, span := range spans {
+		if s == 0 {
+			index = span.GetOffset()
+		} else {
+			index += span.GetOffset()
+		}
+		for j := uint32(0); j < span.GetLength(); j++ {
+			switch {
+			case i < len(deltas):
+				count += float64(deltas[i])
+			case i < len(counts):
+				count = counts[i]
+			default:
+				return
+			}
+			f(index, count)
+			index++
+			i++
+		}
+	}
+}
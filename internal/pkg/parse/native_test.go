@@ -0,0 +1,143 @@
+package parse
+
+import (
+	"math"
+	"testing"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/metrictest"
+)
+
+// nativeHistogramFamily returns a histogram family with the given classic buckets, and native buckets with schema 0: a
+// zero bucket of 1 observation, a negative bucket of 2 observations between -2 and -1, and positive buckets of 1, 2
+// and 1 observations up to 1, 2 and 8.
+func nativeHistogramFamily(buckets ...*promclient.Bucket) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name: proto.String("latency"),
+		Type: promclient.MetricType_HISTOGRAM.Enum(),
+		Metric: []*promclient.Metric{
+			{
+				Label: []*promclient.LabelPair{metrictest.LabelPair("container", "container1")},
+				Histogram: &promclient.Histogram{
+					SampleCount:   proto.Uint64(7),
+					SampleSum:     proto.Float64(10),
+					Bucket:        buckets,
+					Schema:        proto.Int32(0),
+					ZeroThreshold: proto.Float64(0.001),
+					ZeroCount:     proto.Uint64(1),
+					NegativeSpan:  []*promclient.BucketSpan{bucketSpan(1, 1)},
+					NegativeDelta: []int64{2},
+					PositiveSpan:  []*promclient.BucketSpan{bucketSpan(0, 2), bucketSpan(1, 1)},
+					PositiveDelta: []int64{1, 1, -1},
+				},
+			},
+		},
+	}
+}
+
+// bucketSpan returns a span of native buckets.
+func bucketSpan(offset int32, length uint32) *promclient.BucketSpan {
+	return &promclient.BucketSpan{Offset: proto.Int32(offset), Length: proto.Uint32(length)}
+}
+
+// classicBucket returns a classic bucket.
+func classicBucket(upperBound float64, cumulativeCount uint64) *promclient.Bucket {
+	return &promclient.Bucket{UpperBound: proto.Float64(upperBound), CumulativeCount: proto.Uint64(cumulativeCount)}
+}
+
+func TestNativeHistogramPassthrough(t *testing.T) {
+	testCases := []struct {
+		name string
+		mf   *promclient.MetricFamily
+	}{
+		{
+			"keep a native histogram",
+			nativeHistogramFamily(),
+		},
+		{
+			"keep a histogram with both classic and native buckets",
+			nativeHistogramFamily(classicBucket(1, 4), classicBucket(math.Inf(+1), 7)),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mf, err := Unmarshal(protoDelimited(tc.mf), expfmt.FmtProtoDelim)
+			require.NoError(t, err)
+			rm, err := Marshal(mf, expfmt.FmtProtoDelim)
+			require.NoError(t, err)
+			assert.Equal(t, protoDelimited(tc.mf).Bytes(), rm.Bytes())
+		})
+	}
+}
+
+func TestAddClassicBuckets(t *testing.T) {
+	testCases := []struct {
+		name            string
+		mf              *promclient.MetricFamily
+		expectedBuckets []*promclient.Bucket
+	}{
+		{
+			"add classic buckets to a native histogram",
+			nativeHistogramFamily(),
+			[]*promclient.Bucket{
+				classicBucket(-1, 2),
+				classicBucket(0.001, 3),
+				classicBucket(1, 4),
+				classicBucket(2, 6),
+				classicBucket(8, 7),
+				classicBucket(math.Inf(+1), 7),
+			},
+		},
+		{
+			"leave the classic buckets of a histogram with both kinds of buckets",
+			nativeHistogramFamily(classicBucket(1, 4), classicBucket(math.Inf(+1), 7)),
+			[]*promclient.Bucket{
+				classicBucket(1, 4),
+				classicBucket(math.Inf(+1), 7),
+			},
+		},
+		{
+			"leave a classic histogram",
+			&promclient.MetricFamily{
+				Name: proto.String("latency"),
+				Type: promclient.MetricType_HISTOGRAM.Enum(),
+				Metric: []*promclient.Metric{
+					{Histogram: &promclient.Histogram{SampleCount: proto.Uint64(0), SampleSum: proto.Float64(0)}},
+				},
+			},
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			AddClassicBuckets(map[string]*promclient.MetricFamily{"latency": tc.mf})
+			assert.Equal(t, tc.expectedBuckets, tc.mf.Metric[0].Histogram.Bucket)
+		})
+	}
+}
+
+func TestAddClassicBucketsKeepsNativeBuckets(t *testing.T) {
+	mf := nativeHistogramFamily()
+	AddClassicBuckets(map[string]*promclient.MetricFamily{"latency": mf})
+	expected := nativeHistogramFamily().Metric[0].Histogram
+	expected.Bucket = mf.Metric[0].Histogram.Bucket
+	assert.True(t, proto.Equal(expected, mf.Metric[0].Histogram))
+
+	rm, err := Marshal(map[string]*promclient.MetricFamily{"latency": mf}, expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, `# TYPE latency histogram
+latency_bucket{container="container1",le="-1"} 2
+latency_bucket{container="container1",le="0.001"} 3
+latency_bucket{container="container1",le="1"} 4
+latency_bucket{container="container1",le="2"} 6
+latency_bucket{container="container1",le="8"} 7
+latency_bucket{container="container1",le="+Inf"} 7
+latency_sum{container="container1"} 10
+latency_count{container="container1"} 7
+`, rm.String())
+}
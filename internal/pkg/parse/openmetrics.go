@@ -0,0 +1,640 @@
+package parse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The types of metric families in the OpenMetrics format.
+const (
+	omCounter        = "counter"
+	omGauge          = "gauge"
+	omHistogram      = "histogram"
+	omGaugeHistogram = "gaugehistogram"
+	omSummary        = "summary"
+	omInfo           = "info"
+	omStateSet       = "stateset"
+	omUnknown        = "unknown"
+)
+
+// omSuffixes are the suffixes the names of the samples of each type of metric family may have.
+var omSuffixes = map[string][]string{
+	omCounter:        {"_total", "_created"},
+	omGauge:          {""},
+	omHistogram:      {"_bucket", "_count", "_sum", "_created"},
+	omGaugeHistogram: {"_bucket", "_gcount", "_gsum"},
+	omSummary:        {"", "_count", "_sum", "_created"},
+	omInfo:           {"_info"},
+	omStateSet:       {""},
+	omUnknown:        {""},
+}
+
+// omFamily is an OpenMetrics metric family being parsed, which turns into one or more MetricFamily objects.
+type omFamily struct {
+	name     string
+	typ      string
+	help     *string
+	unit     string
+	sampled  bool
+	families map[string]*promclient.MetricFamily
+	// metrics are the metrics of the family by family name and label set, without the le and quantile labels.
+	metrics map[string]*promclient.Metric
+	// samples are the label sets of the samples seen so far by sample name, to reject duplicate samples.
+	samples map[string]bool
+}
+
+// omSample is a single line of samples in the OpenMetrics format.
+type omSample struct {
+	name        string
+	labels      []*promclient.LabelPair
+	value       float64
+	timestampMs *int64
+	exemplar    *promclient.Exemplar
+}
+
+// openMetricsParser parses raw metrics in the OpenMetrics text format. Exemplars of counters and histogram buckets,
+// the units of metric families, and the created timestamps of counters, summaries and histograms are kept. Info and
+// state set families are turned into gauges, and gauge histograms into a gauge family per sample name, the same way
+// Prometheus ingests them.
+type openMetricsParser struct {
+	metricFamilies map[string]*promclient.MetricFamily
+	current        *omFamily
+	// done are the names of the families that have been parsed, which mustn't appear again.
+	done map[string]bool
+}
+
+// unmarshalOpenMetrics parses raw metrics in the OpenMetrics text format to MetricFamily objects.
+func unmarshalOpenMetrics(metrics *bytes.Buffer) (map[string]*promclient.MetricFamily, error) {
+	p := &openMetricsParser{
+		metricFamilies: make(map[string]*promclient.MetricFamily),
+		done:           make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(metrics)
+	scanner.Buffer(nil, math.MaxInt32)
+	lineNumber := 0
+	eof := false
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if eof {
+			return nil, fmt.Errorf("failed to parse OpenMetrics raw metrics to MetricFamily: line %d: content after # EOF", lineNumber)
+		}
+		var err error
+		switch {
+		case line == "# EOF":
+			eof = true
+			err = p.finishFamily()
+		case strings.HasPrefix(line, "#"):
+			err = p.parseMetadata(line)
+		default:
+			err = p.parseSampleLine(line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse OpenMetrics raw metrics to MetricFamily: line %d: %w", lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read OpenMetrics raw metrics: %w", err)
+	}
+	if !eof {
+		return nil, fmt.Errorf("failed to parse OpenMetrics raw metrics to MetricFamily: missing # EOF")
+	}
+	return p.metricFamilies, nil
+}
+
+// parseMetadata parses a HELP, TYPE or UNIT line, which has to come before the samples of its family.
+func (p *openMetricsParser) parseMetadata(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return fmt.Errorf("invalid metadata line %q", line)
+	}
+	keyword, name := fields[1], fields[2]
+	if !validMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	value := ""
+	if len(fields) == 4 {
+		value = fields[3]
+	}
+	if p.current == nil || p.current.name != name {
+		if err := p.startFamily(name); err != nil {
+			return err
+		}
+	} else if p.current.sampled {
+		return fmt.Errorf("metadata of metric family %s after its samples", name)
+	}
+
+	family := p.current
+	switch keyword {
+	case "HELP":
+		if family.help != nil {
+			return fmt.Errorf("duplicate HELP of metric family %s", name)
+		}
+		help, err := unescape(value, false)
+		if err != nil {
+			return fmt.Errorf("invalid HELP of metric family %s: %w", name, err)
+		}
+		family.help = proto.String(help)
+	case "TYPE":
+		if family.typ != omUnknown {
+			return fmt.Errorf("duplicate TYPE of metric family %s", name)
+		}
+		if _, ok := omSuffixes[value]; !ok {
+			return fmt.Errorf("unknown type %q of metric family %s", value, name)
+		}
+		family.typ = value
+	case "UNIT":
+		if family.unit != "" {
+			return fmt.Errorf("duplicate UNIT of metric family %s", name)
+		}
+		if value != "" && !strings.HasSuffix(name, "_"+value) {
+			return fmt.Errorf("metric family %s doesn't end with its unit %s", name, value)
+		}
+		family.unit = value
+	default:
+		return fmt.Errorf("invalid metadata line %q", line)
+	}
+	return nil
+}
+
+// parseSampleLine parses a line of samples and adds the sample to its family.
+func (p *openMetricsParser) parseSampleLine(line string) error {
+	sample, err := parseSample(line)
+	if err != nil {
+		return err
+	}
+	if p.current == nil || !p.current.hasSample(sample.name) {
+		if err := p.startFamily(sample.name); err != nil {
+			return err
+		}
+	}
+	p.current.sampled = true
+	return p.current.add(sample)
+}
+
+// startFamily finishes the current family and starts a new one.
+func (p *openMetricsParser) startFamily(name string) error {
+	if err := p.finishFamily(); err != nil {
+		return err
+	}
+	if p.done[name] {
+		return fmt.Errorf("metric family %s appears more than once", name)
+	}
+	p.current = &omFamily{
+		name:     name,
+		typ:      omUnknown,
+		families: make(map[string]*promclient.MetricFamily),
+		metrics:  make(map[string]*promclient.Metric),
+		samples:  make(map[string]bool),
+	}
+	return nil
+}
+
+// finishFamily checks the current family is complete and adds its MetricFamily objects to the parsed ones.
+func (p *openMetricsParser) finishFamily() error {
+	family := p.current
+	if family == nil {
+		return nil
+	}
+	p.current = nil
+	p.done[family.name] = true
+	for name, mf := range family.families {
+		if _, ok := p.metricFamilies[name]; ok {
+			return fmt.Errorf("metric family %s clashes with another metric family", name)
+		}
+		for _, m := range mf.Metric {
+			if err := completeMetric(name, m); err != nil {
+				return err
+			}
+		}
+		mf.Help = family.help
+		if family.unit != "" {
+			mf.Unit = proto.String(family.unit)
+		}
+		p.metricFamilies[name] = mf
+	}
+	return nil
+}
+
+// completeMetric checks the metric has a value and derives the count of a histogram from its +Inf bucket if needed.
+func completeMetric(name string, m *promclient.Metric) error {
+	switch {
+	case m.Counter != nil && m.Counter.Value == nil:
+		return fmt.Errorf("counter %s has a created timestamp but no value", name)
+	case m.Histogram != nil:
+		buckets := m.Histogram.Bucket
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+		if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+			return fmt.Errorf("histogram %s has no +Inf bucket", name)
+		}
+		if m.Histogram.SampleCount == nil {
+			m.Histogram.SampleCount = proto.Uint64(buckets[len(buckets)-1].GetCumulativeCount())
+		}
+	case m.Summary != nil:
+		quantiles := m.Summary.Quantile
+		sort.Slice(quantiles, func(i, j int) bool { return quantiles[i].GetQuantile() < quantiles[j].GetQuantile() })
+	}
+	return nil
+}
+
+// hasSample reports whether a sample with the given name belongs to the family.
+func (f *omFamily) hasSample(name string) bool {
+	if !strings.HasPrefix(name, f.name) {
+		return false
+	}
+	suffix := name[len(f.name):]
+	for _, s := range omSuffixes[f.typ] {
+		if s == suffix {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds the sample to the MetricFamily objects of the family.
+func (f *omFamily) add(sample omSample) error {
+	key := sample.name + labelsKey(sample.labels, "")
+	if f.samples[key] {
+		return fmt.Errorf("duplicate sample %s", sample.name)
+	}
+	f.samples[key] = true
+
+	suffix := sample.name[len(f.name):]
+	switch f.typ {
+	case omCounter:
+		m := f.metric(f.name+"_total", promclient.MetricType_COUNTER, sample)
+		if m.Counter == nil {
+			m.Counter = &promclient.Counter{}
+		}
+		if suffix == "_created" {
+			SetCreated(m, secondsToTime(sample.value))
+			return nil
+		}
+		m.Counter.Value = proto.Float64(sample.value)
+		m.Counter.Exemplar = sample.exemplar
+	case omGauge, omStateSet, omInfo, omGaugeHistogram:
+		// Gauge histograms have no type of their own in client_model, so each of their samples is a gauge.
+		m := f.metric(sample.name, promclient.MetricType_GAUGE, sample)
+		m.Gauge = &promclient.Gauge{Value: proto.Float64(sample.value)}
+	case omUnknown:
+		m := f.metric(sample.name, promclient.MetricType_UNTYPED, sample)
+		m.Untyped = &promclient.Untyped{Value: proto.Float64(sample.value)}
+	case omHistogram:
+		return f.addHistogramSample(suffix, sample)
+	case omSummary:
+		return f.addSummarySample(suffix, sample)
+	}
+	return nil
+}
+
+// addHistogramSample adds a bucket, the count, the sum or the created timestamp of a histogram.
+func (f *omFamily) addHistogramSample(suffix string, sample omSample) error {
+	m := f.metric(f.name, promclient.MetricType_HISTOGRAM, sample)
+	if m.Histogram == nil {
+		m.Histogram = &promclient.Histogram{}
+	}
+	switch suffix {
+	case "_bucket":
+		le, ok := labelValue(sample.labels, "le")
+		if !ok {
+			return fmt.Errorf("bucket of histogram %s without le label", f.name)
+		}
+		upperBound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return fmt.Errorf("invalid le label %q of histogram %s", le, f.name)
+		}
+		m.Histogram.Bucket = append(m.Histogram.Bucket, &promclient.Bucket{
+			UpperBound:      proto.Float64(upperBound),
+			CumulativeCount: proto.Uint64(uint64(sample.value)),
+			Exemplar:        sample.exemplar,
+		})
+	case "_count":
+		m.Histogram.SampleCount = proto.Uint64(uint64(sample.value))
+	case "_sum":
+		m.Histogram.SampleSum = proto.Float64(sample.value)
+	case "_created":
+		SetCreated(m, secondsToTime(sample.value))
+	}
+	return nil
+}
+
+// addSummarySample adds a quantile, the count, the sum or the created timestamp of a summary.
+func (f *omFamily) addSummarySample(suffix string, sample omSample) error {
+	m := f.metric(f.name, promclient.MetricType_SUMMARY, sample)
+	if m.Summary == nil {
+		m.Summary = &promclient.Summary{}
+	}
+	switch suffix {
+	case "":
+		q, ok := labelValue(sample.labels, "quantile")
+		if !ok {
+			return fmt.Errorf("sample of summary %s without quantile label", f.name)
+		}
+		quantile, err := strconv.ParseFloat(q, 64)
+		if err != nil {
+			return fmt.Errorf("invalid quantile label %q of summary %s", q, f.name)
+		}
+		m.Summary.Quantile = append(m.Summary.Quantile, &promclient.Quantile{
+			Quantile: proto.Float64(quantile),
+			Value:    proto.Float64(sample.value),
+		})
+	case "_count":
+		m.Summary.SampleCount = proto.Uint64(uint64(sample.value))
+	case "_sum":
+		m.Summary.SampleSum = proto.Float64(sample.value)
+	case "_created":
+		SetCreated(m, secondsToTime(sample.value))
+	}
+	return nil
+}
+
+// metric returns the metric of the sample in the MetricFamily with the given name, creating both if needed. The le
+// label of histograms and the quantile label of summaries are left out of the labels of the metric.
+func (f *omFamily) metric(name string, typ promclient.MetricType, sample omSample) *promclient.Metric {
+	mf, ok := f.families[name]
+	if !ok {
+		mf = &promclient.MetricFamily{Name: proto.String(name), Type: typ.Enum()}
+		f.families[name] = mf
+	}
+	omit := ""
+	switch typ {
+	case promclient.MetricType_HISTOGRAM:
+		omit = "le"
+	case promclient.MetricType_SUMMARY:
+		omit = "quantile"
+	}
+	key := name + labelsKey(sample.labels, omit)
+	m, ok := f.metrics[key]
+	if !ok {
+		m = &promclient.Metric{}
+		for _, label := range sample.labels {
+			if label.GetName() != omit {
+				m.Label = append(m.Label, label)
+			}
+		}
+		mf.Metric = append(mf.Metric, m)
+		f.metrics[key] = m
+	}
+	if m.TimestampMs == nil {
+		m.TimestampMs = sample.timestampMs
+	}
+	return m
+}
+
+// parseSample parses a line of the form name{labels} value [timestamp] [# {labels} value [timestamp]].
+func parseSample(line string) (omSample, error) {
+	var sample omSample
+	l := &omLexer{line: line}
+	sample.name = l.name()
+	if !validMetricName(sample.name) {
+		return sample, fmt.Errorf("invalid metric name in line %q", line)
+	}
+	var err error
+	if l.peek() == '{' {
+		if sample.labels, err = l.labels(); err != nil {
+			return sample, err
+		}
+	}
+	if sample.value, err = l.float("value"); err != nil {
+		return sample, err
+	}
+	if l.done() {
+		return sample, nil
+	}
+	if !l.startsWith(" #") {
+		timestamp, err := l.float("timestamp")
+		if err != nil {
+			return sample, err
+		}
+		sample.timestampMs = proto.Int64(int64(math.Round(timestamp * 1000)))
+	}
+	if l.done() {
+		return sample, nil
+	}
+	if sample.exemplar, err = l.exemplar(); err != nil {
+		return sample, err
+	}
+	if !l.done() {
+		return sample, fmt.Errorf("unexpected %q at the end of line %q", l.rest(), line)
+	}
+	// Only counters and histogram buckets have exemplars, those of other samples are dropped.
+	if !strings.HasSuffix(sample.name, "_total") && !strings.HasSuffix(sample.name, "_bucket") {
+		sample.exemplar = nil
+	}
+	return sample, nil
+}
+
+// omLexer reads the tokens of a line of samples in the OpenMetrics format.
+type omLexer struct {
+	line string
+	pos  int
+}
+
+func (l *omLexer) done() bool {
+	return l.pos >= len(l.line)
+}
+
+func (l *omLexer) peek() byte {
+	if l.done() {
+		return 0
+	}
+	return l.line[l.pos]
+}
+
+func (l *omLexer) rest() string {
+	return l.line[l.pos:]
+}
+
+func (l *omLexer) startsWith(prefix string) bool {
+	return strings.HasPrefix(l.rest(), prefix)
+}
+
+// name reads a metric or label name.
+func (l *omLexer) name() string {
+	start := l.pos
+	for !l.done() && isNameChar(l.peek()) {
+		l.pos++
+	}
+	return l.line[start:l.pos]
+}
+
+// float reads a space followed by a number.
+func (l *omLexer) float(what string) (float64, error) {
+	if l.peek() != ' ' {
+		return 0, fmt.Errorf("expected a space before the %s in line %q", what, l.line)
+	}
+	l.pos++
+	start := l.pos
+	for !l.done() && l.peek() != ' ' {
+		l.pos++
+	}
+	value, err := strconv.ParseFloat(l.line[start:l.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q in line %q", what, l.line[start:l.pos], l.line)
+	}
+	return value, nil
+}
+
+// labels reads a set of labels enclosed in braces.
+func (l *omLexer) labels() ([]*promclient.LabelPair, error) {
+	l.pos++ // {
+	var labels []*promclient.LabelPair
+	seen := make(map[string]bool)
+	for l.peek() != '}' {
+		name := l.name()
+		if name == "" || name[0] >= '0' && name[0] <= '9' || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid label name in line %q", l.line)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate label %s in line %q", name, l.line)
+		}
+		seen[name] = true
+		if !l.startsWith(`="`) {
+			return nil, fmt.Errorf("expected =\" after label %s in line %q", name, l.line)
+		}
+		l.pos += 2
+		value, err := l.labelValue()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, &promclient.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		switch l.peek() {
+		case ',':
+			l.pos++
+		case '}':
+		default:
+			return nil, fmt.Errorf("expected , or } after label %s in line %q", name, l.line)
+		}
+	}
+	l.pos++ // }
+	return labels, nil
+}
+
+// labelValue reads an escaped label value up to and including its closing quote.
+func (l *omLexer) labelValue() (string, error) {
+	start := l.pos
+	for !l.done() {
+		switch l.peek() {
+		case '\\':
+			l.pos += 2
+			continue
+		case '"':
+			value, err := unescape(l.line[start:l.pos], true)
+			l.pos++
+			return value, err
+		}
+		l.pos++
+	}
+	return "", fmt.Errorf("unterminated label value in line %q", l.line)
+}
+
+// exemplar reads an exemplar of the form " # {labels} value [timestamp]".
+func (l *omLexer) exemplar() (*promclient.Exemplar, error) {
+	if !l.startsWith(" # {") {
+		return nil, fmt.Errorf("invalid exemplar in line %q", l.line)
+	}
+	l.pos += 3
+	labels, err := l.labels()
+	if err != nil {
+		return nil, err
+	}
+	value, err := l.float("exemplar value")
+	if err != nil {
+		return nil, err
+	}
+	exemplar := &promclient.Exemplar{Label: labels, Value: proto.Float64(value)}
+	if !l.done() {
+		timestamp, err := l.float("exemplar timestamp")
+		if err != nil {
+			return nil, err
+		}
+		exemplar.Timestamp = timestamppb.New(secondsToTime(timestamp))
+	}
+	return exemplar, nil
+}
+
+// unescape resolves the escape sequences of a HELP text or, if quoted is set, of a label value.
+func unescape(s string, quoted bool) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("invalid escape sequence at the end of %q", s)
+		}
+		switch s[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case '\\':
+			b.WriteByte('\\')
+		case '"':
+			b.WriteByte('"')
+		default:
+			if quoted {
+				return "", fmt.Errorf("invalid escape sequence \\%c in %q", s[i], s)
+			}
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// labelsKey returns a key identifying the label set, apart from the label with the omitted name.
+func labelsKey(labels []*promclient.LabelPair, omit string) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		if label.GetName() != omit {
+			pairs = append(pairs, label.GetName()+"\xff"+label.GetValue())
+		}
+	}
+	sort.Strings(pairs)
+	return "\xfe" + strings.Join(pairs, "\xfe")
+}
+
+// labelValue returns the value of the label with the given name.
+func labelValue(labels []*promclient.LabelPair, name string) (string, bool) {
+	for _, label := range labels {
+		if label.GetName() == name {
+			return label.GetValue(), true
+		}
+	}
+	return "", false
+}
+
+func validMetricName(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':'
+}
+
+func secondsToTime(seconds float64) time.Time {
+	whole, fraction := math.Modf(seconds)
+	return time.Unix(int64(whole), int64(math.Round(fraction*1e9)))
+}
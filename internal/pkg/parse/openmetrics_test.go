@@ -0,0 +1,240 @@
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/metrictest"
+)
+
+// withCreated sets the created timestamp of the single metric of the family.
+func withCreated(mf *promclient.MetricFamily, created time.Time) *promclient.MetricFamily {
+	SetCreated(mf.Metric[0], created)
+	return mf
+}
+
+// withFamilyUnit sets the unit of the family.
+func withFamilyUnit(mf *promclient.MetricFamily, unit string) *promclient.MetricFamily {
+	mf.Unit = proto.String(unit)
+	return mf
+}
+
+func TestUnmarshalOpenMetrics(t *testing.T) {
+	testCases := []struct {
+		name           string
+		rawMetric      string
+		err            error
+		metricFamilies map[string]*promclient.MetricFamily
+	}{
+		{
+			"return an empty MetricFamily map when inputs only # EOF",
+			"# EOF\n",
+			nil,
+			map[string]*promclient.MetricFamily{},
+		},
+		{
+			"keep the exemplar, unit and created timestamp of a counter",
+			`# TYPE request_duration_seconds counter
+# UNIT request_duration_seconds seconds
+# HELP request_duration_seconds Time spent serving requests.
+request_duration_seconds_total{method="GET"} 17.5 # {trace_id="abc"} 0.5 1600000000.25
+request_duration_seconds_created{method="GET"} 1500000000
+# EOF
+`,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"request_duration_seconds_total": withCreated(withFamilyUnit(&promclient.MetricFamily{
+					Name: proto.String("request_duration_seconds_total"),
+					Help: proto.String("Time spent serving requests."),
+					Type: promclient.MetricType_COUNTER.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{metrictest.LabelPair("method", "GET")},
+							Counter: &promclient.Counter{
+								Value: proto.Float64(17.5),
+								Exemplar: &promclient.Exemplar{
+									Label:     []*promclient.LabelPair{metrictest.LabelPair("trace_id", "abc")},
+									Value:     proto.Float64(0.5),
+									Timestamp: timestamppb.New(time.Unix(1600000000, 250000000)),
+								},
+							},
+						},
+					},
+				}, "seconds"), time.Unix(1500000000, 0)),
+			},
+		},
+		{
+			"group the buckets of a histogram and keep their exemplars",
+			`# TYPE latency histogram
+latency_bucket{path="/",le="0.5"} 3 # {trace_id="def"} 0.25
+latency_bucket{path="/",le="+Inf"} 4
+latency_sum{path="/"} 2.5
+latency_count{path="/"} 4
+latency_created{path="/"} 1500000000.5
+# EOF
+`,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"latency": withCreated(&promclient.MetricFamily{
+					Name: proto.String("latency"),
+					Type: promclient.MetricType_HISTOGRAM.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{metrictest.LabelPair("path", "/")},
+							Histogram: &promclient.Histogram{
+								SampleCount: proto.Uint64(4),
+								SampleSum:   proto.Float64(2.5),
+								Bucket: []*promclient.Bucket{
+									{
+										UpperBound:      proto.Float64(0.5),
+										CumulativeCount: proto.Uint64(3),
+										Exemplar: &promclient.Exemplar{
+											Label: []*promclient.LabelPair{metrictest.LabelPair("trace_id", "def")},
+											Value: proto.Float64(0.25),
+										},
+									},
+									{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: proto.Uint64(4)},
+								},
+							},
+						},
+					},
+				}, time.Unix(1500000000, 500000000)),
+			},
+		},
+		{
+			"turn a summary, an info and a state set into their Prometheus types",
+			`# TYPE rpc summary
+rpc{quantile="0.99"} 0.1
+rpc{quantile="0.5"} 0.05
+rpc_sum 17
+rpc_count 100
+# TYPE build info
+build_info{version="1.2.3"} 1
+# TYPE state stateset
+state{state="ready"} 1 1600000000
+# EOF
+`,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"rpc": {
+					Name: proto.String("rpc"),
+					Type: promclient.MetricType_SUMMARY.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Summary: &promclient.Summary{
+								SampleCount: proto.Uint64(100),
+								SampleSum:   proto.Float64(17),
+								Quantile: []*promclient.Quantile{
+									{Quantile: proto.Float64(0.5), Value: proto.Float64(0.05)},
+									{Quantile: proto.Float64(0.99), Value: proto.Float64(0.1)},
+								},
+							},
+						},
+					},
+				},
+				"build_info": {
+					Name: proto.String("build_info"),
+					Type: promclient.MetricType_GAUGE.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{metrictest.LabelPair("version", "1.2.3")},
+							Gauge: &promclient.Gauge{Value: proto.Float64(1)},
+						},
+					},
+				},
+				"state": {
+					Name: proto.String("state"),
+					Type: promclient.MetricType_GAUGE.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label:       []*promclient.LabelPair{metrictest.LabelPair("state", "ready")},
+							Gauge:       &promclient.Gauge{Value: proto.Float64(1)},
+							TimestampMs: proto.Int64(1600000000000),
+						},
+					},
+				},
+			},
+		},
+		{
+			"parse samples without metadata as untyped and unescape label values",
+			`untyped_metric{path="a \"quoted\\\" \n value"} +Inf
+# EOF
+`,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"untyped_metric": {
+					Name: proto.String("untyped_metric"),
+					Type: promclient.MetricType_UNTYPED.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label:   []*promclient.LabelPair{metrictest.LabelPair("path", "a \"quoted\\\" \n value")},
+							Untyped: &promclient.Untyped{Value: proto.Float64(math.Inf(+1))},
+						},
+					},
+				},
+			},
+		},
+		{
+			"returns an error when the input misses # EOF",
+			"# TYPE requests counter\nrequests_total 1\n",
+			errors.New("missing # EOF"),
+			nil,
+		},
+		{
+			"returns an error when the input goes on after # EOF",
+			"# EOF\nrequests_total 1\n",
+			errors.New("content after # EOF"),
+			nil,
+		},
+		{
+			"returns an error when a family appears twice",
+			"# TYPE a gauge\na 1\n# TYPE b gauge\nb 1\na 2\n# EOF\n",
+			errors.New("metric family a appears more than once"),
+			nil,
+		},
+		{
+			"returns an error when a sample is duplicated",
+			"# TYPE a gauge\na{x=\"1\"} 1\na{x=\"1\"} 2\n# EOF\n",
+			errors.New("duplicate sample a"),
+			nil,
+		},
+		{
+			"returns an error when a histogram has no +Inf bucket",
+			"# TYPE latency histogram\nlatency_bucket{le=\"1\"} 1\n# EOF\n",
+			errors.New("histogram latency has no +Inf bucket"),
+			nil,
+		},
+		{
+			"returns an error when the unit is not a suffix of the family name",
+			"# TYPE latency gauge\n# UNIT latency seconds\n# EOF\n",
+			errors.New("metric family latency doesn't end with its unit seconds"),
+			nil,
+		},
+		{
+			"returns an error when a label value is not terminated",
+			"a{x=\"1} 1\n# EOF\n",
+			errors.New("unterminated label value"),
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mf, err := Unmarshal(bytes.NewBufferString(tc.rawMetric), expfmt.FmtOpenMetrics)
+			if tc.err != nil {
+				assert.ErrorContains(t, err, tc.err.Error())
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.metricFamilies, mf)
+		})
+	}
+}
@@ -2,17 +2,31 @@ package parse
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
 
 	promclient "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 )
 
-// Unmarshal accepts the raw metrics and parse them to MetricFamily objects.
-func Unmarshal(metrics *bytes.Buffer) (map[string]*promclient.MetricFamily, error) {
+// Unmarshal accepts the raw metrics in the given exposition format and parse them to MetricFamily objects. Raw
+// metrics in the delimited protobuf and OpenMetrics formats are decoded as such, anything else is parsed as text.
+func Unmarshal(metrics *bytes.Buffer, format expfmt.Format) (map[string]*promclient.MetricFamily, error) {
+	defer observeDuration("unmarshal", time.Now())
 	if metrics == nil {
 		return nil, fmt.Errorf("empty raw metrics input")
 	}
+	switch format {
+	case expfmt.FmtProtoDelim:
+		return unmarshalProto(metrics)
+	case expfmt.FmtOpenMetrics:
+		return unmarshalOpenMetrics(metrics)
+	}
 	parser := expfmt.TextParser{}
 	mf, err := parser.TextToMetricFamilies(metrics)
 	if err != nil {
@@ -21,23 +35,77 @@ func Unmarshal(metrics *bytes.Buffer) (map[string]*promclient.MetricFamily, erro
 	return mf, nil
 }
 
-// Marshal accepts the MetricFamily objects and encodes them into raw metrics.
-func Marshal(metricFamilies map[string]*promclient.MetricFamily) (*bytes.Buffer, error) {
+// unmarshalProto decodes raw metrics in the delimited protobuf format to MetricFamily objects.
+func unmarshalProto(metrics *bytes.Buffer) (map[string]*promclient.MetricFamily, error) {
+	decoder := expfmt.NewDecoder(metrics, expfmt.FmtProtoDelim)
+	metricFamilies := make(map[string]*promclient.MetricFamily)
+	for {
+		mf := &promclient.MetricFamily{}
+		if err := decoder.Decode(mf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return metricFamilies, nil
+			}
+			return nil, fmt.Errorf("failed to decode protobuf raw metrics to MetricFamily: %w", err)
+		}
+		if _, ok := metricFamilies[mf.GetName()]; ok {
+			return nil, fmt.Errorf("failed to decode protobuf raw metrics to MetricFamily: duplicate metric family %s", mf.GetName())
+		}
+		metricFamilies[mf.GetName()] = mf
+	}
+}
+
+// Marshal accepts the MetricFamily objects and encodes them into raw metrics in the given exposition format, ordered
+// by family name.
+func Marshal(metricFamilies map[string]*promclient.MetricFamily, format expfmt.Format) (*bytes.Buffer, error) {
+	defer observeDuration("marshal", time.Now())
 	if metricFamilies == nil {
 		return nil, fmt.Errorf("empty MetricFamily input")
 	}
-	rawMetrics := &bytes.Buffer{}
-	for _, mf := range metricFamilies {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-		buff := &bytes.Buffer{}
-		_, err := expfmt.MetricFamilyToText(buff, mf)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse MetricFamily to raw metrics: %w", err)
+	rawMetrics := &bytes.Buffer{}
+	encoder := NewEncoder(rawMetrics, format)
+	for _, name := range names {
+		if err := encoder.Encode(metricFamilies[name]); err != nil {
+			return nil, fmt.Errorf("failed to encode MetricFamily to raw metrics: %w", err)
 		}
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish the raw metrics: %w", err)
+	}
+	return rawMetrics, nil
+}
 
-		if _, err := rawMetrics.Write(buff.Bytes()); err != nil {
-			return nil, err
+func observeDuration(operation string, start time.Time) {
+	telemetry.CodecDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// CountSamples returns the number of samples the metric families are exposed as, the way Prometheus counts the
+// samples it scraped: one per counter, gauge and untyped metric, and one per bucket or quantile plus the sum and
+// count of each histogram and summary. A native histogram without classic buckets is a single sample.
+func CountSamples(metricFamilies map[string]*promclient.MetricFamily) int {
+	samples := 0
+	for _, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			switch {
+			case m.Histogram != nil && IsNativeHistogram(m.GetHistogram()) && len(m.GetHistogram().GetBucket()) == 0:
+				samples++
+			case m.Histogram != nil:
+				buckets := m.GetHistogram().GetBucket()
+				samples += len(buckets) + 2
+				if len(buckets) == 0 || !math.IsInf(buckets[len(buckets)-1].GetUpperBound(), +1) {
+					samples++
+				}
+			case m.Summary != nil:
+				samples += len(m.GetSummary().GetQuantile()) + 2
+			default:
+				samples++
+			}
 		}
 	}
-	return rawMetrics, nil
+	return samples
 }
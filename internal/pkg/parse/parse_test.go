@@ -8,20 +8,68 @@ import (
 	"testing"
 
 	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 )
 
+// requestsFamily returns a counter family with a single series for the given method.
+func requestsFamily(method string) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name: proto.String("requests_total"),
+		Help: proto.String("Number of requests."),
+		Type: promclient.MetricType_COUNTER.Enum(),
+		Metric: []*promclient.Metric{
+			{
+				Label:   []*promclient.LabelPair{{Name: proto.String("method"), Value: proto.String(method)}},
+				Counter: &promclient.Counter{Value: proto.Float64(10)},
+			},
+		},
+	}
+}
+
+// protoDelimited encodes the metric families in the delimited protobuf format.
+func protoDelimited(metricFamilies ...*promclient.MetricFamily) *bytes.Buffer {
+	buff := &bytes.Buffer{}
+	encoder := expfmt.NewEncoder(buff, expfmt.FmtProtoDelim)
+	for _, mf := range metricFamilies {
+		if err := encoder.Encode(mf); err != nil {
+			panic(err)
+		}
+	}
+	return buff
+}
+
+// assertMetricFamiliesEqual asserts that the metric families hold the same messages. Unlike comparing them with
+// assert.Equal, this ignores the internal state that decoding the protobuf format leaves in the messages.
+func assertMetricFamiliesEqual(t *testing.T, expected map[string]*promclient.MetricFamily, actual map[string]*promclient.MetricFamily) {
+	t.Helper()
+	format := func(metricFamilies map[string]*promclient.MetricFamily) map[string]string {
+		if metricFamilies == nil {
+			return nil
+		}
+		formatted := make(map[string]string, len(metricFamilies))
+		for name, mf := range metricFamilies {
+			formatted[name] = prototext.Format(mf)
+		}
+		return formatted
+	}
+	assert.Equal(t, format(expected), format(actual))
+}
+
 func TestRawMetricsToMetricFamilies(t *testing.T) {
 	testCases := []struct {
 		name           string
 		rawMetric      *bytes.Buffer
+		format         expfmt.Format
 		err            error
 		metricFamilies map[string]*promclient.MetricFamily
 	}{
 		{
 			"returns an error when the input is empty",
 			nil,
+			expfmt.FmtText,
 			errors.New("empty raw metrics input"),
 			nil,
 		},
@@ -31,6 +79,7 @@ func TestRawMetricsToMetricFamilies(t *testing.T) {
 	another_metric -3e3 103948
 	no_labels{} 3
 	`)),
+			expfmt.FmtText,
 			nil,
 			map[string]*promclient.MetricFamily{
 				"minimal_metric": &promclient.MetricFamily{
@@ -78,6 +127,7 @@ just_histogram_bucket{le="+Inf"} 2693
 just_histogram_sum 314159.26535
 just_histogram_count 2333
 `)),
+			expfmt.FmtText,
 			nil,
 			map[string]*promclient.MetricFamily{
 				"just_histogram": &promclient.MetricFamily{
@@ -109,23 +159,82 @@ just_histogram_count 2333
 				},
 			},
 		},
+		{
+			"return correct MetricFamily map when inputs delimited protobuf",
+			protoDelimited(requestsFamily("GET"), &promclient.MetricFamily{
+				Name: proto.String("go_goroutines"),
+				Type: promclient.MetricType_GAUGE.Enum(),
+				Metric: []*promclient.Metric{
+					{Gauge: &promclient.Gauge{Value: proto.Float64(12)}},
+				},
+			}),
+			expfmt.FmtProtoDelim,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"requests_total": requestsFamily("GET"),
+				"go_goroutines": {
+					Name: proto.String("go_goroutines"),
+					Type: promclient.MetricType_GAUGE.Enum(),
+					Metric: []*promclient.Metric{
+						{Gauge: &promclient.Gauge{Value: proto.Float64(12)}},
+					},
+				},
+			},
+		},
+		{
+			"return an empty MetricFamily map when inputs empty delimited protobuf",
+			bytes.NewBuffer(nil),
+			expfmt.FmtProtoDelim,
+			nil,
+			map[string]*promclient.MetricFamily{},
+		},
+		{
+			"returns an error when inputs the same family twice in delimited protobuf",
+			protoDelimited(requestsFamily("GET"), requestsFamily("POST")),
+			expfmt.FmtProtoDelim,
+			errors.New("duplicate metric family requests_total"),
+			nil,
+		},
+		{
+			"returns an error when inputs text as delimited protobuf",
+			bytes.NewBuffer([]byte("minimal_metric 1.234\n")),
+			expfmt.FmtProtoDelim,
+			errors.New("failed to decode protobuf raw metrics to MetricFamily"),
+			nil,
+		},
+		{
+			"parse text when the format is unknown",
+			bytes.NewBuffer([]byte("minimal_metric 1.234\n")),
+			expfmt.FmtUnknown,
+			nil,
+			map[string]*promclient.MetricFamily{
+				"minimal_metric": {
+					Name: proto.String("minimal_metric"),
+					Type: promclient.MetricType_UNTYPED.Enum(),
+					Metric: []*promclient.Metric{
+						{Untyped: &promclient.Untyped{Value: proto.Float64(1.234)}},
+					},
+				},
+			},
+		},
 		{
 			"returns an error when inputs invalid raw metrics content",
 			bytes.NewBuffer([]byte(`
 		Random! Just random words that cannot be parsed into MetricFamily.`)),
+			expfmt.FmtText,
 			errors.New("failed to parse raw metrics to MetricFamily"),
 			nil,
 		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			mf, err := Unmarshal(tc.rawMetric)
+			mf, err := Unmarshal(tc.rawMetric, tc.format)
 			if tc.err != nil {
 				assert.ErrorContains(t, err, tc.err.Error())
 			} else {
 				assert.NoError(t, err)
 			}
-			assert.Equal(t, mf, tc.metricFamilies)
+			assertMetricFamiliesEqual(t, tc.metricFamilies, mf)
 		})
 	}
 }
@@ -235,7 +344,7 @@ just_histogram_count 2333
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			rm, err := Marshal(tc.metricFamilies)
+			rm, err := Marshal(tc.metricFamilies, expfmt.FmtText)
 			if tc.err != nil {
 				assert.ErrorContains(t, err, tc.err.Error())
 			} else {
@@ -247,3 +356,75 @@ just_histogram_count 2333
 		})
 	}
 }
+
+func TestCountSamples(t *testing.T) {
+	testCases := []struct {
+		name            string
+		rawMetric       string
+		expectedSamples int
+	}{
+		{
+			"count one sample per counter, gauge and untyped metric",
+			`# TYPE requests_total counter
+requests_total{code="200"} 10
+requests_total{code="500"} 1
+# TYPE go_goroutines gauge
+go_goroutines 12
+minimal_metric 1.234
+`,
+			4,
+		},
+		{
+			"count buckets, sum and count of histograms",
+			`# TYPE just_histogram histogram
+just_histogram_bucket{le="1"} 209
+just_histogram_bucket{le="2"} 210
+just_histogram_bucket{le="+Inf"} 2693
+just_histogram_sum 314159.26535
+just_histogram_count 2333
+`,
+			5,
+		},
+		{
+			"count quantiles, sum and count of summaries",
+			`# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds{quantile="0.99"} 0.1
+rpc_duration_seconds_sum 17
+rpc_duration_seconds_count 100
+`,
+			4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mf, err := Unmarshal(bytes.NewBufferString(tc.rawMetric), expfmt.FmtText)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedSamples, CountSamples(mf))
+		})
+	}
+}
+
+func TestCountNativeHistogramSamples(t *testing.T) {
+	testCases := []struct {
+		name            string
+		mf              *promclient.MetricFamily
+		expectedSamples int
+	}{
+		{
+			"count a native histogram as one sample",
+			nativeHistogramFamily(),
+			1,
+		},
+		{
+			"count the classic buckets, sum and count of a histogram that has native buckets as well",
+			nativeHistogramFamily(classicBucket(1, 4), classicBucket(math.Inf(+1), 7)),
+			4,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedSamples, CountSamples(map[string]*promclient.MetricFamily{"latency": tc.mf}))
+		})
+	}
+}
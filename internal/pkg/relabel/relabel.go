@@ -0,0 +1,583 @@
+package relabel
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+)
+
+// Action is the action a relabelling rule performs.
+type Action string
+
+const (
+	// Replace sets the target label to the replacement when the regex matches the source labels.
+	Replace Action = "replace"
+	// Keep drops the series whose source labels the regex doesn't match.
+	Keep Action = "keep"
+	// Drop drops the series whose source labels the regex matches.
+	Drop Action = "drop"
+	// HashMod sets the target label to the modulus of a hash of the source labels.
+	HashMod Action = "hashmod"
+	// LabelMap copies the labels whose name the regex matches to the names given by the replacement.
+	LabelMap Action = "labelmap"
+	// LabelDrop removes the labels whose name the regex matches.
+	LabelDrop Action = "labeldrop"
+	// LabelKeep removes the labels whose name the regex doesn't match.
+	LabelKeep Action = "labelkeep"
+)
+
+// relabelTarget matches the target labels of the replace action that refer to capture groups of the regex.
+var relabelTarget = regexp.MustCompile(`^(?:(?:[a-zA-Z_]|\$(?:\{\w+\}|\w+))+\w*)+$`)
+
+// Config is a relabelling rule, with the same YAML schema and defaults as the metric_relabel_configs of Prometheus.
+type Config struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Separator    string   `yaml:"separator"`
+	Regex        string   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       Action   `yaml:"action"`
+}
+
+// DefaultConfig is the rule the settings missing from a relabelling rule are taken from.
+var DefaultConfig = Config{
+	Separator:   ";",
+	Regex:       "(.*)",
+	Replacement: "$1",
+	Action:      Replace,
+}
+
+// UnmarshalYAML decodes a relabelling rule on top of the defaults, rejecting unknown settings.
+func (c *Config) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.MappingNode {
+		for i := 0; i < len(value.Content); i += 2 {
+			switch key := value.Content[i]; key.Value {
+			case "source_labels", "separator", "regex", "modulus", "target_label", "replacement", "action":
+			default:
+				return fmt.Errorf("line %d: field %s not found in relabel config", key.Line, key.Value)
+			}
+		}
+	}
+	*c = DefaultConfig
+	// plain has no UnmarshalYAML method, so decoding it doesn't recurse.
+	type plain Config
+	if err := value.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.Action = Action(strings.ToLower(string(c.Action)))
+	return nil
+}
+
+// Rule is a validated relabelling rule, ready to be applied.
+type Rule struct {
+	Config
+	regex *regexp.Regexp
+}
+
+// Compile validates the relabelling rules the way Prometheus does, and compiles their regular expressions.
+func Compile(configs []Config) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for i, c := range configs {
+		rule, err := compile(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relabel config %d: %w", i, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// compile validates a single relabelling rule.
+func compile(c Config) (*Rule, error) {
+	switch c.Action {
+	case Replace, Keep, Drop, HashMod, LabelMap, LabelDrop, LabelKeep:
+	case "":
+		return nil, fmt.Errorf("relabel action cannot be empty")
+	default:
+		return nil, fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	if c.Action == HashMod && c.Modulus == 0 {
+		return nil, fmt.Errorf("relabel configuration for hashmod requires non-zero modulus")
+	}
+	if (c.Action == Replace || c.Action == HashMod) && c.TargetLabel == "" {
+		return nil, fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+	}
+	if c.Action == Replace && !strings.Contains(c.TargetLabel, "$") && !model.LabelName(c.TargetLabel).IsValid() ||
+		c.Action == Replace && strings.Contains(c.TargetLabel, "$") && !relabelTarget.MatchString(c.TargetLabel) ||
+		c.Action == HashMod && !model.LabelName(c.TargetLabel).IsValid() {
+		return nil, fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+	}
+	if (c.Action == LabelDrop || c.Action == LabelKeep) && (c.SourceLabels != nil ||
+		c.TargetLabel != DefaultConfig.TargetLabel ||
+		c.Modulus != DefaultConfig.Modulus ||
+		c.Separator != DefaultConfig.Separator ||
+		c.Replacement != DefaultConfig.Replacement) {
+		return nil, fmt.Errorf("%s action requires only 'regex', and no other fields", c.Action)
+	}
+	// Like Prometheus, the regular expression has to match the whole value.
+	regex, err := regexp.Compile("^(?:" + c.Regex + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", c.Regex, err)
+	}
+	return &Rule{Config: c, regex: regex}, nil
+}
+
+// Process applies the rules in order to the labels of a series, which include its name as the __name__ label, and
+// reports whether the series is kept. Labels set to an empty value are removed.
+func Process(labels map[string]string, rules []*Rule) bool {
+	for _, rule := range rules {
+		if !rule.apply(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply applies the rule to the labels of a series, and reports whether the series is kept.
+func (rule *Rule) apply(labels map[string]string) bool {
+	values := make([]string, 0, len(rule.SourceLabels))
+	for _, name := range rule.SourceLabels {
+		values = append(values, labels[name])
+	}
+	value := strings.Join(values, rule.Separator)
+
+	switch rule.Action {
+	case Drop:
+		if rule.regex.MatchString(value) {
+			return false
+		}
+	case Keep:
+		if !rule.regex.MatchString(value) {
+			return false
+		}
+	case Replace:
+		indexes := rule.regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			break
+		}
+		target := string(rule.regex.ExpandString(nil, rule.TargetLabel, value, indexes))
+		if !model.LabelName(target).IsValid() {
+			break
+		}
+		setLabel(labels, target, string(rule.regex.ExpandString(nil, rule.Replacement, value, indexes)))
+	case HashMod:
+		sum := md5.Sum([]byte(value))
+		// Like Prometheus, only the lower 64 bits of the hash are used.
+		setLabel(labels, rule.TargetLabel, fmt.Sprint(binary.BigEndian.Uint64(sum[md5.Size-8:])%rule.Modulus))
+	case LabelMap:
+		// The labels are matched as they were before the rule, whatever it sets along the way.
+		original := make(map[string]string, len(labels))
+		for name, v := range labels {
+			original[name] = v
+		}
+		for _, name := range sortedNames(original) {
+			if rule.regex.MatchString(name) {
+				setLabel(labels, rule.regex.ReplaceAllString(name, rule.Replacement), original[name])
+			}
+		}
+	case LabelDrop:
+		for name := range labels {
+			if rule.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case LabelKeep:
+		for name := range labels {
+			if !rule.regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+// setLabel sets the label to the value, or removes it if the value is empty.
+func setLabel(labels map[string]string, name string, value string) {
+	if value == "" {
+		delete(labels, name)
+		return
+	}
+	labels[name] = value
+}
+
+// sortedNames returns the names of the labels in order.
+func sortedNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// MetricFamilies applies the rules to every series of the metric families, with the name of its family as the
+// __name__ label, and returns the number of series dropped. A series whose name is changed by the rules moves to the
+// family of its new name, unless that family has another type or the name is invalid, in which case it is dropped.
+//
+// Like in Prometheus, histograms and summaries are relabelled series by series: each bucket as <name>_bucket with its
+// le label, each quantile as <name> with its quantile label, the sum as <name>_sum and the count as <name>_count, and a
+// native histogram as a single series <name>. The metric is built again from the series that are kept, so that
+// buckets and quantiles can be dropped. When the series that are kept don't make up a histogram or summary anymore,
+// because the sum, the count, the +Inf bucket or the le or quantile labels were dropped, or the series were given
+// different names or labels, they are kept as untyped series of their own names, which Prometheus stores the same way.
+func MetricFamilies(metricFamilies map[string]*promclient.MetricFamily, rules []*Rule) int {
+	if len(rules) == 0 {
+		return 0
+	}
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f := &families{original: metricFamilies, relabelled: make(map[string]*promclient.MetricFamily, len(metricFamilies))}
+	dropped := 0
+	for _, name := range names {
+		mf := metricFamilies[name]
+		for _, m := range mf.GetMetric() {
+			if mf.GetType() == promclient.MetricType_HISTOGRAM || mf.GetType() == promclient.MetricType_SUMMARY {
+				dropped += f.addComposite(mf, m, rules)
+				continue
+			}
+			labels := metricLabels(name, m)
+			if !Process(labels, rules) || !f.add(labels, m, mf.GetType(), mf) {
+				dropped++
+			}
+		}
+	}
+
+	for name := range metricFamilies {
+		delete(metricFamilies, name)
+	}
+	for name, mf := range f.relabelled {
+		// A family none of whose series could be added, because of their type, is left out.
+		if len(mf.Metric) != 0 {
+			metricFamilies[name] = mf
+		}
+	}
+	return dropped
+}
+
+// families are the metric families being relabelled.
+type families struct {
+	original   map[string]*promclient.MetricFamily
+	relabelled map[string]*promclient.MetricFamily
+}
+
+// add adds the metric of the given type with the relabelled labels, including its name, to the family of its name, and
+// reports whether it was added. The family takes its type and metadata, such as its unit, from the family of the same
+// name the containers exposed, if any, or else from the given origin, so metrics of another type are not added.
+func (f *families) add(labels map[string]string, m *promclient.Metric, metricType promclient.MetricType, origin *promclient.MetricFamily) bool {
+	name := labels[model.MetricNameLabel]
+	delete(labels, model.MetricNameLabel)
+	target, ok := f.relabelled[name]
+	if !ok {
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			return false
+		}
+		if existing, ok := f.original[name]; ok {
+			origin = existing
+		}
+		target = &promclient.MetricFamily{Name: proto.String(name), Type: metricType.Enum()}
+		if origin != nil {
+			target.Help, target.Type, target.Unit = origin.Help, origin.Type, origin.Unit
+		}
+		f.relabelled[name] = target
+	}
+	if target.GetType() != metricType {
+		return false
+	}
+	m.Label = nil
+	for _, labelName := range sortedNames(labels) {
+		m.Label = append(m.Label, &promclient.LabelPair{
+			Name:  proto.String(labelName),
+			Value: proto.String(labels[labelName]),
+		})
+	}
+	target.Metric = append(target.Metric, m)
+	return true
+}
+
+// seriesKind is the part of a histogram or summary a series exposes.
+type seriesKind int
+
+const (
+	bucketSeries seriesKind = iota
+	quantileSeries
+	sumSeries
+	countSeries
+	nativeSeries
+)
+
+// series is one of the series a histogram or summary is exposed as, along with its labels, including its name.
+type series struct {
+	kind   seriesKind
+	labels map[string]string
+	value  float64
+	// bucket is the bucket of a bucket series, whose upper bound is given by its le label.
+	bucket *promclient.Bucket
+	// implicit is set on the +Inf bucket of a histogram that leaves it out, as its count is the count of the histogram.
+	implicit bool
+}
+
+// addComposite relabels the series of a histogram or summary one by one, adds the metric built again from the series
+// that are kept, and returns the number of series dropped.
+func (f *families) addComposite(mf *promclient.MetricFamily, m *promclient.Metric, rules []*Rule) int {
+	dropped := 0
+	var kept []series
+	for _, s := range exposedSeries(mf.GetName(), m) {
+		if Process(s.labels, rules) {
+			kept = append(kept, s)
+		} else {
+			dropped++
+		}
+	}
+	if len(kept) == 0 {
+		return dropped
+	}
+	if labels, ok := rebuild(mf.GetType(), m, kept); ok {
+		if !f.add(labels, m, mf.GetType(), mf) {
+			dropped += len(kept)
+		}
+		return dropped
+	}
+	for _, s := range kept {
+		flat := &promclient.Metric{TimestampMs: m.TimestampMs}
+		metricType := promclient.MetricType_UNTYPED
+		if s.kind == nativeSeries {
+			// A native histogram is a single series, so it is kept as a histogram without its classic buckets.
+			flat.Histogram = m.GetHistogram()
+			flat.Histogram.Bucket = nil
+			metricType = promclient.MetricType_HISTOGRAM
+		} else {
+			flat.Untyped = &promclient.Untyped{Value: proto.Float64(s.value)}
+		}
+		if !f.add(s.labels, flat, metricType, nil) {
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// exposedSeries returns the series the histogram or summary metric is exposed as.
+func exposedSeries(name string, m *promclient.Metric) []series {
+	labels := metricLabels(name, m)
+	withLabel := func(labelName string, labelValue string, suffix string) map[string]string {
+		l := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			l[k] = v
+		}
+		l[model.MetricNameLabel] = name + suffix
+		if labelName != "" {
+			l[labelName] = labelValue
+		}
+		return l
+	}
+
+	var exposed []series
+	if h := m.GetHistogram(); h != nil {
+		native := parse.IsNativeHistogram(h)
+		if native {
+			exposed = append(exposed, series{kind: nativeSeries, labels: withLabel("", "", "")})
+		}
+		for _, b := range h.GetBucket() {
+			exposed = append(exposed, series{
+				kind:   bucketSeries,
+				labels: withLabel(model.BucketLabel, formatFloat(b.GetUpperBound()), "_bucket"),
+				value:  float64(b.GetCumulativeCount()),
+				bucket: b,
+			})
+		}
+		if native && len(h.GetBucket()) == 0 {
+			return exposed
+		}
+		if n := len(h.GetBucket()); n == 0 || !math.IsInf(h.GetBucket()[n-1].GetUpperBound(), +1) {
+			inf := &promclient.Bucket{UpperBound: proto.Float64(math.Inf(+1)), CumulativeCount: h.SampleCount}
+			exposed = append(exposed, series{
+				kind:     bucketSeries,
+				labels:   withLabel(model.BucketLabel, "+Inf", "_bucket"),
+				value:    float64(h.GetSampleCount()),
+				bucket:   inf,
+				implicit: true,
+			})
+		}
+		if !native {
+			exposed = append(exposed,
+				series{kind: sumSeries, labels: withLabel("", "", "_sum"), value: h.GetSampleSum()},
+				series{kind: countSeries, labels: withLabel("", "", "_count"), value: float64(h.GetSampleCount())},
+			)
+		}
+		return exposed
+	}
+	summary := m.GetSummary()
+	for _, q := range summary.GetQuantile() {
+		exposed = append(exposed, series{
+			kind:   quantileSeries,
+			labels: withLabel(model.QuantileLabel, formatFloat(q.GetQuantile()), ""),
+			value:  q.GetValue(),
+		})
+	}
+	return append(exposed,
+		series{kind: sumSeries, labels: withLabel("", "", "_sum"), value: summary.GetSampleSum()},
+		series{kind: countSeries, labels: withLabel("", "", "_count"), value: float64(summary.GetSampleCount())},
+	)
+}
+
+// rebuild builds the histogram or summary metric again from the series that are kept, and returns its labels,
+// including its name. It reports false if the series don't make up a histogram or summary anymore, in which case the
+// buckets of the metric may have been changed already and only the values of the series are left to be used.
+func rebuild(metricType promclient.MetricType, m *promclient.Metric, kept []series) (map[string]string, bool) {
+	// The sum and count, or the native histogram that holds them, give the name and the labels of the metric.
+	var name string
+	var labels map[string]string
+	required := map[seriesKind]bool{}
+	if metricType == promclient.MetricType_HISTOGRAM && parse.IsNativeHistogram(m.GetHistogram()) {
+		required[nativeSeries] = true
+	} else {
+		required[sumSeries], required[countSeries] = true, true
+	}
+	for _, s := range kept {
+		if !required[s.kind] {
+			continue
+		}
+		delete(required, s.kind)
+		base, l, ok := splitName(s)
+		if !ok || (labels != nil && (base != name || !equalLabels(l, labels))) {
+			return nil, false
+		}
+		name, labels = base, l
+	}
+	if len(required) != 0 {
+		return nil, false
+	}
+
+	var buckets []*promclient.Bucket
+	var quantiles []*promclient.Quantile
+	var implicitInf bool
+	for _, s := range kept {
+		var label string
+		switch s.kind {
+		case bucketSeries:
+			label = model.BucketLabel
+		case quantileSeries:
+			label = model.QuantileLabel
+		default:
+			continue
+		}
+		base, l, ok := splitName(s)
+		value, hasLabel := l[label]
+		delete(l, label)
+		if !ok || base != name || !hasLabel || !equalLabels(l, labels) {
+			return nil, false
+		}
+		bound, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, false
+		}
+		if s.kind == quantileSeries {
+			quantiles = append(quantiles, &promclient.Quantile{Quantile: proto.Float64(bound), Value: proto.Float64(s.value)})
+			continue
+		}
+		s.bucket.UpperBound = proto.Float64(bound)
+		buckets = append(buckets, s.bucket)
+		if s.implicit && math.IsInf(bound, +1) {
+			implicitInf = true
+		}
+	}
+
+	if metricType == promclient.MetricType_SUMMARY {
+		sort.SliceStable(quantiles, func(i, j int) bool { return quantiles[i].GetQuantile() < quantiles[j].GetQuantile() })
+		for i := 1; i < len(quantiles); i++ {
+			if quantiles[i].GetQuantile() == quantiles[i-1].GetQuantile() {
+				return nil, false
+			}
+		}
+		m.Summary.Quantile = quantiles
+	} else {
+		sort.SliceStable(buckets, func(i, j int) bool { return buckets[i].GetUpperBound() < buckets[j].GetUpperBound() })
+		for i := 1; i < len(buckets); i++ {
+			if buckets[i].GetUpperBound() == buckets[i-1].GetUpperBound() || buckets[i].GetCumulativeCount() < buckets[i-1].GetCumulativeCount() {
+				return nil, false
+			}
+		}
+		// The +Inf bucket of classic histograms can't be left out, as it is exposed along with the count.
+		n := len(buckets)
+		hasInf := n != 0 && math.IsInf(buckets[n-1].GetUpperBound(), +1)
+		if n != 0 && !hasInf || n == 0 && !parse.IsNativeHistogram(m.GetHistogram()) {
+			return nil, false
+		}
+		if hasInf && implicitInf {
+			buckets = buckets[:n-1]
+		}
+		m.Histogram.Bucket = buckets
+	}
+	labels[model.MetricNameLabel] = name
+	return labels, true
+}
+
+// splitName returns the name of the histogram or summary a relabelled series belongs to, taken from the name of the
+// series without the suffix of its kind, and the other labels of the series. It reports false if the name of the
+// series lost its suffix.
+func splitName(s series) (string, map[string]string, bool) {
+	labels := make(map[string]string, len(s.labels))
+	for name, value := range s.labels {
+		labels[name] = value
+	}
+	name := labels[model.MetricNameLabel]
+	delete(labels, model.MetricNameLabel)
+	suffix := map[seriesKind]string{bucketSeries: "_bucket", sumSeries: "_sum", countSeries: "_count"}[s.kind]
+	if !strings.HasSuffix(name, suffix) || name == suffix {
+		return "", nil, false
+	}
+	return strings.TrimSuffix(name, suffix), labels, true
+}
+
+// equalLabels reports whether both label sets are the same.
+func equalLabels(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// metricLabels returns the labels of the metric, along with the given name as the __name__ label.
+func metricLabels(name string, m *promclient.Metric) map[string]string {
+	labels := make(map[string]string, len(m.GetLabel())+1)
+	for _, label := range m.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	labels[model.MetricNameLabel] = name
+	return labels
+}
+
+// formatFloat formats the upper bound of a bucket or a quantile the way the text format exposes them.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,375 @@
+package relabel
+
+import (
+	"testing"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/metrictest"
+)
+
+// parseRules decodes and compiles relabelling rules written in YAML.
+func parseRules(t *testing.T, rules string) []*Rule {
+	var configs []Config
+	require.NoError(t, yaml.Unmarshal([]byte(rules), &configs))
+	compiled, err := Compile(configs)
+	require.NoError(t, err)
+	return compiled
+}
+
+func TestUnmarshalYAML(t *testing.T) {
+	testCases := []struct {
+		name           string
+		yaml           string
+		expectedConfig Config
+		errString      string
+	}{
+		{
+			"fill in the defaults",
+			"source_labels: [job]",
+			Config{SourceLabels: []string{"job"}, Separator: ";", Regex: "(.*)", Replacement: "$1", Action: Replace},
+			"",
+		},
+		{
+			"keep an explicitly empty replacement",
+			"{target_label: team, replacement: ''}",
+			Config{Separator: ";", Regex: "(.*)", TargetLabel: "team", Replacement: "", Action: Replace},
+			"",
+		},
+		{
+			"lower the case of the action",
+			"{regex: go_.*, action: LabelDrop}",
+			Config{Separator: ";", Regex: "go_.*", Replacement: "$1", Action: LabelDrop},
+			"",
+		},
+		{
+			"return an error for an unknown setting",
+			"{source_label: [job]}",
+			Config{},
+			"field source_label not found",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var config Config
+			err := yaml.Unmarshal([]byte(tc.yaml), &config)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedConfig, config)
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	testCases := []struct {
+		name      string
+		yaml      string
+		errString string
+	}{
+		{"accept a valid rule", "- {source_labels: [__name__], regex: go_.*, action: drop}", ""},
+		{"accept a target label referring to a group", "- {source_labels: [key], regex: '(.*)', target_label: '${1}_value'}", ""},
+		{"reject an unknown action", "- {action: delete}", `unknown relabel action "delete"`},
+		{"reject an empty action", "- {action: ''}", "relabel action cannot be empty"},
+		{"reject hashmod without a modulus", "- {target_label: shard, action: hashmod}", "requires non-zero modulus"},
+		{"reject replace without a target label", "- {source_labels: [job]}", "requires 'target_label' value"},
+		{"reject an invalid target label", "- {target_label: team-name}", `"team-name" is invalid 'target_label'`},
+		{"reject labeldrop with other fields", "- {regex: tmp_.*, replacement: x, action: labeldrop}", "labeldrop action requires only 'regex'"},
+		{"reject an invalid regex", "- {regex: '(', action: drop}", "invalid regex"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var configs []Config
+			require.NoError(t, yaml.Unmarshal([]byte(tc.yaml), &configs))
+			_, err := Compile(configs)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProcess(t *testing.T) {
+	testCases := []struct {
+		name           string
+		rules          string
+		labels         map[string]string
+		expectedLabels map[string]string
+	}{
+		{
+			"drop a series whose labels match",
+			"- {source_labels: [__name__], regex: go_.*, action: drop}",
+			map[string]string{"__name__": "go_goroutines"},
+			nil,
+		},
+		{
+			"keep a series whose joined labels match",
+			"- {source_labels: [method, code], regex: GET;2.., action: keep}",
+			map[string]string{"__name__": "requests", "method": "GET", "code": "200"},
+			map[string]string{"__name__": "requests", "method": "GET", "code": "200"},
+		},
+		{
+			"drop a series whose labels don't match the keep regex",
+			"- {source_labels: [method, code], regex: GET;2.., action: keep}",
+			map[string]string{"__name__": "requests", "method": "GET", "code": "500"},
+			nil,
+		},
+		{
+			"replace with the groups of the regex",
+			"- {source_labels: [path], regex: '/api/([^/]+)/.*', target_label: endpoint, replacement: '$1'}",
+			map[string]string{"__name__": "requests", "path": "/api/users/42"},
+			map[string]string{"__name__": "requests", "path": "/api/users/42", "endpoint": "users"},
+		},
+		{
+			"leave the labels when the replace regex doesn't match",
+			"- {source_labels: [path], regex: '/api/([^/]+)/.*', target_label: endpoint}",
+			map[string]string{"__name__": "requests", "path": "/healthz"},
+			map[string]string{"__name__": "requests", "path": "/healthz"},
+		},
+		{
+			"remove a label replaced with an empty value",
+			"- {target_label: path, replacement: ''}",
+			map[string]string{"__name__": "requests", "path": "/api/users/42"},
+			map[string]string{"__name__": "requests"},
+		},
+		{
+			"rename a metric",
+			"- {source_labels: [__name__], regex: 'http_(.*)', target_label: __name__, replacement: 'app_$1'}",
+			map[string]string{"__name__": "http_requests"},
+			map[string]string{"__name__": "app_requests"},
+		},
+		{
+			"set the modulus of the hash",
+			"- {source_labels: [pod], modulus: 4, target_label: shard, action: hashmod}",
+			map[string]string{"__name__": "requests", "pod": "pod-1"},
+			map[string]string{"__name__": "requests", "pod": "pod-1", "shard": "3"},
+		},
+		{
+			"map labels to new names",
+			"- {regex: 'meta_(.+)', action: labelmap}",
+			map[string]string{"__name__": "requests", "meta_team": "payments"},
+			map[string]string{"__name__": "requests", "meta_team": "payments", "team": "payments"},
+		},
+		{
+			"drop the labels whose name matches",
+			"- {regex: 'meta_.+', action: labeldrop}",
+			map[string]string{"__name__": "requests", "meta_team": "payments", "method": "GET"},
+			map[string]string{"__name__": "requests", "method": "GET"},
+		},
+		{
+			"keep the labels whose name matches",
+			"- {regex: '__name__|method', action: labelkeep}",
+			map[string]string{"__name__": "requests", "meta_team": "payments", "method": "GET"},
+			map[string]string{"__name__": "requests", "method": "GET"},
+		},
+		{
+			"apply the rules in order",
+			`
+- {source_labels: [pod], modulus: 4, target_label: shard, action: hashmod}
+- {source_labels: [shard], regex: '3', action: drop}
+`,
+			map[string]string{"__name__": "requests", "pod": "pod-1"},
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			kept := Process(tc.labels, parseRules(t, tc.rules))
+			if tc.expectedLabels == nil {
+				assert.False(t, kept)
+				return
+			}
+			assert.True(t, kept)
+			assert.Equal(t, tc.expectedLabels, tc.labels)
+		})
+	}
+}
+
+// family returns a metric family with a series of the given value per method label.
+func family(name string, metricType promclient.MetricType, methods ...string) *promclient.MetricFamily {
+	mf := &promclient.MetricFamily{Name: proto.String(name), Type: metricType.Enum()}
+	for _, method := range methods {
+		mf.Metric = append(mf.Metric, &promclient.Metric{
+			Label: []*promclient.LabelPair{metrictest.LabelPair("method", method)},
+			Gauge: &promclient.Gauge{Value: proto.Float64(1)},
+		})
+	}
+	return mf
+}
+
+// histogram returns a histogram family with a single series, with a bucket per upper bound holding one observation
+// each, and one more observation in the +Inf bucket the series leaves out.
+func histogram(name string, upperBounds ...float64) *promclient.MetricFamily {
+	h := &promclient.Histogram{SampleCount: proto.Uint64(uint64(len(upperBounds) + 1)), SampleSum: proto.Float64(10)}
+	for i, upperBound := range upperBounds {
+		h.Bucket = append(h.Bucket, &promclient.Bucket{UpperBound: proto.Float64(upperBound), CumulativeCount: proto.Uint64(uint64(i + 1))})
+	}
+	return &promclient.MetricFamily{
+		Name:   proto.String(name),
+		Help:   proto.String("Latency of the requests."),
+		Type:   promclient.MetricType_HISTOGRAM.Enum(),
+		Metric: []*promclient.Metric{{Histogram: h}},
+	}
+}
+
+// summary returns a summary family with a single series with the given quantiles.
+func summary(name string, quantiles ...float64) *promclient.MetricFamily {
+	s := &promclient.Summary{SampleCount: proto.Uint64(10), SampleSum: proto.Float64(100)}
+	for _, q := range quantiles {
+		s.Quantile = append(s.Quantile, &promclient.Quantile{Quantile: proto.Float64(q), Value: proto.Float64(q * 10)})
+	}
+	return &promclient.MetricFamily{
+		Name:   proto.String(name),
+		Help:   proto.String("Latency of the requests."),
+		Type:   promclient.MetricType_SUMMARY.Enum(),
+		Metric: []*promclient.Metric{{Summary: s}},
+	}
+}
+
+// untyped returns an untyped family with a single series of the given value and labels.
+func untyped(name string, value float64, labels ...*promclient.LabelPair) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name:   proto.String(name),
+		Type:   promclient.MetricType_UNTYPED.Enum(),
+		Metric: []*promclient.Metric{{Label: labels, Untyped: &promclient.Untyped{Value: proto.Float64(value)}}},
+	}
+}
+
+func TestMetricFamilies(t *testing.T) {
+	testCases := []struct {
+		name                   string
+		rules                  string
+		metricFamilies         map[string]*promclient.MetricFamily
+		expectedMetricFamilies map[string]*promclient.MetricFamily
+		expectedDropped        int
+	}{
+		{
+			"leave the families without rules",
+			"",
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "GET")},
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "GET")},
+			0,
+		},
+		{
+			"drop series and the families left empty",
+			"- {source_labels: [method], regex: POST, action: drop}",
+			map[string]*promclient.MetricFamily{
+				"requests": family("requests", promclient.MetricType_GAUGE, "GET", "POST"),
+				"uploads":  family("uploads", promclient.MetricType_GAUGE, "POST"),
+			},
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "GET")},
+			2,
+		},
+		{
+			"move renamed series to the family of their new name",
+			"- {source_labels: [__name__], regex: 'legacy_(.*)', target_label: __name__}",
+			map[string]*promclient.MetricFamily{
+				"legacy_requests": family("legacy_requests", promclient.MetricType_GAUGE, "POST"),
+				"requests":        family("requests", promclient.MetricType_GAUGE, "GET"),
+			},
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "POST", "GET")},
+			0,
+		},
+		{
+			"drop renamed series whose new family has another type",
+			"- {source_labels: [__name__], regex: 'legacy_(.*)', target_label: __name__}",
+			map[string]*promclient.MetricFamily{
+				"legacy_requests": family("legacy_requests", promclient.MetricType_COUNTER, "POST"),
+				"requests":        family("requests", promclient.MetricType_GAUGE, "GET"),
+			},
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "GET")},
+			1,
+		},
+		{
+			"sort the labels of relabelled series",
+			"- {target_label: code, replacement: '200'}",
+			map[string]*promclient.MetricFamily{"requests": family("requests", promclient.MetricType_GAUGE, "GET")},
+			map[string]*promclient.MetricFamily{
+				"requests": {
+					Name: proto.String("requests"),
+					Type: promclient.MetricType_GAUGE.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{metrictest.LabelPair("code", "200"), metrictest.LabelPair("method", "GET")},
+							Gauge: &promclient.Gauge{Value: proto.Float64(1)},
+						},
+					},
+				},
+			},
+			0,
+		},
+		{
+			"drop the buckets of histograms by their le label",
+			"- {source_labels: [__name__, le], regex: 'latency_bucket;0.5', action: drop}",
+			map[string]*promclient.MetricFamily{"latency": histogram("latency", 0.1, 0.5, 1)},
+			map[string]*promclient.MetricFamily{
+				"latency": func() *promclient.MetricFamily {
+					mf := histogram("latency", 0.1, 0.5, 1)
+					h := mf.Metric[0].Histogram
+					h.Bucket = []*promclient.Bucket{h.Bucket[0], h.Bucket[2]}
+					return mf
+				}(),
+			},
+			1,
+		},
+		{
+			"drop the quantiles of summaries by their quantile label",
+			"- {source_labels: [quantile], regex: '0.99', action: drop}",
+			map[string]*promclient.MetricFamily{"latency": summary("latency", 0.5, 0.99)},
+			map[string]*promclient.MetricFamily{
+				"latency": func() *promclient.MetricFamily {
+					mf := summary("latency", 0.5)
+					return mf
+				}(),
+			},
+			1,
+		},
+		{
+			"rename histograms whose series are renamed alike",
+			"- {source_labels: [__name__], regex: 'latency_(.*)', target_label: __name__, replacement: 'request_latency_$1'}",
+			map[string]*promclient.MetricFamily{"latency": histogram("latency", 0.1)},
+			map[string]*promclient.MetricFamily{
+				"request_latency": func() *promclient.MetricFamily {
+					mf := histogram("request_latency", 0.1)
+					return mf
+				}(),
+			},
+			0,
+		},
+		{
+			"keep the sum and count of histograms without buckets as untyped series",
+			"- {source_labels: [__name__], regex: latency_bucket, action: drop}",
+			map[string]*promclient.MetricFamily{"latency": histogram("latency", 0.1, 1)},
+			map[string]*promclient.MetricFamily{
+				"latency_sum":   untyped("latency_sum", 10),
+				"latency_count": untyped("latency_count", 3),
+			},
+			3,
+		},
+		{
+			"keep the sum and count of summaries whose quantile label is dropped as untyped series",
+			"- {regex: quantile, action: labeldrop}",
+			map[string]*promclient.MetricFamily{"latency": summary("latency", 0.5)},
+			map[string]*promclient.MetricFamily{
+				"latency_sum":   untyped("latency_sum", 100),
+				"latency_count": untyped("latency_count", 10),
+			},
+			1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dropped := MetricFamilies(tc.metricFamilies, parseRules(t, tc.rules))
+			assert.Equal(t, tc.expectedDropped, dropped)
+			assert.Equal(t, tc.expectedMetricFamilies, tc.metricFamilies)
+		})
+	}
+}
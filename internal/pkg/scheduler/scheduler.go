@@ -0,0 +1,188 @@
+package scheduler
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time of the scheduler, so that tests can replace it with a fake clock.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the part of time.Timer used by the scheduler.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// RealClock is the Clock backed by the time package.
+type RealClock struct{}
+
+// Now returns the current time.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer returns a Timer firing once after the given duration.
+func (RealClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// Scheduler runs a job per container on its own timer. The first run of each job is offset by a stable,
+// name-derived amount up to the jitter, or up to the interval of the job when the runs are spread, so that the jobs of
+// different containers don't run at the same time.
+// A job never overlaps with its own next run: runs that would have started while the job was still busy are skipped.
+type Scheduler struct {
+	clock    Clock
+	interval time.Duration
+	jitter   time.Duration
+	spread   bool
+	mu       sync.Mutex
+	stops    map[string]chan struct{}
+	// done holds, for each name, a channel closed once the latest job scheduled under that name has stopped, so that
+	// a job scheduled again under the same name never overlaps with the run of its predecessor.
+	done map[string]chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a new Scheduler pointer. The jitter is capped at the interval of each job, and ignored when spread is
+// set, in which case the first runs are spread over the whole interval of each job. It panics if the interval is not
+// positive or the jitter is negative.
+func New(clock Clock, interval time.Duration, jitter time.Duration, spread bool) *Scheduler {
+	if interval <= 0 {
+		panic(fmt.Sprintf("scheduler: non-positive interval %s", interval))
+	}
+	if jitter < 0 {
+		panic(fmt.Sprintf("scheduler: negative jitter %s", jitter))
+	}
+	return &Scheduler{
+		clock:    clock,
+		interval: interval,
+		jitter:   jitter,
+		spread:   spread,
+		stops:    make(map[string]chan struct{}),
+		done:     make(map[string]chan struct{}),
+	}
+}
+
+// Schedule starts running the job with the given name every interval. A job that is already scheduled under the
+// same name is left running as it is.
+func (s *Scheduler) Schedule(name string, job func()) {
+	s.ScheduleEvery(name, s.interval, job)
+}
+
+// ScheduleEvery starts running the job with the given name every given interval, rather than the interval of the
+// scheduler. A job that is already scheduled under the same name is left running as it is. It panics if the interval
+// is not positive.
+func (s *Scheduler) ScheduleEvery(name string, interval time.Duration, job func()) {
+	if interval <= 0 {
+		panic(fmt.Sprintf("scheduler: non-positive interval %s of job %s", interval, name))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stops[name]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	previous := s.done[name]
+	s.stops[name] = stop
+	s.done[name] = done
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer s.finish(name, done)
+		if previous != nil {
+			<-previous
+		}
+		s.run(stop, interval, s.offset(name, interval), job)
+	}()
+}
+
+// Unschedule stops running the job with the given name. A run in progress is allowed to finish.
+func (s *Scheduler) Unschedule(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.stops[name]; ok {
+		close(stop)
+		delete(s.stops, name)
+	}
+}
+
+// Scheduled reports whether a job is scheduled under the given name.
+func (s *Scheduler) Scheduled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.stops[name]
+	return ok
+}
+
+// Stop stops running all jobs and waits for the runs in progress to finish.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	for name, stop := range s.stops {
+		close(stop)
+		delete(s.stops, name)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// finish marks the job scheduled under the name as stopped.
+func (s *Scheduler) finish(name string, done chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(done)
+	if s.done[name] == done {
+		delete(s.done, name)
+	}
+}
+
+// run runs the job on its own timer until it is stopped.
+func (s *Scheduler) run(stop <-chan struct{}, interval time.Duration, offset time.Duration, job func()) {
+	next := s.clock.Now().Add(offset)
+	for {
+		timer := s.clock.NewTimer(next.Sub(s.clock.Now()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		job()
+
+		next = next.Add(interval)
+		if now := s.clock.Now(); !next.After(now) {
+			missed := now.Sub(next)/interval + 1
+			next = next.Add(missed * interval)
+		}
+	}
+}
+
+// offset returns the stable offset of the first run of the named job, with the jitter capped at the interval of the
+// job.
+func (s *Scheduler) offset(name string, interval time.Duration) time.Duration {
+	jitter := s.jitter
+	if s.spread || jitter > interval {
+		jitter = interval
+	}
+	if jitter <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return time.Duration(h.Sum64() % uint64(jitter))
+}
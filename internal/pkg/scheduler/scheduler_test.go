@@ -0,0 +1,259 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const interval = 10 * time.Second
+
+// fakeClock is a Clock whose time only moves when the test advances it.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+// Advance moves the time forward and fires the timers whose deadline has passed.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			t.c <- c.now
+		}
+	}
+	c.timers = pending
+}
+
+// WaitForTimers waits until the given number of timers are pending and returns their deadlines.
+func (c *fakeClock) WaitForTimers(t *testing.T, n int) []time.Time {
+	var deadlines []time.Time
+	require.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		deadlines = deadlines[:0]
+		for _, timer := range c.timers {
+			deadlines = append(deadlines, timer.deadline)
+		}
+		return len(deadlines) == n
+	}, time.Second, time.Millisecond)
+	return deadlines
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func TestOffset(t *testing.T) {
+	testCases := []struct {
+		name        string
+		jitter      time.Duration
+		spread      bool
+		expectedMax time.Duration
+	}{
+		{"offsets are spread within the jitter", 5 * time.Second, false, 5 * time.Second},
+		{"jitter larger than the interval is capped", time.Hour, false, interval},
+		{"spreading ignores the jitter and spreads over the interval", time.Second, true, interval},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := New(newFakeClock(), interval, tc.jitter, tc.spread)
+			offsets := make(map[time.Duration]bool)
+			for _, name := range []string{"container1", "container2", "container3"} {
+				offset := s.offset(name, interval)
+				assert.Equal(t, offset, s.offset(name, interval), "the offset of a container must be stable")
+				assert.True(t, offset >= 0 && offset < tc.expectedMax)
+				offsets[offset] = true
+			}
+			assert.Len(t, offsets, 3)
+		})
+	}
+
+	assert.Equal(t, time.Duration(0), New(newFakeClock(), interval, 0, false).offset("container1", interval))
+	assert.Less(t, New(newFakeClock(), interval, interval, false).offset("container1", time.Second), time.Second,
+		"the jitter must be capped at the interval of the job")
+	assert.Less(t, New(newFakeClock(), interval, 0, true).offset("container1", time.Second), time.Second,
+		"the offsets must be spread over the interval of the job")
+}
+
+func TestNewRejectsInvalidSettings(t *testing.T) {
+	testCases := []struct {
+		name          string
+		interval      time.Duration
+		jitter        time.Duration
+		expectedPanic string
+	}{
+		{"rejects a zero interval", 0, 0, "scheduler: non-positive interval 0s"},
+		{"rejects a negative interval", -time.Second, 0, "scheduler: non-positive interval -1s"},
+		{"rejects a negative jitter", interval, -time.Millisecond, "scheduler: negative jitter -1ms"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.PanicsWithValue(t, tc.expectedPanic, func() { New(newFakeClock(), tc.interval, tc.jitter, false) })
+		})
+	}
+
+	s := New(newFakeClock(), interval, 0, false)
+	assert.PanicsWithValue(t, "scheduler: non-positive interval 0s of job container1", func() {
+		s.ScheduleEvery("container1", 0, func() {})
+	})
+}
+
+func TestScheduleRunsEveryInterval(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	s := New(clock, interval, 0, false)
+	runs := make(chan string, 10)
+	s.Schedule("container1", func() { runs <- "container1" })
+	s.Schedule("container2", func() { runs <- "container2" })
+	defer s.Stop()
+
+	// Without jitter both containers run immediately, each on its own timer.
+	assert.ElementsMatch(t, []string{"container1", "container2"}, []string{<-runs, <-runs})
+	for i := 1; i <= 3; i++ {
+		deadlines := clock.WaitForTimers(t, 2)
+		assert.Equal(t, []time.Time{start.Add(time.Duration(i) * interval), start.Add(time.Duration(i) * interval)}, deadlines)
+		clock.Advance(interval)
+		assert.ElementsMatch(t, []string{"container1", "container2"}, []string{<-runs, <-runs})
+	}
+}
+
+func TestSlowJobNeverOverlaps(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	s := New(clock, interval, 0, false)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	s.Schedule("slow", func() {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		started <- struct{}{}
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	defer s.Stop()
+
+	<-started
+	// The run takes two and a half intervals, so the two runs that fall within it are skipped.
+	clock.Advance(interval*2 + interval/2)
+	release <- struct{}{}
+
+	deadlines := clock.WaitForTimers(t, 1)
+	assert.Equal(t, []time.Time{start.Add(3 * interval)}, deadlines)
+	clock.Advance(interval / 2)
+	<-started
+	release <- struct{}{}
+	assert.Equal(t, 1, maxRunning)
+}
+
+func TestUnschedule(t *testing.T) {
+	clock := newFakeClock()
+	s := New(clock, interval, 0, false)
+	runs := make(chan struct{}, 10)
+	s.Schedule("container1", func() { runs <- struct{}{} })
+	s.Schedule("container1", func() { t.Error("a scheduled container must not be scheduled twice") })
+	<-runs
+
+	clock.WaitForTimers(t, 1)
+	assert.True(t, s.Scheduled("container1"))
+	s.Unschedule("container1")
+	assert.False(t, s.Scheduled("container1"))
+	clock.WaitForTimers(t, 0)
+	clock.Advance(interval)
+	s.Stop()
+	assert.Empty(t, runs)
+}
+
+func TestScheduleEvery(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	s := New(clock, interval, 0, false)
+	runs := make(chan struct{}, 10)
+	s.ScheduleEvery("container1", 3*interval, func() { runs <- struct{}{} })
+	defer s.Stop()
+
+	<-runs
+	deadlines := clock.WaitForTimers(t, 1)
+	assert.Equal(t, []time.Time{start.Add(3 * interval)}, deadlines)
+}
+
+func TestRescheduleWaitsForPreviousRun(t *testing.T) {
+	clock := newFakeClock()
+	s := New(clock, interval, 0, false)
+	started := make(chan string)
+	release := make(chan struct{})
+	s.Schedule("container1", func() {
+		started <- "old"
+		<-release
+	})
+	defer s.Stop()
+	assert.Equal(t, "old", <-started)
+
+	// The job is rescheduled while its previous run is still in progress, as a reload changing its interval does.
+	s.Unschedule("container1")
+	s.ScheduleEvery("container1", 2*interval, func() { started <- "new" })
+	select {
+	case job := <-started:
+		t.Fatalf("the %s job ran while the previous run was in progress", job)
+	case <-time.After(10 * time.Millisecond):
+	}
+	release <- struct{}{}
+	assert.Equal(t, "new", <-started)
+}
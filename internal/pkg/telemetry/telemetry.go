@@ -0,0 +1,178 @@
+package telemetry
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "multiplexer"
+
+// The reasons a scrape of a container can fail for, used as the reason label of ScrapeErrors.
+const (
+	ReasonRequest    = "request"
+	ReasonAuth       = "auth"
+	ReasonTimeout    = "timeout"
+	ReasonCanceled   = "canceled"
+	ReasonConnection = "connection"
+	ReasonTLS        = "tls"
+	ReasonStatus     = "status"
+	ReasonRead       = "read"
+	ReasonDecompress = "decompress"
+	ReasonParse      = "parse"
+	ReasonLabel      = "label"
+	// ReasonTypeConflict are scrapes failed by the fail type conflict policy.
+	ReasonTypeConflict = "type_conflict"
+	// ReasonBodySizeLimit and ReasonLimit are scrapes whose metrics exceeded the body size limit, or the limits on
+	// their samples and labels.
+	ReasonBodySizeLimit = "body_size_limit"
+	ReasonLimit         = "limit"
+)
+
+// The reasons a request to the sidecar can be rejected for, used as the reason label of AuthFailures.
+const (
+	AuthReasonMissingCredentials = "missing_credentials"
+	AuthReasonInvalidCredentials = "invalid_credentials"
+)
+
+// Registry is the registry of the metrics describing the sidecar itself. It is kept apart from the default registry
+// so that the sidecar's own metrics never mix with the multiplexed metrics of the containers.
+var Registry = prometheus.NewRegistry()
+
+// TypeConflicts counts the metric families whose type differed between containers, by container and by the policy
+// that was applied to resolve the conflict.
+var TypeConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "type_conflicts_total",
+	Help:      "Number of metric families dropped, renamed or failed because their type conflicted with another container.",
+}, []string{"container", "policy"})
+
+// ScrapeErrors counts the failed scrapes of containers by the reason they failed for.
+var ScrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "scrape_errors_total",
+	Help:      "Number of failed scrapes of containers, by reason.",
+}, []string{"reason"})
+
+// ScrapeDuration observes how long the HTTP requests scraping the containers take.
+var ScrapeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "upstream_scrape_duration_seconds",
+	Help:      "Duration of the HTTP requests scraping the containers.",
+	Buckets:   prometheus.DefBuckets,
+})
+
+// CodecDuration observes how long unmarshalling and marshalling metrics takes, by operation.
+var CodecDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "codec_duration_seconds",
+	Help:      "Duration of unmarshalling scraped metrics and marshalling multiplexed metrics, by operation.",
+	Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25},
+}, []string{"operation"})
+
+// LabelDuration observes how long appending the container label to the metrics of a container takes.
+var LabelDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "label_duration_seconds",
+	Help:      "Duration of appending the container label to the metrics of a container.",
+	Buckets:   []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01},
+})
+
+// ScrapeLimitsExceeded counts the scrapes of containers that failed because their metrics exceeded a limit, by
+// container and by limit.
+var ScrapeLimitsExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "scrape_limit_exceeded_total",
+	Help:      "Number of scrapes of containers that failed because their metrics exceeded a limit, by container and limit.",
+}, []string{"container", "limit"})
+
+// RelabelDroppedSeries counts the series dropped by the metric relabelling rules, by container.
+var RelabelDroppedSeries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "relabel_dropped_series_total",
+	Help:      "Number of series dropped by the metric relabelling rules, by container.",
+}, []string{"container"})
+
+// CachedSamples is the number of samples cached for each container.
+var CachedSamples = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "cached_samples",
+	Help:      "Number of samples cached for each container.",
+}, []string{"container"})
+
+// RequestDuration observes how long serving the multiplexed metrics takes, by status code.
+var RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "request_duration_seconds",
+	Help:      "Duration of the requests for the multiplexed metrics, by status code.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"code"})
+
+// ResponseSize observes the size of the multiplexed metrics responses, by status code.
+var ResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "response_size_bytes",
+	Help:      "Size of the responses to the requests for the multiplexed metrics, by status code.",
+	Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+}, []string{"code"})
+
+// AuthFailures counts the requests to the sidecar that were rejected because they lacked valid credentials, by reason.
+var AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "http_auth_failures_total",
+	Help:      "Number of requests to the sidecar rejected because they lacked valid credentials, by reason.",
+}, []string{"reason"})
+
+// ConfigReloads counts the reloads of the configuration file by result, either "success" or "failure".
+var ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "config_reloads_total",
+	Help:      "Number of reloads of the configuration file, by result.",
+}, []string{"result"})
+
+// ConfigLastReloadSuccessful is 1 if the last reload of the configuration file succeeded, 0 otherwise.
+var ConfigLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "config_last_reload_successful",
+	Help:      "Whether the last reload of the configuration file succeeded.",
+})
+
+// ConfigLastReloadSuccessTimestamp is the Unix time of the last successful reload of the configuration file.
+var ConfigLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "config_last_reload_success_timestamp_seconds",
+	Help:      "Unix time of the last successful reload of the configuration file.",
+})
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		TypeConflicts,
+		ScrapeErrors,
+		ScrapeDuration,
+		CodecDuration,
+		LabelDuration,
+		RelabelDroppedSeries,
+		ScrapeLimitsExceeded,
+		CachedSamples,
+		RequestDuration,
+		ResponseSize,
+		AuthFailures,
+		ConfigReloads,
+		ConfigLastReloadSuccessful,
+		ConfigLastReloadSuccessTimestamp,
+	)
+}
+
+// Handler returns the HTTP handler serving the metrics of the sidecar itself.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentMetricsHandler wraps the handler of the multiplexed metrics, observing the duration and size of its
+// responses.
+func InstrumentMetricsHandler(handler http.Handler) http.Handler {
+	return promhttp.InstrumentHandlerDuration(RequestDuration, promhttp.InstrumentHandlerResponseSize(ResponseSize, handler))
+}
@@ -5,40 +5,229 @@ import (
 	"compress/gzip"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/common/model"
 )
 
 var errInvalidLabelName = errors.New("received invalid label name")
 
-// GenerateContainerToPortMap generates a map structure for the flag `container_to_port_map`.
-func GenerateContainerToPortMap(containerPortList []string) (map[string]int, error) {
-	if len(containerPortList) == 0 {
-		return nil, fmt.Errorf("received an empty container:port list")
+const (
+	defaultScheme = "http"
+	defaultHost   = "localhost"
+	// regexPrefix marks a container pattern as a regular expression rather than a glob.
+	regexPrefix = "regex:"
+)
+
+// Target is where the metrics of a container are scraped from.
+type Target struct {
+	Scheme string
+	Host   string
+	Port   int
+	Path   string
+	// BodySizeLimit is the size in bytes the uncompressed metrics of the target may not exceed, 0 for no limit.
+	BodySizeLimit int64
+	// TLS are the TLS settings of a target scraped over https.
+	TLS TLSConfig
+	// Auth is how the scrapes of the target are authenticated.
+	Auth AuthConfig
+}
+
+// Equal reports whether the targets are scraped in the same way.
+func (t Target) Equal(other Target) bool {
+	return reflect.DeepEqual(t, other)
+}
+
+// TLSConfig are the TLS settings a target is scraped with. The files are read again whenever they change, so that
+// rotated certificates are picked up without a restart.
+type TLSConfig struct {
+	// CAFile is the CA bundle the certificate of the target is verified with, rather than the system roots.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are the client certificate and key presented to a target that requires one.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ServerName is the name the certificate of the target is verified for, rather than its host.
+	ServerName string `yaml:"server_name"`
+	// InsecureSkipVerify disables the verification of the certificate of the target.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+// Validate checks that the client certificate and key are given together.
+func (c TLSConfig) Validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("a client certificate requires both cert_file and key_file")
 	}
+	return nil
+}
 
-	containerPortMap := make(map[string]int)
-	for _, entry := range containerPortList {
-		s := strings.Split(entry, ":")
-		if len(s) != 2 {
-			return nil, fmt.Errorf("failed to parse \"container_name\":\"port\" entry: %s: incorrect number of elements", entry)
+// AuthConfig is how the scrapes of a target are authenticated. The files are read again whenever they change, so that
+// rotated credentials, such as projected service account tokens, are picked up without a restart.
+type AuthConfig struct {
+	// BearerToken and BearerTokenFile are the bearer token sent with every scrape, or the file it is read from.
+	BearerToken     string `yaml:"bearer_token"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	// BasicAuth are the basic auth credentials sent with every scrape.
+	BasicAuth BasicAuth `yaml:"basic_auth"`
+	// Headers are sent with every scrape.
+	Headers map[string]string `yaml:"headers"`
+}
+
+// BasicAuth are basic auth credentials, with the password given either as is or as the file it is read from.
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// reservedHeaders are set by the sidecar itself, so they can't be given as headers of a target.
+var reservedHeaders = []string{"Accept", "Accept-Encoding", "Authorization"}
+
+// Validate checks that at most one kind of credentials is given, and that the headers don't override those the
+// sidecar sets.
+func (c AuthConfig) Validate() error {
+	kinds := 0
+	for _, set := range []bool{c.BearerToken != "", c.BearerTokenFile != "", c.BasicAuth != (BasicAuth{})} {
+		if set {
+			kinds++
 		}
-		if len(s[0]) == 0 {
-			return nil, fmt.Errorf("missing container name for entry '%s'", entry)
+	}
+	if kinds > 1 {
+		return fmt.Errorf("at most one of bearer_token, bearer_token_file and basic_auth can be given")
+	}
+	if c.BasicAuth != (BasicAuth{}) {
+		if c.BasicAuth.Username == "" {
+			return fmt.Errorf("basic_auth requires a username")
 		}
-
-		if len(s[1]) == 0 {
-			return nil, fmt.Errorf("missing port value for entry '%s'", entry)
+		if c.BasicAuth.Password != "" && c.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("at most one of password and password_file can be given")
+		}
+	}
+	for name := range c.Headers {
+		if name == "" {
+			return fmt.Errorf("header names must not be empty")
+		}
+		for _, reserved := range reservedHeaders {
+			if strings.EqualFold(name, reserved) {
+				return fmt.Errorf("header %s is reserved", name)
+			}
 		}
+	}
+	return nil
+}
+
+// URL returns the URL the metrics of the target are scraped from.
+func (t Target) URL() string {
+	return fmt.Sprintf("%s://%s%s", t.Scheme, net.JoinHostPort(t.Host, strconv.Itoa(t.Port)), t.Path)
+}
+
+// Validate checks if the target can be scraped.
+func (t Target) Validate() error {
+	if t.Scheme != "http" && t.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", t.Scheme)
+	}
+	if len(t.Host) == 0 {
+		return fmt.Errorf("missing host")
+	}
+	if t.Port <= 0 || t.Port > 65535 {
+		return fmt.Errorf("port %d out of range", t.Port)
+	}
+	if !strings.HasPrefix(t.Path, "/") {
+		return fmt.Errorf("path %q must start with /", t.Path)
+	}
+	return nil
+}
+
+// GenerateTargets generates the targets of the containers from the flag `container_to_port_map`. An entry is either
+// formatted as <container>:<port>[<path>], which is scraped over http on localhost, or as <container>=<url> with the
+// scheme, host, port and path of the URL. Entries without a path are scraped on the default path.
+func GenerateTargets(containerTargetList []string, defaultPath string) (map[string]Target, error) {
+	if len(containerTargetList) == 0 {
+		return nil, fmt.Errorf("received an empty container:port list")
+	}
+
+	targets := make(map[string]Target)
+	for _, entry := range containerTargetList {
+		var containerName string
+		var target Target
 		var err error
-		containerPortMap[s[0]], err = strconv.Atoi(s[1])
+		if i := strings.Index(entry, "="); i >= 0 {
+			containerName = entry[:i]
+			target, err = ParseTargetURL(entry[i+1:], defaultPath)
+		} else {
+			containerName, target, err = parseContainerPort(entry, defaultPath)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse string to int for entry %s: %w", entry, err)
+			return nil, err
 		}
+		if len(containerName) == 0 {
+			return nil, fmt.Errorf("missing container name for entry '%s'", entry)
+		}
+		if _, ok := targets[containerName]; ok {
+			return nil, fmt.Errorf("duplicate container name for entry '%s'", entry)
+		}
+		if err := target.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid target for entry '%s': %w", entry, err)
+		}
+		targets[containerName] = target
 	}
-	return containerPortMap, nil
+	return targets, nil
+}
+
+// parseContainerPort parses an entry formatted as <container>:<port>[<path>].
+func parseContainerPort(entry string, defaultPath string) (string, Target, error) {
+	s := strings.Split(entry, ":")
+	if len(s) != 2 {
+		return "", Target{}, fmt.Errorf("failed to parse \"container_name\":\"port\" entry: %s: incorrect number of elements", entry)
+	}
+	port, path := s[1], defaultPath
+	if i := strings.Index(port, "/"); i >= 0 {
+		port, path = port[:i], port[i:]
+	}
+	if len(port) == 0 {
+		return "", Target{}, fmt.Errorf("missing port value for entry '%s'", entry)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", Target{}, fmt.Errorf("failed to parse string to int for entry %s: %w", entry, err)
+	}
+	return s[0], NewLocalTarget(p, path), nil
+}
+
+// NewLocalTarget returns the target scraped over http on the given port of localhost.
+func NewLocalTarget(port int, path string) Target {
+	return Target{Scheme: defaultScheme, Host: defaultHost, Port: port, Path: path}
+}
+
+// ParseTargetURL parses the URL a target is scraped from, such as the URL of an entry formatted as <container>=<url>.
+// URLs without a path are scraped on the default path.
+func ParseTargetURL(rawURL string, defaultPath string) (Target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return Target{}, fmt.Errorf("failed to parse target URL %s: %w", rawURL, err)
+	}
+	if u.Port() == "" {
+		return Target{}, fmt.Errorf("missing port value for target URL '%s'", rawURL)
+	}
+	port, err := strconv.Atoi(u.Port())
+	if err != nil {
+		return Target{}, fmt.Errorf("failed to parse string to int for target URL %s: %w", rawURL, err)
+	}
+	path := u.EscapedPath()
+	if len(path) == 0 {
+		path = defaultPath
+	}
+	if len(u.RawQuery) != 0 {
+		path += "?" + u.RawQuery
+	}
+	return Target{Scheme: u.Scheme, Host: u.Hostname(), Port: port, Path: path}, nil
 }
 
 // CompressDataToGzip zips the given byte slice using gzip encoding
@@ -90,3 +279,101 @@ func ValidateLabelName(labelName string) error {
 	}
 	return nil
 }
+
+// ParseLabels parses labels given as entries formatted as <name>=<value>, such as the entries of the flag
+// `extra_labels`.
+func ParseLabels(entries []string) (map[string]string, error) {
+	labels := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("failed to parse \"name\"=\"value\" entry: %s: missing =", entry)
+		}
+		name := entry[:i]
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("duplicate label name for entry '%s'", entry)
+		}
+		labels[name] = entry[i+1:]
+	}
+	return labels, nil
+}
+
+// LogLimiter rate limits log lines that may repeat on every scrape, allowing at most one line per key and interval.
+type LogLimiter struct {
+	interval   time.Duration
+	now        func() time.Time
+	mu         sync.Mutex
+	lastLogged map[string]time.Time
+}
+
+// NewLogLimiter returns a new LogLimiter pointer.
+func NewLogLimiter(interval time.Duration) *LogLimiter {
+	return &LogLimiter{
+		interval:   interval,
+		now:        time.Now,
+		lastLogged: make(map[string]time.Time),
+	}
+}
+
+// Allow reports whether a line with the given key may be logged now, and if so records that it was.
+func (l *LogLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if last, ok := l.lastLogged[key]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	l.lastLogged[key] = now
+	return true
+}
+
+// ContainerFilter matches container names against a list of patterns. A pattern is either a glob, such as `istio-*`,
+// or a regular expression prefixed with `regex:`, such as `regex:istio-(proxy|init)`, which has to match the whole
+// container name.
+type ContainerFilter struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+// NewContainerFilter returns a new ContainerFilter pointer matching the given patterns. Empty patterns are ignored.
+func NewContainerFilter(patterns []string) (*ContainerFilter, error) {
+	filter := &ContainerFilter{}
+	for _, pattern := range patterns {
+		if len(pattern) == 0 {
+			continue
+		}
+		if strings.HasPrefix(pattern, regexPrefix) {
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, regexPrefix) + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid container pattern '%s': %w", pattern, err)
+			}
+			filter.regexps = append(filter.regexps, re)
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid container pattern '%s': %w", pattern, err)
+		}
+		filter.globs = append(filter.globs, pattern)
+	}
+	return filter, nil
+}
+
+// Empty reports whether the filter has no patterns, and so matches no container.
+func (f *ContainerFilter) Empty() bool {
+	return len(f.globs) == 0 && len(f.regexps) == 0
+}
+
+// Matches reports whether the container name matches any of the patterns.
+func (f *ContainerFilter) Matches(containerName string) bool {
+	for _, glob := range f.globs {
+		if ok, _ := path.Match(glob, containerName); ok {
+			return true
+		}
+	}
+	for _, re := range f.regexps {
+		if re.MatchString(containerName) {
+			return true
+		}
+	}
+	return false
+}
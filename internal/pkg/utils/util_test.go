@@ -2,18 +2,19 @@ package utils
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-func TestGenerateContainerToPortMap(t *testing.T) {
+func TestGenerateTargets(t *testing.T) {
 
 	testCases := []struct {
 		name          string
 		flags         []string
 		errString     string
-		resultMapping map[string]int
+		resultMapping map[string]Target
 	}{
 		{"returns an error when input is nil",
 			nil,
@@ -49,20 +50,60 @@ func TestGenerateContainerToPortMap(t *testing.T) {
 			"failed to parse string to int",
 			nil,
 		},
+		{"returns an error when input has an out of range port value",
+			[]string{"port:114534"},
+			"port 114534 out of range",
+			nil,
+		},
+		{"returns an error when a container is given twice",
+			[]string{"port1:123", "port1:456"},
+			"duplicate container name",
+			nil,
+		},
+		{"returns an error when a URL doesn't have a port",
+			[]string{"envoy=http://localhost/stats/prometheus"},
+			"missing port value",
+			nil,
+		},
+		{"returns an error when a URL has an unsupported scheme",
+			[]string{"envoy=ftp://localhost:21/metrics"},
+			"unsupported scheme",
+			nil,
+		},
+		{"returns an error when a URL doesn't have a container name",
+			[]string{"=http://localhost:9901/stats/prometheus"},
+			"missing container name",
+			nil,
+		},
 		{"generates correct mapping with correct inputs",
-			[]string{"port1:123", "port2:456", "portYeah:114534"},
+			[]string{"port1:123", "port2:456", "portYeah:11453"},
+			"",
+			map[string]Target{
+				"port1":    {Scheme: "http", Host: "localhost", Port: 123, Path: "/metrics"},
+				"port2":    {Scheme: "http", Host: "localhost", Port: 456, Path: "/metrics"},
+				"portYeah": {Scheme: "http", Host: "localhost", Port: 11453, Path: "/metrics"},
+			},
+		},
+		{"generates correct mapping with paths and URLs",
+			[]string{
+				"app:8080/admin/prometheus",
+				"envoy=http://127.0.0.1:9901/stats/prometheus",
+				"secure=https://localhost:8443",
+				"queried=http://localhost:8081/metrics?format=prometheus",
+			},
 			"",
-			map[string]int{
-				"port1":    123,
-				"port2":    456,
-				"portYeah": 114534,
+			map[string]Target{
+				"app":     {Scheme: "http", Host: "localhost", Port: 8080, Path: "/admin/prometheus"},
+				"envoy":   {Scheme: "http", Host: "127.0.0.1", Port: 9901, Path: "/stats/prometheus"},
+				"secure":  {Scheme: "https", Host: "localhost", Port: 8443, Path: "/metrics"},
+				"queried": {Scheme: "http", Host: "localhost", Port: 8081, Path: "/metrics?format=prometheus"},
 			},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			m, err := GenerateContainerToPortMap(tc.flags)
+			m, err := GenerateTargets(tc.flags, "/metrics")
 			assert.Equal(t, tc.resultMapping, m)
 			if len(tc.errString) != 0 {
 				assert.ErrorContains(t, err, tc.errString)
@@ -73,6 +114,91 @@ func TestGenerateContainerToPortMap(t *testing.T) {
 	}
 }
 
+func TestTargetURL(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		target      Target
+		expectedURL string
+	}{
+		{"formats a host name", Target{Scheme: "http", Host: "localhost", Port: 8080, Path: "/metrics"}, "http://localhost:8080/metrics"},
+		{"formats an IPv6 host", Target{Scheme: "https", Host: "::1", Port: 8443, Path: "/stats/prometheus"}, "https://[::1]:8443/stats/prometheus"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedURL, tc.target.URL())
+		})
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		config    TLSConfig
+		errString string
+	}{
+		{"accepts an empty config", TLSConfig{}, ""},
+		{"accepts a client certificate and key", TLSConfig{CAFile: "ca.pem", CertFile: "cert.pem", KeyFile: "key.pem"}, ""},
+		{"rejects a client certificate without a key", TLSConfig{CertFile: "cert.pem"}, "requires both cert_file and key_file"},
+		{"rejects a key without a client certificate", TLSConfig{KeyFile: "key.pem"}, "requires both cert_file and key_file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthConfigValidate(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		config    AuthConfig
+		errString string
+	}{
+		{"accepts an empty config", AuthConfig{}, ""},
+		{"accepts a bearer token file and headers", AuthConfig{BearerTokenFile: "token", Headers: map[string]string{"X-Tenant": "payments"}}, ""},
+		{"accepts basic auth with a password file", AuthConfig{BasicAuth: BasicAuth{Username: "prometheus", PasswordFile: "password"}}, ""},
+		{"rejects a bearer token and a bearer token file", AuthConfig{BearerToken: "token", BearerTokenFile: "token"}, "at most one of"},
+		{"rejects a bearer token and basic auth", AuthConfig{BearerToken: "token", BasicAuth: BasicAuth{Username: "prometheus"}}, "at most one of"},
+		{"rejects basic auth without a username", AuthConfig{BasicAuth: BasicAuth{Password: "secret"}}, "requires a username"},
+		{"rejects a password and a password file", AuthConfig{BasicAuth: BasicAuth{Username: "prometheus", Password: "secret", PasswordFile: "password"}}, "at most one of password and password_file"},
+		{"rejects an empty header name", AuthConfig{Headers: map[string]string{"": "value"}}, "must not be empty"},
+		{"rejects a reserved header", AuthConfig{Headers: map[string]string{"authorization": "Bearer token"}}, "header authorization is reserved"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Validate()
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTargetEqual(t *testing.T) {
+	target := Target{Scheme: "http", Host: "localhost", Port: 8080, Path: "/metrics", Auth: AuthConfig{Headers: map[string]string{"X-Tenant": "payments"}}}
+	var testCases = []struct {
+		name     string
+		other    Target
+		expected bool
+	}{
+		{"equals a target with the same settings", Target{Scheme: "http", Host: "localhost", Port: 8080, Path: "/metrics", Auth: AuthConfig{Headers: map[string]string{"X-Tenant": "payments"}}}, true},
+		{"differs from a target on another port", Target{Scheme: "http", Host: "localhost", Port: 8081, Path: "/metrics", Auth: AuthConfig{Headers: map[string]string{"X-Tenant": "payments"}}}, false},
+		{"differs from a target with other headers", Target{Scheme: "http", Host: "localhost", Port: 8080, Path: "/metrics", Auth: AuthConfig{Headers: map[string]string{"X-Tenant": "platform"}}}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, target.Equal(tc.other))
+		})
+	}
+}
+
 func TestGzipToCompressData(t *testing.T) {
 	var testCases = []struct {
 		name           string
@@ -137,3 +263,98 @@ func TestValidateLabelName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseLabels(t *testing.T) {
+	var testCases = []struct {
+		name           string
+		entries        []string
+		expectedLabels map[string]string
+		errString      string
+	}{
+		{
+			"parses labels",
+			[]string{"team=payments", "pod=env:POD_NAME", "equation=a=b"},
+			map[string]string{"team": "payments", "pod": "env:POD_NAME", "equation": "a=b"},
+			"",
+		},
+		{
+			"returns an error when an entry has no value",
+			[]string{"team"},
+			nil,
+			"missing =",
+		},
+		{
+			"returns an error when a label is given twice",
+			[]string{"team=payments", "team=search"},
+			nil,
+			"duplicate label name",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, err := ParseLabels(tc.entries)
+			assert.Equal(t, tc.expectedLabels, labels)
+			if len(tc.errString) != 0 {
+				assert.ErrorContains(t, err, tc.errString)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewLogLimiter(time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	var testCases = []struct {
+		name    string
+		elapsed time.Duration
+		key     string
+		allowed bool
+	}{
+		{"allows the first line of a key", 0, "container1/requests", true},
+		{"rejects the same key within the interval", 30 * time.Second, "container1/requests", false},
+		{"allows another key within the interval", 0, "container2/requests", true},
+		{"allows the same key after the interval", 31 * time.Second, "container1/requests", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.elapsed)
+			assert.Equal(t, tc.allowed, limiter.Allow(tc.key))
+		})
+	}
+}
+
+func TestContainerFilter(t *testing.T) {
+	filter, err := NewContainerFilter([]string{"", "istio-*", "regex:log(ger|shipper)"})
+	require.NoError(t, err)
+
+	var testCases = []struct {
+		name          string
+		containerName string
+		matches       bool
+	}{
+		{"matches a glob", "istio-proxy", true},
+		{"does not match a glob partially", "my-istio-proxy", false},
+		{"matches a regular expression", "logshipper", true},
+		{"matches a regular expression against the whole name", "logshipper-sidecar", false},
+		{"does not match another container", "app", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.matches, filter.Matches(tc.containerName))
+		})
+	}
+
+	assert.False(t, filter.Empty())
+	emptyFilter, err := NewContainerFilter([]string{""})
+	require.NoError(t, err)
+	assert.True(t, emptyFilter.Empty())
+
+	_, err = NewContainerFilter([]string{"istio-["})
+	assert.Error(t, err)
+	_, err = NewContainerFilter([]string{"regex:istio-("})
+	assert.Error(t, err)
+}
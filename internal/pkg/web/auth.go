@@ -0,0 +1,169 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/filecache"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+)
+
+// dummyHash is compared with the passwords of unknown users, so that they take as long to reject as those of known
+// users and the names of the users can't be guessed from the time it takes.
+var dummyHash = []byte("$2a$10$Rosb06CyB4d6dHcTYdv82egiQEAC4VNw6PlIHjy1yChngSyM6vIMy")
+
+// Authenticator holds the requests to the sidecar to the credentials of the web configuration file.
+type Authenticator struct {
+	file  *configFile
+	files *filecache.Reader
+	// mu guards validated, the latest configuration whose credentials were checked, and authenticated, the hashes of
+	// the credentials that were checked successfully, so that bcrypt is only run once for each of them.
+	mu            sync.Mutex
+	validated     *Config
+	authenticated map[[sha256.Size]byte]bool
+}
+
+// NewAuthenticator checks the credentials of the web configuration file and returns the authenticator holding
+// requests to them. The file and the token file are checked on every request and read again once they changed, so
+// that changes of the users or the token take effect without restarting the sidecar.
+func NewAuthenticator(path string) (*Authenticator, error) {
+	files := &filecache.Reader{}
+	a := &Authenticator{
+		file:          &configFile{path: path, files: files},
+		files:         files,
+		authenticated: make(map[[sha256.Size]byte]bool),
+	}
+	if _, err := a.config(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// config returns the configuration of the current content of the file, checking its credentials once it changed.
+func (a *Authenticator) config() (*Config, error) {
+	config, err := a.file.load()
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if config == a.validated {
+		return config, nil
+	}
+	if err := config.validateAuth(a.files); err != nil {
+		return nil, err
+	}
+	a.validated = config
+	return config, nil
+}
+
+// validateAuth checks that at most one kind of credentials is given, and that they are usable.
+func (c *Config) validateAuth(files *filecache.Reader) error {
+	if len(c.BasicAuthUsers) != 0 && c.BearerTokenFile != "" {
+		return fmt.Errorf("at most one of basic_auth_users and bearer_token_file can be given")
+	}
+	for user, hash := range c.BasicAuthUsers {
+		if user == "" {
+			return fmt.Errorf("basic auth user names must not be empty")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid bcrypt hash of basic auth user %s: %w", user, err)
+		}
+	}
+	if c.BearerTokenFile != "" {
+		if _, err := readToken(files, c.BearerTokenFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readToken reads the bearer token of the file, ignoring surrounding whitespace.
+func readToken(files *filecache.Reader, path string) (string, error) {
+	data, err := files.Read(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the bearer token file: %w", err)
+	}
+	token := strings.TrimSpace(data)
+	if token == "" {
+		return "", fmt.Errorf("the bearer token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// Wrap returns a handler that answers requests without valid credentials with 401 Unauthorized, and passes the
+// others on to the given handler.
+func (a *Authenticator) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, err := a.config()
+		if err != nil {
+			log.Errorf("Failed to authenticate a request to %s: %v", r.URL.Path, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		var reason, challenge string
+		switch {
+		case len(config.BasicAuthUsers) != 0:
+			reason, challenge = a.checkBasicAuth(r, config.BasicAuthUsers), `Basic realm="metrics", charset="UTF-8"`
+		case config.BearerTokenFile != "":
+			reason, challenge = a.checkBearerToken(r, config.BearerTokenFile), `Bearer realm="metrics"`
+		}
+		if reason != "" {
+			telemetry.AuthFailures.WithLabelValues(reason).Inc()
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// checkBasicAuth returns the reason the basic auth credentials of the request are rejected for, if they are.
+func (a *Authenticator) checkBasicAuth(r *http.Request, users map[string]string) string {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return telemetry.AuthReasonMissingCredentials
+	}
+	hash, known := users[user]
+	if !known {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return telemetry.AuthReasonInvalidCredentials
+	}
+
+	// The user and hash are part of the key, so that changing the password of a user invalidates its entry.
+	key := sha256.Sum256([]byte(strings.Join([]string{user, hash, password}, "\x00")))
+	a.mu.Lock()
+	authenticated := a.authenticated[key]
+	a.mu.Unlock()
+	if authenticated {
+		return ""
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return telemetry.AuthReasonInvalidCredentials
+	}
+	a.mu.Lock()
+	a.authenticated[key] = true
+	a.mu.Unlock()
+	return ""
+}
+
+// checkBearerToken returns the reason the bearer token of the request is rejected for, if it is.
+func (a *Authenticator) checkBearerToken(r *http.Request, tokenFile string) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return telemetry.AuthReasonMissingCredentials
+	}
+	expected, err := readToken(a.files, tokenFile)
+	if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		return telemetry.AuthReasonInvalidCredentials
+	}
+	return ""
+}
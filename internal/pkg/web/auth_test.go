@@ -0,0 +1,172 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/certtest"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "token", []byte("secret-token\n"))
+	certtest.WriteFile(t, dir, "empty-token", []byte("\n"))
+
+	testCases := []struct {
+		name        string
+		yaml        string
+		expectedErr string
+	}{
+		{"accepts a file without credentials", "", ""},
+		{"accepts basic auth users", "basic_auth_users: {prometheus: $2a$10$Rosb06CyB4d6dHcTYdv82egiQEAC4VNw6PlIHjy1yChngSyM6vIMy}", ""},
+		{"accepts a bearer token file", "bearer_token_file: token", ""},
+		{"rejects both basic auth users and a bearer token file", "{basic_auth_users: {prometheus: $2a$10$Rosb06CyB4d6dHcTYdv82egiQEAC4VNw6PlIHjy1yChngSyM6vIMy}, bearer_token_file: token}", "at most one of"},
+		{"rejects a password that isn't hashed", "basic_auth_users: {prometheus: secret}", "invalid bcrypt hash of basic auth user prometheus"},
+		{"rejects a missing bearer token file", "bearer_token_file: missing", "failed to read the bearer token file"},
+		{"rejects an empty bearer token file", "bearer_token_file: empty-token", "is empty"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewAuthenticator(certtest.WriteFile(t, dir, "web.yaml", []byte(tc.yaml)))
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorWrap(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "token", []byte("secret-token\n"))
+
+	basicAuth := func(user string, password string) http.Header {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.SetBasicAuth(user, password)
+		return r.Header
+	}
+	testCases := []struct {
+		name              string
+		yaml              string
+		header            http.Header
+		expectedCode      int
+		expectedChallenge string
+		expectedReason    string
+	}{
+		{"lets requests in without credentials configured", "", nil, http.StatusOK, "", ""},
+		{"lets requests in with only TLS settings", "tls_server_config: {cert_file: cert.pem, key_file: key.pem}", nil, http.StatusOK, "", ""},
+		{"lets a basic auth user in", "basic_auth_users: {prometheus: " + string(hash) + "}", basicAuth("prometheus", "secret"), http.StatusOK, "", ""},
+		{
+			"rejects a wrong password",
+			"basic_auth_users: {prometheus: " + string(hash) + "}",
+			basicAuth("prometheus", "guess"),
+			http.StatusUnauthorized, `Basic realm="metrics", charset="UTF-8"`, telemetry.AuthReasonInvalidCredentials,
+		},
+		{
+			"rejects an unknown user",
+			"basic_auth_users: {prometheus: " + string(hash) + "}",
+			basicAuth("grafana", "secret"),
+			http.StatusUnauthorized, `Basic realm="metrics", charset="UTF-8"`, telemetry.AuthReasonInvalidCredentials,
+		},
+		{
+			"rejects a request without basic auth",
+			"basic_auth_users: {prometheus: " + string(hash) + "}",
+			nil,
+			http.StatusUnauthorized, `Basic realm="metrics", charset="UTF-8"`, telemetry.AuthReasonMissingCredentials,
+		},
+		{"lets the bearer token in", "bearer_token_file: token", http.Header{"Authorization": {"Bearer secret-token"}}, http.StatusOK, "", ""},
+		{
+			"rejects a wrong bearer token",
+			"bearer_token_file: token",
+			http.Header{"Authorization": {"Bearer guess"}},
+			http.StatusUnauthorized, `Bearer realm="metrics"`, telemetry.AuthReasonInvalidCredentials,
+		},
+		{
+			"rejects a request without a bearer token",
+			"bearer_token_file: token",
+			basicAuth("prometheus", "secret"),
+			http.StatusUnauthorized, `Bearer realm="metrics"`, telemetry.AuthReasonMissingCredentials,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			authenticator, err := NewAuthenticator(certtest.WriteFile(t, dir, "web.yaml", []byte(tc.yaml)))
+			require.NoError(t, err)
+			handler := authenticator.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			for name, values := range tc.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			failuresBefore := testutil.ToFloat64(telemetry.AuthFailures.WithLabelValues(tc.expectedReason))
+
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, tc.expectedCode, w.Code)
+			assert.Equal(t, tc.expectedChallenge, w.Header().Get("WWW-Authenticate"))
+			if tc.expectedReason != "" {
+				assert.Equal(t, failuresBefore+1, testutil.ToFloat64(telemetry.AuthFailures.WithLabelValues(tc.expectedReason)))
+			}
+		})
+	}
+}
+
+func TestAuthenticatorWrapReloads(t *testing.T) {
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "token", []byte("old-token"))
+	webConfig := certtest.WriteFile(t, dir, "web.yaml", []byte("bearer_token_file: token"))
+	authenticator, err := NewAuthenticator(webConfig)
+	require.NoError(t, err)
+	handler := authenticator.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(token string) int {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve("old-token"))
+
+	certtest.WriteFile(t, dir, "token", []byte("new-token"))
+	assert.Equal(t, http.StatusUnauthorized, serve("old-token"))
+	assert.Equal(t, http.StatusOK, serve("new-token"))
+
+	certtest.WriteFile(t, dir, "web.yaml", []byte("basic_auth_users: {prometheus: secret}"))
+	assert.Equal(t, http.StatusInternalServerError, serve("new-token"), "an invalid file should fail the requests")
+}
+
+func TestAuthenticatorValidatesChangedConfig(t *testing.T) {
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "token", []byte("secret-token"))
+	webConfig := certtest.WriteFile(t, dir, "web.yaml", []byte("bearer_token_file: token"))
+	authenticator, err := NewAuthenticator(webConfig)
+	require.NoError(t, err)
+
+	first, err := authenticator.config()
+	require.NoError(t, err)
+	second, err := authenticator.config()
+	require.NoError(t, err)
+	assert.Same(t, first, second, "the configuration should be reused while the file is unchanged")
+
+	certtest.WriteFile(t, dir, "web.yaml", []byte("bearer_token_file: missing"))
+	_, err = authenticator.config()
+	assert.ErrorContains(t, err, "failed to read the bearer token file")
+
+	certtest.WriteFile(t, dir, "web.yaml", []byte("bearer_token_file: ./token"))
+	third, err := authenticator.config()
+	require.NoError(t, err)
+	assert.NotSame(t, first, third)
+}
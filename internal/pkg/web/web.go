@@ -0,0 +1,273 @@
+// Package web reads the web configuration file of the sidecar, in the format of the web configuration files of the
+// Prometheus exporter toolkit, and builds the TLS settings and the authentication the metrics are served with.
+package web
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/filecache"
+)
+
+// Config is the web configuration file.
+type Config struct {
+	TLSServerConfig TLSServerConfig `yaml:"tls_server_config"`
+	// BasicAuthUsers are the users allowed in with basic auth, by name, along with the bcrypt hashes of their
+	// passwords.
+	BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	// BearerTokenFile is the file of the bearer token allowed in, as an alternative to basic auth.
+	BearerTokenFile string `yaml:"bearer_token_file"`
+}
+
+// TLSServerConfig are the TLS settings the metrics are served with. The metrics are served over plain HTTP when they
+// are empty.
+type TLSServerConfig struct {
+	CertFile       string   `yaml:"cert_file"`
+	KeyFile        string   `yaml:"key_file"`
+	ClientAuthType string   `yaml:"client_auth_type"`
+	ClientCAFile   string   `yaml:"client_ca_file"`
+	MinVersion     string   `yaml:"min_version"`
+	MaxVersion     string   `yaml:"max_version"`
+	CipherSuites   []string `yaml:"cipher_suites"`
+}
+
+// clientAuthTypes are the values of client_auth_type.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsVersions are the values of min_version and max_version.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// parseConfig parses the content of the web configuration file of the given path. Relative paths in the file are
+// relative to the directory of the file.
+func parseConfig(data []byte, path string) (*Config, error) {
+	var config Config
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse the web configuration file: %w", err)
+	}
+	config.resolvePaths(filepath.Dir(path))
+	return &config, nil
+}
+
+// configFile is the web configuration file, parsed again only once its content changed. The configurations it returns
+// are shared, so they must not be modified.
+type configFile struct {
+	path  string
+	files *filecache.Reader
+
+	mu     sync.Mutex
+	data   string
+	config *Config
+}
+
+// load returns the configuration of the current content of the file.
+func (f *configFile) load() (*Config, error) {
+	data, err := f.files.Read(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the web configuration file: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.config != nil && data == f.data {
+		return f.config, nil
+	}
+	config, err := parseConfig([]byte(data), f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.data, f.config = data, config
+	return config, nil
+}
+
+// resolvePaths makes the relative paths of the files relative to the given directory.
+func (c *Config) resolvePaths(dir string) {
+	for _, path := range []*string{&c.TLSServerConfig.CertFile, &c.TLSServerConfig.KeyFile, &c.TLSServerConfig.ClientCAFile, &c.BearerTokenFile} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+}
+
+// NewTLSConfig returns the TLS settings of the web configuration file, or nil if the metrics are served over plain
+// HTTP. The file and the files it names are checked on every TLS handshake, and the settings built again once any of
+// them changed, so that rotated certificates and changes of the file take effect without restarting the sidecar.
+func NewTLSConfig(path string) (*tls.Config, error) {
+	files := &filecache.Reader{}
+	loader := &tlsConfigLoader{file: &configFile{path: path, files: files}, files: files}
+	config, err := loader.file.load()
+	if err != nil {
+		return nil, err
+	}
+	if config.TLSServerConfig.empty() {
+		return nil, nil
+	}
+	tlsConfig, err := loader.load()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return loader.load()
+	}
+	return tlsConfig, nil
+}
+
+// tlsConfigLoader builds the TLS settings of the web configuration file, building them again only once the file or
+// the certificate, key or client CA file it names changed.
+type tlsConfigLoader struct {
+	file  *configFile
+	files *filecache.Reader
+
+	mu        sync.Mutex
+	inputs    tlsInputs
+	tlsConfig *tls.Config
+}
+
+// tlsInputs are what the TLS settings are built from: the configuration and the content of the files it names.
+type tlsInputs struct {
+	config   *Config
+	cert     string
+	key      string
+	clientCA string
+}
+
+// load returns the TLS settings of the current content of the files.
+func (l *tlsConfigLoader) load() (*tls.Config, error) {
+	config, err := l.file.load()
+	if err != nil {
+		return nil, err
+	}
+	inputs := tlsInputs{config: config}
+	// A file that can't be read is left empty, and the settings are built again to report it.
+	c := &config.TLSServerConfig
+	for _, file := range []struct {
+		path    string
+		content *string
+	}{{c.CertFile, &inputs.cert}, {c.KeyFile, &inputs.key}, {c.ClientCAFile, &inputs.clientCA}} {
+		if file.path != "" {
+			*file.content, _ = l.files.Read(file.path)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tlsConfig != nil && inputs == l.inputs {
+		return l.tlsConfig, nil
+	}
+	tlsConfig, err := c.TLSConfig(l.files)
+	if err != nil {
+		return nil, err
+	}
+	l.inputs, l.tlsConfig = inputs, tlsConfig
+	return tlsConfig, nil
+}
+
+// empty reports whether no TLS settings are given.
+func (c *TLSServerConfig) empty() bool {
+	return c.CertFile == "" && c.KeyFile == "" && c.ClientAuthType == "" && c.ClientCAFile == "" &&
+		c.MinVersion == "" && c.MaxVersion == "" && len(c.CipherSuites) == 0
+}
+
+// TLSConfig validates the TLS settings and builds the TLS configuration of the server, reading the files it names
+// with the given reader.
+func (c *TLSServerConfig) TLSConfig(files *filecache.Reader) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("serving TLS requires both cert_file and key_file")
+	}
+	cert, err := loadKeyPair(files, c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	clientAuth, ok := clientAuthTypes[c.ClientAuthType]
+	if !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %q", c.ClientAuthType)
+	}
+	tlsConfig.ClientAuth = clientAuth
+	if c.ClientCAFile != "" {
+		if clientAuth == tls.NoClientCert {
+			return nil, fmt.Errorf("client_ca_file requires a client_auth_type verifying client certificates")
+		}
+		ca, err := files.Read(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CA file: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no certificates found in the client CA file %s", c.ClientCAFile)
+		}
+	} else if clientAuth == tls.VerifyClientCertIfGiven || clientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_auth_type %s requires a client_ca_file", c.ClientAuthType)
+	}
+
+	if c.MinVersion != "" {
+		if tlsConfig.MinVersion, ok = tlsVersions[c.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown min_version %q", c.MinVersion)
+		}
+	}
+	if c.MaxVersion != "" {
+		if tlsConfig.MaxVersion, ok = tlsVersions[c.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown max_version %q", c.MaxVersion)
+		}
+		if tlsConfig.MaxVersion < tlsConfig.MinVersion {
+			return nil, fmt.Errorf("max_version %s is lower than min_version", c.MaxVersion)
+		}
+	}
+	for _, name := range c.CipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return tlsConfig, nil
+}
+
+// loadKeyPair reads and parses the certificate and key of the given files.
+func loadKeyPair(files *filecache.Reader, certFile string, keyFile string) (tls.Certificate, error) {
+	cert, err := files.Read(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, err := files.Read(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair([]byte(cert), []byte(key))
+}
+
+// cipherSuite returns the ID of the cipher suite of the given name, as named by crypto/tls. As in crypto/tls, the
+// cipher suites of TLS 1.3 are not configurable, so naming them has no effect.
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
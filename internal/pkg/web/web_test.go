@@ -0,0 +1,211 @@
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/certtest"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	ca := certtest.New(t, nil)
+	serverCert := certtest.New(t, ca)
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "ca.pem", ca.CertPEM)
+	certtest.WriteFile(t, dir, "cert.pem", serverCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", serverCert.KeyPEM)
+	certtest.WriteFile(t, dir, "invalid.pem", []byte("not a certificate"))
+
+	testCases := []struct {
+		name               string
+		yaml               string
+		expectedTLS        bool
+		expectedClientCA   bool
+		expectedMin        uint16
+		expectedMax        uint16
+		expectedCiphers    []uint16
+		expectedClientAuth tls.ClientAuthType
+		expectedErr        string
+	}{
+		{"serves plain HTTP without TLS settings", "", false, false, 0, 0, nil, tls.NoClientCert, ""},
+		{
+			"serves TLS 1.2 and later by default",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem}",
+			true, false, tls.VersionTLS12, 0, nil, tls.NoClientCert, "",
+		},
+		{
+			"verifies client certificates",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_auth_type: RequireAndVerifyClientCert, client_ca_file: ca.pem}",
+			true, true, tls.VersionTLS12, 0, nil, tls.RequireAndVerifyClientCert, "",
+		},
+		{
+			"restricts the versions and cipher suites",
+			`
+tls_server_config:
+  cert_file: cert.pem
+  key_file: key.pem
+  min_version: TLS12
+  max_version: TLS12
+  cipher_suites: [TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]
+`,
+			true, false, tls.VersionTLS12, tls.VersionTLS12,
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			tls.NoClientCert, "",
+		},
+		{"rejects unknown settings", "tls_server_config: {cert: cert.pem}", false, false, 0, 0, nil, tls.NoClientCert, "field cert not found"},
+		{"rejects a key without a certificate", "tls_server_config: {key_file: key.pem}", false, false, 0, 0, nil, tls.NoClientCert, "requires both cert_file and key_file"},
+		{"rejects a missing certificate", "tls_server_config: {cert_file: missing.pem, key_file: key.pem}", false, false, 0, 0, nil, tls.NoClientCert, "failed to load the certificate"},
+		{
+			"rejects an unknown client auth type",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_auth_type: Always}",
+			false, false, 0, 0, nil, tls.NoClientCert, "unknown client_auth_type",
+		},
+		{
+			"rejects a client CA without client auth",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_ca_file: ca.pem}",
+			false, false, 0, 0, nil, tls.NoClientCert, "client_ca_file requires a client_auth_type",
+		},
+		{
+			"rejects verifying client certificates without a client CA",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_auth_type: RequireAndVerifyClientCert}",
+			false, false, 0, 0, nil, tls.NoClientCert, "requires a client_ca_file",
+		},
+		{
+			"rejects a client CA file without certificates",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_auth_type: VerifyClientCertIfGiven, client_ca_file: invalid.pem}",
+			false, false, 0, 0, nil, tls.NoClientCert, "no certificates found",
+		},
+		{
+			"rejects an unknown version",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, min_version: SSL30}",
+			false, false, 0, 0, nil, tls.NoClientCert, "unknown min_version",
+		},
+		{
+			"rejects a maximum version lower than the minimum",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, min_version: TLS13, max_version: TLS12}",
+			false, false, 0, 0, nil, tls.NoClientCert, "lower than min_version",
+		},
+		{
+			"rejects an unknown cipher suite",
+			"tls_server_config: {cert_file: cert.pem, key_file: key.pem, cipher_suites: [TLS_RSA_WITH_NULL]}",
+			false, false, 0, 0, nil, tls.NoClientCert, "unknown cipher suite",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tlsConfig, err := NewTLSConfig(certtest.WriteFile(t, dir, "web.yaml", []byte(tc.yaml)))
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			if !tc.expectedTLS {
+				assert.Nil(t, tlsConfig)
+				return
+			}
+			require.NotNil(t, tlsConfig)
+			assert.Equal(t, tc.expectedClientCA, tlsConfig.ClientCAs != nil)
+			assert.Equal(t, tc.expectedMin, tlsConfig.MinVersion)
+			assert.Equal(t, tc.expectedMax, tlsConfig.MaxVersion)
+			assert.Equal(t, tc.expectedCiphers, tlsConfig.CipherSuites)
+			assert.Equal(t, tc.expectedClientAuth, tlsConfig.ClientAuth)
+		})
+	}
+}
+
+func TestNewTLSConfigReloadsCertificates(t *testing.T) {
+	ca := certtest.New(t, nil)
+	oldCert := certtest.New(t, ca)
+	newCert := certtest.New(t, ca)
+	clientCert := certtest.New(t, ca)
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "ca.pem", ca.CertPEM)
+	certtest.WriteFile(t, dir, "cert.pem", oldCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", oldCert.KeyPEM)
+	webConfig := certtest.WriteFile(t, dir, "web.yaml", []byte(
+		"tls_server_config: {cert_file: cert.pem, key_file: key.pem, client_auth_type: RequireAndVerifyClientCert, client_ca_file: ca.pem}"))
+
+	tlsConfig, err := NewTLSConfig(webConfig)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		TLSConfig: tlsConfig,
+	}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	keyPair, err := tls.X509KeyPair(clientCert.CertPEM, clientCert.KeyPEM)
+	require.NoError(t, err)
+	// handshake returns the serial number of the certificate the server presents.
+	handshake := func(certificates []tls.Certificate) (*big.Int, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: certificates})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		// The server only rejects a missing client certificate once the client reads from the connection in TLS 1.3.
+		if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return nil, err
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber, nil
+	}
+
+	serial, err := handshake([]tls.Certificate{keyPair})
+	require.NoError(t, err)
+	assert.Equal(t, oldCert.Cert.SerialNumber, serial)
+
+	_, err = handshake(nil)
+	assert.Error(t, err, "the server should require a client certificate")
+
+	certtest.WriteFile(t, dir, "cert.pem", newCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", newCert.KeyPEM)
+	serial, err = handshake([]tls.Certificate{keyPair})
+	require.NoError(t, err)
+	assert.Equal(t, newCert.Cert.SerialNumber, serial)
+}
+
+func TestNewTLSConfigCachesSettings(t *testing.T) {
+	ca := certtest.New(t, nil)
+	oldCert := certtest.New(t, ca)
+	newCert := certtest.New(t, ca)
+	dir := t.TempDir()
+	certtest.WriteFile(t, dir, "cert.pem", oldCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", oldCert.KeyPEM)
+	webConfig := certtest.WriteFile(t, dir, "web.yaml", []byte("tls_server_config: {cert_file: cert.pem, key_file: key.pem}"))
+
+	tlsConfig, err := NewTLSConfig(webConfig)
+	require.NoError(t, err)
+	first, err := tlsConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	second, err := tlsConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Same(t, first, second, "the settings should be reused while the files are unchanged")
+
+	certtest.WriteFile(t, dir, "cert.pem", newCert.CertPEM)
+	certtest.WriteFile(t, dir, "key.pem", newCert.KeyPEM)
+	third, err := tlsConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.NotSame(t, first, third, "the settings should be built again once the certificate changed")
+	require.Len(t, third.Certificates, 1)
+	assert.Equal(t, newCert.Cert.Raw, third.Certificates[0].Certificate[0])
+
+	certtest.WriteFile(t, dir, "web.yaml", []byte("tls_server_config: {cert_file: cert.pem, key_file: key.pem, min_version: TLS13}"))
+	fourth, err := tlsConfig.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), fourth.MinVersion)
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The actions of the admin endpoint, appended to its path.
+const (
+	adminActionPause  = "pause"
+	adminActionResume = "resume"
+)
+
+// HandleAdmin is the handler of the admin endpoint. POST <admin endpoint>/pause?container=<name> stops scraping the
+// container until POST <admin endpoint>/resume?container=<name> starts scraping it again. A paused container is left
+// out of the multiplexed metrics, but stays paused across reloads of the configuration.
+func (server *Server) HandleAdmin(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		http.Error(writer, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	containerName := r.FormValue("container")
+	if containerName == "" {
+		http.Error(writer, "missing container parameter", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	switch action := strings.TrimPrefix(r.URL.Path, server.adminPath+"/"); action {
+	case adminActionPause:
+		err = server.Pause(containerName)
+	case adminActionResume:
+		err = server.Resume(containerName)
+	default:
+		http.Error(writer, fmt.Sprintf("unknown admin action %q", action), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// Pause stops scraping the container, dropping its cached metrics and the state of its latest scrape.
+func (server *Server) Pause(containerName string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if err := server.setPaused(containerName, true); err != nil {
+		return err
+	}
+	server.scheduler.Unschedule(containerName)
+	server.forgetContainer(containerName)
+	log.Infof("Paused scraping container %s", containerName)
+	return nil
+}
+
+// Resume starts scraping a paused container again.
+func (server *Server) Resume(containerName string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if err := server.setPaused(containerName, false); err != nil {
+		return err
+	}
+	if server.started && server.scrapeMode != ScrapeModeOnDemand {
+		server.schedule(containerName)
+	}
+	log.Infof("Resumed scraping container %s", containerName)
+	return nil
+}
+
+// setPaused marks the container as paused or not. The caller must hold mu.
+func (server *Server) setPaused(containerName string, paused bool) error {
+	if _, ok := server.settings.targets[containerName]; !ok {
+		return fmt.Errorf("unknown container %s", containerName)
+	}
+	pausedContainers := make(map[string]bool, len(server.settings.paused)+1)
+	for name := range server.settings.paused {
+		pausedContainers[name] = true
+	}
+	if paused {
+		pausedContainers[containerName] = true
+	} else {
+		delete(pausedContainers, containerName)
+	}
+	server.settings.paused = pausedContainers
+	return nil
+}
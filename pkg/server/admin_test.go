@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
+)
+
+const adminEndpoint = "/multiplexer/admin"
+
+func TestHandleAdmin(t *testing.T) {
+	testCases := []struct {
+		name           string
+		method         string
+		target         string
+		expectedStatus int
+	}{
+		{"test pause", http.MethodPost, adminEndpoint + "/pause?container=container1", http.StatusNoContent},
+		{"test resume", http.MethodPost, adminEndpoint + "/resume?container=container1", http.StatusNoContent},
+		{"test method other than POST", http.MethodGet, adminEndpoint + "/pause?container=container1", http.StatusMethodNotAllowed},
+		{"test missing container", http.MethodPost, adminEndpoint + "/pause", http.StatusBadRequest},
+		{"test unknown container", http.MethodPost, adminEndpoint + "/pause?container=container9", http.StatusNotFound},
+		{"test unknown action", http.MethodPost, adminEndpoint + "/restart?container=container1", http.StatusNotFound},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mockCache := mock_server.NewMockMetricCache(ctr)
+			mockCache.EXPECT().GetAndInvalidate("container1").AnyTimes()
+			adminOpts := opts
+			adminOpts.AdminEndpoint = adminEndpoint
+			server := NewServer(adminOpts, mockCache, nil, targets)
+
+			recorder := httptest.NewRecorder()
+			server.HandleAdmin(recorder, httptest.NewRequest(tc.method, tc.target, nil))
+			assert.Equal(t, tc.expectedStatus, recorder.Code)
+		})
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	var wg sync.WaitGroup
+	mc := mock_server.NewMockMetricClient(ctr)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	expectScrape := func(containerName string) {
+		wg.Add(1)
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), targets[containerName]).Return(bytes.NewBufferString("new_metric 1\n"), expfmt.FmtText, nil)
+		mockCache.EXPECT().Set(containerName, gomock.Any()).Do(func(string, map[string]*promclient.MetricFamily) { wg.Done() })
+	}
+	for containerName := range targets {
+		expectScrape(containerName)
+	}
+	server := NewServer(opts, mockCache, mc, targets)
+	server.Start(context.Background())
+	wg.Wait()
+
+	mockCache.EXPECT().GetAndInvalidate("container2")
+	telemetry.RelabelDroppedSeries.WithLabelValues("container2").Inc()
+	assert.NoError(t, server.Pause("container2"))
+	assert.Equal(t, []string{"container1", "container3"}, server.currentSettings().containerNames())
+	_, ok := server.states.get("container2")
+	assert.False(t, ok, "the state of a paused container must be dropped")
+	assert.False(t, telemetry.RelabelDroppedSeries.DeleteLabelValues("container2"), "the telemetry of a paused container must be deleted")
+
+	// A reload keeps the container paused.
+	server.Reload(opts, targets)
+	assert.Equal(t, []string{"container1", "container3"}, server.currentSettings().containerNames())
+
+	expectScrape("container2")
+	assert.NoError(t, server.Resume("container2"))
+	wg.Wait()
+	server.Close()
+	assert.Equal(t, []string{"container1", "container2", "container3"}, server.currentSettings().containerNames())
+}
+
+func TestPauseDropsScrapeInFlight(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	scraping, release := make(chan struct{}), make(chan struct{})
+	mc := mock_server.NewMockMetricClient(ctr)
+	mc.EXPECT().ScrapeRawMetrics(gomock.Any(), targets["container2"]).DoAndReturn(
+		func(context.Context, utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+			close(scraping)
+			<-release
+			return bytes.NewBufferString("new_metric 1\n"), expfmt.FmtText, nil
+		})
+	// The cache is only invalidated by the pause, the scrape finishing after it never sets it.
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	mockCache.EXPECT().GetAndInvalidate("container2")
+	server := NewServer(opts, mockCache, mc, targets)
+
+	done := make(chan struct{})
+	go func() {
+		server.PopulateCacheForContainer(context.Background(), "container", "container2", targets["container2"])
+		close(done)
+	}()
+	<-scraping
+	assert.NoError(t, server.Pause("container2"))
+	close(release)
+	<-done
+
+	_, ok := server.states.get("container2")
+	assert.False(t, ok, "the scrape in flight must not bring back the state of a paused container")
+}
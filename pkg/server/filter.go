@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+)
+
+// The query parameters of the metric path selecting the containers whose metrics are served.
+const (
+	includeContainerParam = "container"
+	excludeContainerParam = "exclude_container"
+)
+
+// HandleContainerMetrics serves the cached metrics of the container named by the request path,
+// <metric path>/<container>, along with its synthetic series, in the same formats as HandleMetrics. The cache is
+// read without invalidating it, so debugging a container never takes its metrics away from Prometheus, and the
+// container is never scraped for the request, whatever the scrape mode.
+func (server *Server) HandleContainerMetrics(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writer.Header().Set("Allow", http.MethodGet)
+		http.Error(writer, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	settings := server.currentSettings()
+	containerName := strings.TrimPrefix(r.URL.Path, server.containerPath())
+	if _, ok := settings.targets[containerName]; !ok || settings.paused[containerName] {
+		http.Error(writer, fmt.Sprintf("unknown container %q", containerName), http.StatusNotFound)
+		return
+	}
+
+	var containerMetricFamilies []mutate.ContainerMetricFamilies
+	if metricFamilies, ok := server.cache.Get(containerName); ok {
+		containerMetricFamilies = append(containerMetricFamilies, mutate.ContainerMetricFamilies{
+			ContainerName:  containerName,
+			MetricFamilies: metricFamilies,
+		})
+	}
+	server.writeMetrics(writer, r, settings, []string{containerName}, containerMetricFamilies)
+}
+
+// containerPath is the path under which the metrics of single containers are served.
+func (server *Server) containerPath() string {
+	return strings.TrimSuffix(server.path, "/") + "/"
+}
+
+// filtersContainers reports whether the query parameters select some of the containers.
+func filtersContainers(query url.Values) bool {
+	return len(query[includeContainerParam]) != 0 || len(query[excludeContainerParam]) != 0
+}
+
+// selectContainers returns the containers selected by the query parameters, out of the given container names. At
+// most one of the parameters can be given, and only the names of known containers.
+func selectContainers(query url.Values, containerNames []string) ([]string, error) {
+	if !filtersContainers(query) {
+		return containerNames, nil
+	}
+	included, excluded := query[includeContainerParam], query[excludeContainerParam]
+	if len(included) != 0 && len(excluded) != 0 {
+		return nil, fmt.Errorf("at most one of the %s and %s parameters can be given", includeContainerParam, excludeContainerParam)
+	}
+
+	known := make(map[string]bool, len(containerNames))
+	for _, containerName := range containerNames {
+		known[containerName] = true
+	}
+	selected := make(map[string]bool, len(included)+len(excluded))
+	for _, containerName := range append(included, excluded...) {
+		if !known[containerName] {
+			return nil, fmt.Errorf("unknown container %q", containerName)
+		}
+		selected[containerName] = true
+	}
+	names := make([]string, 0, len(containerNames))
+	for _, containerName := range containerNames {
+		// Included containers are those selected, excluded containers those that aren't.
+		if selected[containerName] == (len(included) != 0) {
+			names = append(names, containerName)
+		}
+	}
+	return names, nil
+}
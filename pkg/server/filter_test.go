@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
+	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
+)
+
+func TestSelectContainers(t *testing.T) {
+	containerNames := []string{"container1", "container2", "container3"}
+	testCases := []struct {
+		name          string
+		query         string
+		expectedNames []string
+		expectedErr   string
+	}{
+		{"test select all containers without parameters", "", containerNames, ""},
+		{"test include a container", "container=container2", []string{"container2"}, ""},
+		{"test include several containers", "container=container3&container=container1", []string{"container1", "container3"}, ""},
+		{"test exclude a container", "exclude_container=container2", []string{"container1", "container3"}, ""},
+		{"test ignore other parameters", "debug=true", containerNames, ""},
+		{"test reject an unknown container", "container=container9", nil, `unknown container "container9"`},
+		{"test reject an unknown excluded container", "exclude_container=container9", nil, `unknown container "container9"`},
+		{"test reject both parameters", "container=container1&exclude_container=container2", nil, "at most one of"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tc.query)
+			assert.NoError(t, err)
+			names, err := selectContainers(query, containerNames)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expectedNames, names)
+			}
+		})
+	}
+}
+
+func TestHandleMetricsFiltersContainers(t *testing.T) {
+	testCases := []struct {
+		name           string
+		query          string
+		readContainers []string
+		expectedCode   int
+		expectedBody   string
+	}{
+		{
+			"test serve the included containers",
+			"?container=container1&container=container3",
+			[]string{"container1", "container3"},
+			http.StatusOK,
+			`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container1"} 1
+go_goroutines{container="container3"} 3
+`,
+		},
+		{
+			"test serve all containers but the excluded ones",
+			"?exclude_container=container1",
+			[]string{"container2", "container3"},
+			http.StatusOK,
+			`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container2"} 2
+go_goroutines{container="container3"} 3
+`,
+		},
+		{"test reject an unknown container", "?container=container9", nil, http.StatusBadRequest, "unknown container \"container9\"\n"},
+	}
+	for _, scrapeMode := range []ScrapeMode{ScrapeModePoll, ScrapeModeOnDemand} {
+		for _, tc := range testCases {
+			t.Run(fmt.Sprintf("%s in the %s scrape mode", tc.name, scrapeMode), func(t *testing.T) {
+				ctr := gomock.NewController(t)
+				defer ctr.Finish()
+				// No container is scraped for the request, whatever the scrape mode.
+				mc := mock_server.NewMockMetricClient(ctr)
+				mockCache := mock_server.NewMockMetricCache(ctr)
+				// Only the selected containers are read, and the cache is never invalidated.
+				for _, containerName := range tc.readContainers {
+					value := float64(targets[containerName].Port)
+					mockCache.EXPECT().Get(containerName).Return(goroutinesMetricFamilies(containerName, value), true)
+				}
+				recorder := httptest.NewRecorder()
+
+				serverOpts := opts
+				serverOpts.ScrapeMode = scrapeMode
+				server := NewServer(serverOpts, mockCache, mc, targets)
+				server.HandleMetrics(recorder, httptest.NewRequest(http.MethodGet, path+tc.query, nil))
+
+				assert.Equal(t, tc.expectedCode, recorder.Code)
+				assert.Equal(t, tc.expectedBody, recorder.Body.String())
+			})
+		}
+	}
+}
+
+func TestHandleContainerMetrics(t *testing.T) {
+	testCases := []struct {
+		name         string
+		method       string
+		path         string
+		cached       bool
+		expectedCode int
+		expectedBody string
+	}{
+		{
+			"test serve the cached metrics of a container",
+			http.MethodGet,
+			path + "/container2",
+			true,
+			http.StatusOK,
+			`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container2"} 2
+`,
+		},
+		{"test serve nothing for a container without cached metrics", http.MethodGet, path + "/container2", false, http.StatusOK, ""},
+		{"test reject an unknown container", http.MethodGet, path + "/container9", false, http.StatusNotFound, "unknown container \"container9\"\n"},
+		{"test reject a method other than GET", http.MethodPost, path + "/container2", false, http.StatusMethodNotAllowed, "only GET is allowed\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mockCache := mock_server.NewMockMetricCache(ctr)
+			if tc.expectedCode == http.StatusOK {
+				// The cache is never invalidated, whatever the cache read mode.
+				mockCache.EXPECT().Get("container2").Return(goroutinesMetricFamilies("container2", 2), tc.cached)
+			}
+			recorder := httptest.NewRecorder()
+
+			server := NewServer(opts, mockCache, client.NewClient(), targets)
+			server.HandleMetrics(recorder, httptest.NewRequest(tc.method, tc.path, nil))
+
+			assert.Equal(t, tc.expectedCode, recorder.Code)
+			assert.Equal(t, tc.expectedBody, recorder.Body.String())
+		})
+	}
+}
+
+func TestHandleContainerMetricsRejectsPausedContainers(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	mockCache.EXPECT().GetAndInvalidate("container2")
+	server := NewServer(opts, mockCache, client.NewClient(), targets)
+	assert.NoError(t, server.Pause("container2"))
+
+	recorder := httptest.NewRecorder()
+	server.HandleMetrics(recorder, httptest.NewRequest(http.MethodGet, path+"/container2", nil))
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The paths of the probes of the sidecar.
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// HandleHealth is the handler of the liveness probe. The sidecar is alive while it is serving HTTP requests and,
+// unless it scrapes on demand, the scrape loop of every container is running.
+func (server *Server) HandleHealth(writer http.ResponseWriter, r *http.Request) {
+	writeProbe(writer, server.liveness())
+}
+
+// HandleReady is the handler of the readiness probe. The sidecar is ready once every required container has been
+// scraped successfully at least once, and stays ready unless readiness drops on failure, in which case it is only
+// ready while the latest scrape of every required container succeeded. In the on-demand scrape mode the sidecar is
+// ready without waiting for the containers to be scraped, and only stops being ready when readiness drops on failure
+// and the latest scrape of a required container failed.
+func (server *Server) HandleReady(writer http.ResponseWriter, r *http.Request) {
+	writeProbe(writer, server.readiness())
+}
+
+// liveness returns the reasons the server is not alive, if any.
+func (server *Server) liveness() []string {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	switch {
+	case !server.started:
+		return []string{"scraping has not started"}
+	case server.stopped:
+		return []string{"scraping has stopped"}
+	case server.scrapeMode == ScrapeModeOnDemand:
+		return nil
+	}
+	var problems []string
+	for _, containerName := range server.settings.containerNames() {
+		if !server.scheduler.Scheduled(containerName) {
+			problems = append(problems, fmt.Sprintf("the scrape loop of container %s is not running", containerName))
+		}
+	}
+	return problems
+}
+
+// readiness returns the reasons the server is not ready, if any. Paused containers are not waited for.
+func (server *Server) readiness() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	switch {
+	case !server.started:
+		return []string{"scraping has not started"}
+	case server.stopped:
+		return []string{"scraping has stopped"}
+	case server.ready && !server.settings.readinessDropsOnFailure:
+		return nil
+	}
+	var problems []string
+	for _, containerName := range server.settings.containerNames() {
+		if !server.settings.isRequired(containerName) {
+			continue
+		}
+		state, ok := server.states.get(containerName)
+		switch {
+		case server.scrapeMode == ScrapeModeOnDemand && (!ok || !server.settings.readinessDropsOnFailure):
+			// Containers scraped on demand are only scraped once Prometheus requests the metrics, which it may wait to
+			// do until the sidecar is ready, so they aren't waited for.
+		case !ok || state.lastSuccess.IsZero():
+			problems = append(problems, fmt.Sprintf("container %s has not been scraped successfully yet", containerName))
+		case server.settings.readinessDropsOnFailure && !state.up:
+			problems = append(problems, fmt.Sprintf("the latest scrape of container %s failed: %v", containerName, state.lastError))
+		}
+	}
+	server.ready = len(problems) == 0
+	return problems
+}
+
+// writeProbe writes the response of a probe, which fails with the given problems if there are any.
+func writeProbe(writer http.ResponseWriter, problems []string) {
+	writer.Header().Set("Content-Type", contentType)
+	if len(problems) != 0 {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+		if _, err := writer.Write([]byte(strings.Join(problems, "\n") + "\n")); err != nil {
+			log.Errorf("Failed to write the probe response: %v", err)
+		}
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+	if _, err := writer.Write([]byte("ok\n")); err != nil {
+		log.Errorf("Failed to write the probe response: %v", err)
+	}
+}
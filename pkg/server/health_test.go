@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+
+	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
+)
+
+func TestHandleHealth(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	mc := mock_server.NewMockMetricClient(ctr)
+	mc.EXPECT().ScrapeRawMetrics(gomock.Any(), gomock.Any()).Return(nil, expfmt.FmtUnknown, errors.New("connection refused")).AnyTimes()
+	server := NewServer(opts, nil, mc, targets)
+	probe := func() int {
+		recorder := httptest.NewRecorder()
+		server.HandleHealth(recorder, httptest.NewRequest(http.MethodGet, healthPath, nil))
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, probe(), "the server is not alive before it starts scraping")
+	server.Start(context.Background())
+	assert.Equal(t, http.StatusOK, probe())
+	server.scheduler.Unschedule("container2")
+	assert.Equal(t, http.StatusServiceUnavailable, probe(), "the server is not alive once a scrape loop stopped")
+	server.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, probe())
+}
+
+func TestHandleReady(t *testing.T) {
+	errRefused := errors.New("connection refused")
+	testCases := []struct {
+		name                    string
+		scrapeMode              ScrapeMode
+		required                map[string]bool
+		readinessDropsOnFailure bool
+		scrapeErrors            []map[string]error
+		expectedStatus          int
+	}{
+		{
+			"test not ready before every container was scraped",
+			ScrapeModePoll,
+			nil,
+			false,
+			[]map[string]error{{"container1": nil, "container2": nil}},
+			http.StatusServiceUnavailable,
+		},
+		{
+			"test not ready before every container was scraped successfully",
+			ScrapeModePoll,
+			nil,
+			false,
+			[]map[string]error{{"container1": nil, "container2": nil, "container3": errRefused}},
+			http.StatusServiceUnavailable,
+		},
+		{
+			"test ready once every container was scraped successfully",
+			ScrapeModePoll,
+			nil,
+			false,
+			[]map[string]error{{"container1": nil, "container2": nil, "container3": errRefused}, {"container3": nil}},
+			http.StatusOK,
+		},
+		{
+			"test ready once every required container was scraped successfully",
+			ScrapeModePoll,
+			map[string]bool{"container1": true},
+			false,
+			[]map[string]error{{"container1": nil, "container3": errRefused}},
+			http.StatusOK,
+		},
+		{
+			"test stays ready when a required container fails",
+			ScrapeModePoll,
+			nil,
+			false,
+			[]map[string]error{{"container1": nil, "container2": nil, "container3": nil}, {"container3": errRefused}},
+			http.StatusOK,
+		},
+		{
+			"test readiness drops when a required container fails",
+			ScrapeModePoll,
+			nil,
+			true,
+			[]map[string]error{{"container1": nil, "container2": nil, "container3": nil}, {"container3": errRefused}},
+			http.StatusServiceUnavailable,
+		},
+		{
+			"test readiness does not drop when a container that isn't required fails",
+			ScrapeModePoll,
+			map[string]bool{"container1": true},
+			true,
+			[]map[string]error{{"container1": nil, "container3": nil}, {"container3": errRefused}},
+			http.StatusOK,
+		},
+		{
+			"test ready on demand before any container was scraped",
+			ScrapeModeOnDemand,
+			nil,
+			false,
+			[]map[string]error{{}},
+			http.StatusOK,
+		},
+		{
+			"test stays ready on demand when a required container fails",
+			ScrapeModeOnDemand,
+			nil,
+			false,
+			[]map[string]error{{"container3": errRefused}},
+			http.StatusOK,
+		},
+		{
+			"test readiness drops on demand when a required container fails",
+			ScrapeModeOnDemand,
+			nil,
+			true,
+			[]map[string]error{{"container1": nil, "container3": errRefused}},
+			http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			readyOpts := onDemandOpts
+			readyOpts.ScrapeMode = tc.scrapeMode
+			readyOpts.RequiredContainers = tc.required
+			readyOpts.ReadinessDropsOnFailure = tc.readinessDropsOnFailure
+			server := NewServer(readyOpts, nil, nil, targets)
+			// The scrapes are recorded by the test rather than scheduled.
+			server.started = true
+			defer server.Close()
+
+			// Readiness is probed after every round of scrapes, as the kubelet would.
+			recorder := httptest.NewRecorder()
+			for _, round := range tc.scrapeErrors {
+				for containerName, err := range round {
+					server.states.recordScrape(containerName, time.Now(), 1, err)
+				}
+				recorder = httptest.NewRecorder()
+				server.HandleReady(recorder, httptest.NewRequest(http.MethodGet, readyPath, nil))
+			}
+			assert.Equal(t, tc.expectedStatus, recorder.Code, recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+)
+
+// The names of the limits, used as the limit label of the series reporting the scrapes that exceeded them.
+const (
+	limitBodySize         = "body_size_limit"
+	limitSample           = "sample_limit"
+	limitLabel            = "label_limit"
+	limitLabelNameLength  = "label_name_length_limit"
+	limitLabelValueLength = "label_value_length_limit"
+)
+
+// Limits are the limits the metrics of a container are held to once they are labelled and relabelled, 0 meaning no
+// limit. As in Prometheus, a scrape exceeding any of them fails as a whole. The limit on the size of the body is held
+// by the target of the container, since it applies while the metrics are read.
+type Limits struct {
+	// SampleLimit is the number of samples the metrics may not exceed.
+	SampleLimit int
+	// LabelLimit is the number of labels a series may not exceed, counting its name as the __name__ label.
+	LabelLimit int
+	// LabelNameLengthLimit is the length the names of the labels may not exceed.
+	LabelNameLengthLimit int
+	// LabelValueLengthLimit is the length the values of the labels, and the metric names, may not exceed.
+	LabelValueLengthLimit int
+}
+
+// limitError is a scrape failing because the metrics of the container exceeded one of its limits.
+type limitError struct {
+	limit string
+	err   error
+}
+
+func (e *limitError) Error() string {
+	return e.err.Error()
+}
+
+// check returns a *limitError if the metric families exceed one of the limits.
+func (l Limits) check(metricFamilies map[string]*promclient.MetricFamily) error {
+	if l.SampleLimit > 0 {
+		if samples := parse.CountSamples(metricFamilies); samples > l.SampleLimit {
+			return &limitError{limitSample, fmt.Errorf("%d samples exceed the sample limit of %d", samples, l.SampleLimit)}
+		}
+	}
+	if l.LabelLimit <= 0 && l.LabelNameLengthLimit <= 0 && l.LabelValueLengthLimit <= 0 {
+		return nil
+	}
+	for name, mf := range metricFamilies {
+		for _, m := range mf.GetMetric() {
+			// Like Prometheus, the name of the series is checked as the value of the __name__ label.
+			if err := l.checkLabel(name, model.MetricNameLabel, name); err != nil {
+				return err
+			}
+			if l.LabelLimit > 0 && len(m.GetLabel())+1 > l.LabelLimit {
+				return &limitError{limitLabel, fmt.Errorf("a series of %s has %d labels, exceeding the label limit of %d", name, len(m.GetLabel())+1, l.LabelLimit)}
+			}
+			for _, label := range m.GetLabel() {
+				if err := l.checkLabel(name, label.GetName(), label.GetValue()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkLabel returns a *limitError if a label of a series of the family exceeds the length limits.
+func (l Limits) checkLabel(familyName string, labelName string, value string) error {
+	if l.LabelNameLengthLimit > 0 && len(labelName) > l.LabelNameLengthLimit {
+		return &limitError{limitLabelNameLength, fmt.Errorf("label name %s of %s exceeds the label name length limit of %d", labelName, familyName, l.LabelNameLengthLimit)}
+	}
+	if l.LabelValueLengthLimit > 0 && len(value) > l.LabelValueLengthLimit {
+		return &limitError{limitLabelValueLength, fmt.Errorf("the value of label %s of %s exceeds the label value length limit of %d", labelName, familyName, l.LabelValueLengthLimit)}
+	}
+	return nil
+}
+
+// exceededLimit returns the name of the limit the scrape failed with the given error exceeded, if any.
+func exceededLimit(err error) (string, bool) {
+	var limitErr *limitError
+	switch {
+	case errors.As(err, &limitErr):
+		return limitErr.limit, true
+	case errors.Is(err, client.ErrBodySizeLimit):
+		return limitBodySize, true
+	}
+	return "", false
+}
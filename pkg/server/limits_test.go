@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
+)
+
+// limitedMetricFamilies returns a gauge family with a series of two labels and a histogram family of 4 samples.
+func limitedMetricFamilies() map[string]*promclient.MetricFamily {
+	return map[string]*promclient.MetricFamily{
+		"requests": {
+			Name: proto.String("requests"),
+			Type: promclient.MetricType_GAUGE.Enum(),
+			Metric: []*promclient.Metric{
+				{
+					Label: []*promclient.LabelPair{
+						{Name: proto.String("container"), Value: proto.String("container1")},
+						{Name: proto.String("path"), Value: proto.String("/api/users")},
+					},
+					Gauge: &promclient.Gauge{Value: proto.Float64(1)},
+				},
+			},
+		},
+		"latency": {
+			Name: proto.String("latency"),
+			Type: promclient.MetricType_HISTOGRAM.Enum(),
+			Metric: []*promclient.Metric{
+				{
+					Histogram: &promclient.Histogram{
+						SampleCount: proto.Uint64(1),
+						SampleSum:   proto.Float64(0.5),
+						Bucket: []*promclient.Bucket{
+							{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestLimitsCheck(t *testing.T) {
+	testCases := []struct {
+		name          string
+		limits        Limits
+		expectedLimit string
+	}{
+		{"accept metrics without limits", Limits{}, ""},
+		{"accept metrics within the limits", Limits{5, 3, 9, 10}, ""},
+		{"reject metrics exceeding the sample limit", Limits{SampleLimit: 4}, limitSample},
+		{"reject a series exceeding the label limit", Limits{LabelLimit: 2}, limitLabel},
+		{"reject a label name exceeding the length limit", Limits{LabelNameLengthLimit: 8}, limitLabelNameLength},
+		{"reject a label value exceeding the length limit", Limits{LabelValueLengthLimit: 9}, limitLabelValueLength},
+		{"reject a metric name exceeding the label value length limit", Limits{LabelValueLengthLimit: 6}, limitLabelValueLength},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.limits.check(limitedMetricFamilies())
+			limit, ok := exceededLimit(err)
+			assert.Equal(t, tc.expectedLimit, limit)
+			assert.Equal(t, tc.expectedLimit != "", ok)
+			assert.Equal(t, tc.expectedLimit != "", err != nil)
+		})
+	}
+}
+
+func TestExceededLimit(t *testing.T) {
+	testCases := []struct {
+		name          string
+		err           error
+		expectedLimit string
+		exceeded      bool
+	}{
+		{"tell a limit error", fmt.Errorf("scrape failed: %w", &limitError{limitLabel, errors.New("too many labels")}), limitLabel, true},
+		{"tell a body size limit error", fmt.Errorf("scrape failed: %w", client.ErrBodySizeLimit), limitBodySize, true},
+		{"ignore other errors", errors.New("connection refused"), "", false},
+		{"ignore successful scrapes", nil, "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			limit, exceeded := exceededLimit(tc.err)
+			assert.Equal(t, tc.expectedLimit, limit)
+			assert.Equal(t, tc.exceeded, exceeded)
+		})
+	}
+}
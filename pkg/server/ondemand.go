@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+)
+
+const (
+	scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+	// scrapeTimeoutOffset is taken off Prometheus' scrape timeout, to leave time for merging and writing the response.
+	scrapeTimeoutOffset = 500 * time.Millisecond
+)
+
+// ScrapeMode is the way the containers are scraped.
+type ScrapeMode string
+
+const (
+	// ScrapeModePoll scrapes every container on a schedule and serves the metrics from the cache.
+	ScrapeModePoll ScrapeMode = "poll"
+	// ScrapeModeOnDemand scrapes all containers in parallel when the metrics are requested.
+	ScrapeModeOnDemand ScrapeMode = "on_demand"
+)
+
+// scrapeRound is an on-demand scrape of all containers, shared by the requests that arrive while it is running.
+type scrapeRound struct {
+	done   chan struct{}
+	result []mutate.ContainerMetricFamilies
+}
+
+// scrapeOnDemand scrapes all containers for the request. Concurrent requests are coalesced into a single scrape of
+// the containers, whose deadline is taken from the request that started it.
+func (server *Server) scrapeOnDemand(r *http.Request) []mutate.ContainerMetricFamilies {
+	server.roundMu.Lock()
+	round := server.round
+	if round == nil {
+		round = &scrapeRound{done: make(chan struct{})}
+		server.round = round
+		timeout := server.requestScrapeTimeout(r)
+		parent := server.scrapeContext()
+		go func() {
+			ctx, cancel := context.WithTimeout(parent, timeout)
+			defer cancel()
+			result := server.scrapeAll(ctx)
+
+			server.roundMu.Lock()
+			server.round = nil
+			round.result = result
+			server.roundMu.Unlock()
+			close(round.done)
+		}()
+	}
+	server.roundMu.Unlock()
+
+	select {
+	case <-round.done:
+		return round.result
+	case <-r.Context().Done():
+		return nil
+	}
+}
+
+// scrapeAll scrapes all containers in parallel and updates the cache with the results, which are returned in the
+// order of the container names.
+func (server *Server) scrapeAll(ctx context.Context) []mutate.ContainerMetricFamilies {
+	settings := server.currentSettings()
+	containerNames := settings.containerNames()
+	results := make([]map[string]*promclient.MetricFamily, len(containerNames))
+	var wg sync.WaitGroup
+	for i, containerName := range containerNames {
+		wg.Add(1)
+		go func(i int, containerName string) {
+			defer wg.Done()
+			metricFamilies, err := server.scrapeContainer(ctx, settings.labelName, containerName, settings.targets[containerName])
+			if err != nil {
+				log.Errorf("Failed to scrape container %s on demand: %v", containerName, err)
+				return
+			}
+			results[i] = metricFamilies
+		}(i, containerName)
+	}
+	wg.Wait()
+
+	containerMetricFamilies := make([]mutate.ContainerMetricFamilies, 0, len(containerNames))
+	for i, metricFamilies := range results {
+		if metricFamilies != nil {
+			containerMetricFamilies = append(containerMetricFamilies, mutate.ContainerMetricFamilies{
+				ContainerName:  containerNames[i],
+				MetricFamilies: metricFamilies,
+			})
+		}
+	}
+	return containerMetricFamilies
+}
+
+// requestScrapeTimeout returns the timeout of the on-demand scrape of the request, which is Prometheus' scrape
+// timeout minus an offset for the response, or the configured scrape timeout if Prometheus didn't send one.
+func (server *Server) requestScrapeTimeout(r *http.Request) time.Duration {
+	header := r.Header.Get(scrapeTimeoutHeader)
+	if header == "" {
+		return server.currentSettings().scrapeTimeout
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		log.Warningf("Invalid %s header %q, using the default scrape timeout", scrapeTimeoutHeader, header)
+		return server.currentSettings().scrapeTimeout
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > scrapeTimeoutOffset {
+		timeout -= scrapeTimeoutOffset
+	}
+	return timeout
+}
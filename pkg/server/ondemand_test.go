@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
+)
+
+var onDemandOpts = Options{
+	MetricPort:         metricPort,
+	Endpoint:           endpoint,
+	ContainerLabelName: "container",
+	ScrapeInterval:     time.Hour,
+	ScrapeMode:         ScrapeModeOnDemand,
+	ScrapeTimeout:      10 * time.Second,
+}
+
+// goroutinesRawMetrics returns the raw metrics a container exposing go_goroutines would be scraped with.
+func goroutinesRawMetrics(value int) *bytes.Buffer {
+	return bytes.NewBufferString(fmt.Sprintf(`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines %d
+`, value))
+}
+
+func TestRequestScrapeTimeout(t *testing.T) {
+	testCases := []struct {
+		name            string
+		header          string
+		expectedTimeout time.Duration
+	}{
+		{"use the default timeout without a header", "", 10 * time.Second},
+		{"take the offset off the timeout of the header", "5", 4500 * time.Millisecond},
+		{"parse fractional seconds", "1.5", time.Second},
+		{"keep a timeout shorter than the offset", "0.2", 200 * time.Millisecond},
+		{"use the default timeout for an invalid header", "soon", 10 * time.Second},
+		{"use the default timeout for a negative header", "-3", 10 * time.Second},
+	}
+	server := NewServer(onDemandOpts, nil, nil, targets)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", path, nil)
+			if tc.header != "" {
+				req.Header.Set(scrapeTimeoutHeader, tc.header)
+			}
+			assert.Equal(t, tc.expectedTimeout, server.requestScrapeTimeout(req))
+		})
+	}
+}
+
+func TestHandleMetricsOnDemand(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	mc := mock_server.NewMockMetricClient(ctr)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	for containerName, target := range targets {
+		if containerName == "container2" {
+			mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).Return(nil, expfmt.FmtUnknown, fmt.Errorf("connection refused"))
+			continue
+		}
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).DoAndReturn(
+			func(ctx context.Context, target utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+				deadline, ok := ctx.Deadline()
+				assert.True(t, ok)
+				assert.WithinDuration(t, time.Now().Add(2500*time.Millisecond), deadline, time.Second)
+				return goroutinesRawMetrics(target.Port), expfmt.FmtText, nil
+			})
+		mockCache.EXPECT().Set(containerName, gomock.Any())
+	}
+
+	req, _ := http.NewRequest("GET", path, nil)
+	req.Header.Set(scrapeTimeoutHeader, "3")
+	mw := mock_server.NewMockResponseWriter(ctr)
+	mw.EXPECT().Header().Return(http.Header{})
+	mw.EXPECT().WriteHeader(http.StatusOK)
+	mw.EXPECT().Write([]byte(`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container1"} 1
+go_goroutines{container="container3"} 3
+# HELP scrape_duration_seconds Duration of the latest scrape of the container.
+# TYPE scrape_duration_seconds gauge
+scrape_duration_seconds{container="container1"} 0
+scrape_duration_seconds{container="container2"} 0
+scrape_duration_seconds{container="container3"} 0
+# HELP scrape_last_success_timestamp_seconds Unix time of the latest successful scrape of the container.
+# TYPE scrape_last_success_timestamp_seconds gauge
+scrape_last_success_timestamp_seconds{container="container1"} 1000
+scrape_last_success_timestamp_seconds{container="container2"} 0
+scrape_last_success_timestamp_seconds{container="container3"} 1000
+# HELP scrape_samples_scraped Number of samples the latest scrape of the container exposed.
+# TYPE scrape_samples_scraped gauge
+scrape_samples_scraped{container="container1"} 1
+scrape_samples_scraped{container="container2"} 0
+scrape_samples_scraped{container="container3"} 1
+# HELP up 1 if the latest scrape of the container succeeded, 0 otherwise.
+# TYPE up gauge
+up{container="container1"} 1
+up{container="container2"} 0
+up{container="container3"} 1
+`))
+
+	server := NewServer(onDemandOpts, mockCache, mc, targets)
+	server.states.now = func() time.Time { return time.Unix(1000, 0) }
+	server.Start(context.Background())
+	server.HandleMetrics(mw, req)
+}
+
+// waitingContext is the context of a request that reports when the request started waiting for a scrape round, which
+// is when its Done channel is first asked for.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting chan struct{}
+}
+
+func newWaitingContext() *waitingContext {
+	return &waitingContext{Context: context.Background(), waiting: make(chan struct{})}
+}
+
+func (ctx *waitingContext) Done() <-chan struct{} {
+	ctx.once.Do(func() { close(ctx.waiting) })
+	return ctx.Context.Done()
+}
+
+func TestScrapeOnDemandCoalescesRequests(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	release := make(chan struct{})
+	var scrapes atomic.Int32
+	mc := mock_server.NewMockMetricClient(ctr)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	for containerName, target := range targets {
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).DoAndReturn(
+			func(ctx context.Context, target utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+				scrapes.Add(1)
+				<-release
+				return goroutinesRawMetrics(target.Port), expfmt.FmtText, nil
+			}).AnyTimes()
+		mockCache.EXPECT().Set(containerName, gomock.Any()).AnyTimes()
+	}
+	server := NewServer(onDemandOpts, mockCache, mc, targets)
+
+	results := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		ctx := newWaitingContext()
+		go func() {
+			req, _ := http.NewRequestWithContext(ctx, "GET", path, nil)
+			results <- len(server.scrapeOnDemand(req))
+		}()
+		// The scrapes are held until both requests wait for them, so that both take part in the same round.
+		<-ctx.waiting
+	}
+	close(release)
+
+	assert.Equal(t, len(targets), <-results)
+	assert.Equal(t, len(targets), <-results)
+	assert.Equal(t, int32(len(targets)), scrapes.Load(), "every container should be scraped once for both requests")
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/relabel"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+)
+
+// settings are the options of the server that can be reloaded while it is running, along with the containers paused
+// through the admin endpoint. The options left out of it, such as the port, the paths, the scrape mode and the cache
+// read mode, only take effect when the server is created.
+type settings struct {
+	targets map[string]utils.Target
+	// paused is replaced rather than modified, so that copies of the settings can be read without holding mu.
+	paused          map[string]bool
+	scrapeInterval  time.Duration
+	scrapeIntervals map[string]time.Duration
+	labelName       string
+	// labelCollisionPolicy decides what happens to a series that already has a label named labelName.
+	labelCollisionPolicy mutate.LabelCollisionPolicy
+	extraLabels          map[string]map[string]string
+	relabelRules         map[string][]*relabel.Rule
+	limits               map[string]Limits
+	conflictPolicy       mutate.ConflictPolicy
+	scrapeTimeout        time.Duration
+	// required is nil if every container is required.
+	required                      map[string]bool
+	readinessDropsOnFailure       bool
+	nativeHistogramClassicBuckets bool
+}
+
+func newSettings(opts Options, targets map[string]utils.Target) settings {
+	return settings{
+		targets:                       targets,
+		scrapeInterval:                opts.ScrapeInterval,
+		scrapeIntervals:               opts.ContainerScrapeIntervals,
+		labelName:                     opts.ContainerLabelName,
+		labelCollisionPolicy:          opts.LabelCollisionPolicy,
+		extraLabels:                   opts.ContainerExtraLabels,
+		relabelRules:                  opts.ContainerMetricRelabelRules,
+		limits:                        opts.ContainerLimits,
+		conflictPolicy:                opts.TypeConflictPolicy,
+		scrapeTimeout:                 opts.ScrapeTimeout,
+		required:                      opts.RequiredContainers,
+		readinessDropsOnFailure:       opts.ReadinessDropsOnFailure,
+		nativeHistogramClassicBuckets: opts.NativeHistogramClassicBuckets,
+	}
+}
+
+// containerNames returns the names of all scraped containers in a stable order, so that the merged series of
+// different containers are always exposed in the same order. Paused containers are left out.
+func (s settings) containerNames() []string {
+	names := make([]string, 0, len(s.targets))
+	for containerName := range s.targets {
+		if !s.paused[containerName] {
+			names = append(names, containerName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// interval returns the scrape interval of the container.
+func (s settings) interval(containerName string) time.Duration {
+	if interval, ok := s.scrapeIntervals[containerName]; ok && interval > 0 {
+		return interval
+	}
+	return s.scrapeInterval
+}
+
+// isScraped reports whether the container is scraped from the given target, rather than paused, removed or scraped from
+// another target.
+func (s settings) isScraped(containerName string, target utils.Target) bool {
+	current, ok := s.targets[containerName]
+	return ok && !s.paused[containerName] && current.Equal(target)
+}
+
+// isRequired reports whether the container has to be scraped successfully before the server is ready.
+func (s settings) isRequired(containerName string) bool {
+	return s.required == nil || s.required[containerName]
+}
+
+// currentSettings returns the settings the server is currently running with.
+func (server *Server) currentSettings() settings {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.settings
+}
+
+// Reload swaps in the reloadable options and the targets of the containers while the server is running. The scrape
+// loops of removed containers are stopped, those of added containers are started, and those of containers whose
+// target or scrape interval changed are restarted. Containers whose label name, extra labels or relabelling rules changed
+// are labelled with the new labels from their next scrape. Paused containers stay paused.
+func (server *Server) Reload(opts Options, targets map[string]utils.Target) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	previous := server.settings
+	server.settings = newSettings(opts, targets)
+	server.settings.paused = make(map[string]bool)
+	for containerName := range previous.paused {
+		if _, ok := targets[containerName]; ok {
+			server.settings.paused[containerName] = true
+		}
+	}
+	for containerName, target := range previous.targets {
+		newTarget, ok := targets[containerName]
+		if ok && newTarget.Equal(target) && server.settings.interval(containerName) == previous.interval(containerName) {
+			continue
+		}
+		server.scheduler.Unschedule(containerName)
+		if !ok {
+			log.Infof("Container %s was removed from the configuration, it is no longer scraped", containerName)
+			server.forgetContainer(containerName)
+		}
+	}
+	if !server.started || server.scrapeMode == ScrapeModeOnDemand {
+		return
+	}
+	for _, containerName := range server.settings.containerNames() {
+		server.schedule(containerName)
+	}
+}
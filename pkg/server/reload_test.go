@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
+	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
+)
+
+func TestReload(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	var wg sync.WaitGroup
+	mc := mock_server.NewMockMetricClient(ctr)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	expectScrape := func(containerName string, target utils.Target) {
+		wg.Add(1)
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).Return(bytes.NewBufferString("new_metric 1\n"), expfmt.FmtText, nil)
+		mockCache.EXPECT().Set(containerName, gomock.Any()).Do(func(string, map[string]*promclient.MetricFamily) { wg.Done() })
+	}
+	for containerName, target := range targets {
+		expectScrape(containerName, target)
+	}
+	server := NewServer(opts, mockCache, mc, targets)
+	server.Start(context.Background())
+	wg.Wait()
+
+	// container1 is removed, container2 moves to another port, container3 is left alone and container4 is added.
+	reloadedTargets := map[string]utils.Target{
+		"container2": {Scheme: "http", Host: "localhost", Port: 22, Path: endpoint},
+		"container3": targets["container3"],
+		"container4": {Scheme: "http", Host: "localhost", Port: 4, Path: endpoint},
+	}
+	reloadedOpts := opts
+	reloadedOpts.TypeConflictPolicy = mutate.ConflictPolicyRename
+	mockCache.EXPECT().GetAndInvalidate("container1").Return(nil, false)
+	telemetry.TypeConflicts.WithLabelValues("container1", string(mutate.ConflictPolicyDrop)).Inc()
+	telemetry.ScrapeLimitsExceeded.WithLabelValues("container1", limitSample).Inc()
+	telemetry.RelabelDroppedSeries.WithLabelValues("container1").Inc()
+	expectScrape("container2", reloadedTargets["container2"])
+	expectScrape("container4", reloadedTargets["container4"])
+	server.Reload(reloadedOpts, reloadedTargets)
+	wg.Wait()
+	server.Close()
+
+	settings := server.currentSettings()
+	assert.Equal(t, []string{"container2", "container3", "container4"}, settings.containerNames())
+	assert.Equal(t, mutate.ConflictPolicyRename, settings.conflictPolicy)
+	_, ok := server.states.get("container1")
+	assert.False(t, ok, "the state of a removed container must be forgotten")
+	assert.False(t, telemetry.TypeConflicts.DeleteLabelValues("container1", string(mutate.ConflictPolicyDrop)),
+		"the telemetry of a removed container must be deleted")
+	assert.False(t, telemetry.ScrapeLimitsExceeded.DeleteLabelValues("container1", limitSample),
+		"the telemetry of a removed container must be deleted")
+	assert.False(t, telemetry.RelabelDroppedSeries.DeleteLabelValues("container1"),
+		"the telemetry of a removed container must be deleted")
+}
+
+func TestReloadDropsScrapeInFlight(t *testing.T) {
+	testCases := []struct {
+		name            string
+		reloadedTargets map[string]utils.Target
+	}{
+		{
+			"test drop the scrape of a removed container",
+			map[string]utils.Target{"container2": targets["container2"], "container3": targets["container3"]},
+		},
+		{
+			"test drop the scrape of the old target of a container",
+			map[string]utils.Target{
+				"container1": {Scheme: "http", Host: "localhost", Port: 11, Path: endpoint},
+				"container2": targets["container2"],
+				"container3": targets["container3"],
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			scraping, release := make(chan struct{}), make(chan struct{})
+			mc := mock_server.NewMockMetricClient(ctr)
+			mc.EXPECT().ScrapeRawMetrics(gomock.Any(), targets["container1"]).DoAndReturn(
+				func(context.Context, utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+					close(scraping)
+					<-release
+					return bytes.NewBufferString("new_metric 1\n"), expfmt.FmtText, nil
+				})
+			// The scrape finishing after the reload never sets the cache.
+			mockCache := mock_server.NewMockMetricCache(ctr)
+			mockCache.EXPECT().GetAndInvalidate("container1").AnyTimes()
+			server := NewServer(opts, mockCache, mc, targets)
+
+			done := make(chan struct{})
+			go func() {
+				server.PopulateCacheForContainer(context.Background(), "container", "container1", targets["container1"])
+				close(done)
+			}()
+			<-scraping
+			server.Reload(opts, tc.reloadedTargets)
+			close(release)
+			<-done
+
+			_, ok := server.states.get("container1")
+			assert.False(t, ok, "the scrape in flight must not record the state of the container")
+		})
+	}
+}
+
+func TestSettingsInterval(t *testing.T) {
+	intervalOpts := opts
+	intervalOpts.ContainerScrapeIntervals = map[string]time.Duration{"container1": time.Minute}
+	settings := newSettings(intervalOpts, targets)
+	assert.Equal(t, time.Minute, settings.interval("container1"))
+	assert.Equal(t, time.Hour, settings.interval("container2"))
+}
@@ -3,36 +3,60 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/relabel"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/scheduler"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
 )
 
 const (
-	contentEncoding = "gzip"
-	contentType     = "text/plain; charset=utf-8"
+	contentEncoding     = "gzip"
+	contentType         = "text/plain; charset=utf-8"
+	conflictLogInterval = time.Minute
 )
 
 // MetricClient is the metricClient interface for scraping metrics.
 type MetricClient interface {
-	ScrapeRawMetrics(ctx context.Context, port int, endpoint string) (*bytes.Buffer, error)
+	ScrapeRawMetrics(ctx context.Context, target utils.Target) (*bytes.Buffer, expfmt.Format, error)
 }
 
 // MetricCache is the cache interface for metric storage.
 type MetricCache interface {
-	GetAndInvalidate(containerName string) ([]byte, bool)
-	Set(containerName string, metrics []byte)
+	GetAndInvalidate(containerName string) (map[string]*promclient.MetricFamily, bool)
+	Get(containerName string) (map[string]*promclient.MetricFamily, bool)
+	Set(containerName string, metricFamilies map[string]*promclient.MetricFamily)
 }
 
+// CacheReadMode is the way HandleMetrics reads the scraped metrics from the cache.
+type CacheReadMode string
+
+const (
+	// CacheReadModeInvalidate removes the metrics of a container from the cache once they have been served, so
+	// every scrape of a container is served exactly once.
+	CacheReadModeInvalidate CacheReadMode = "invalidate"
+	// CacheReadModeRetain keeps the metrics of a container in the cache, so the latest scrape of a container is
+	// served to every caller until it is replaced or becomes stale.
+	CacheReadModeRetain CacheReadMode = "retain"
+)
+
 // HTTPServer is a server interface that implements functionality for handling HTTP requests.
 type HTTPServer interface {
 	ListenAndServe() error
+	ListenAndServeTLS(certFile string, keyFile string) error
+	Shutdown(ctx context.Context) error
 	Close() error
 }
 
@@ -43,47 +67,207 @@ type ResponseWriter interface {
 	WriteHeader(statusCode int)
 }
 
+// Options are the settings of the server that apply to all containers.
+type Options struct {
+	// MetricPort is the port the multiplexed metrics are exposed on.
+	MetricPort int
+	// ProbePort is the port the probes are served on over plain HTTP, or 0 to serve them on MetricPort along with the
+	// metrics. Probes on a port of their own keep working when the metrics are served over TLS requiring client
+	// certificates, which the kubelet doesn't present.
+	ProbePort int
+	// Endpoint is the path the multiplexed metrics are exposed on.
+	Endpoint string
+	// TelemetryEndpoint is the path the metrics of the sidecar itself are exposed on.
+	TelemetryEndpoint string
+	// AdminEndpoint is the path under which scraping single containers is paused and resumed, or empty to disable it.
+	AdminEndpoint string
+	// TypeConflictPolicy decides what happens to a metric family whose type differs between containers.
+	TypeConflictPolicy mutate.ConflictPolicy
+	// CacheReadMode decides whether serving the metrics of a container removes them from the cache.
+	CacheReadMode CacheReadMode
+	// ContainerLabelName is the name of the label telling the containers apart in the multiplexed metrics.
+	ContainerLabelName string
+	// LabelCollisionPolicy decides what happens to a series that already has a label named ContainerLabelName.
+	LabelCollisionPolicy mutate.LabelCollisionPolicy
+	// ScrapeInterval is the time between two scrapes of the same container.
+	ScrapeInterval time.Duration
+	// ContainerScrapeIntervals overrides the scrape interval of individual containers.
+	ContainerScrapeIntervals map[string]time.Duration
+	// ScrapeJitter is the maximum offset of the first scrape of each container, so that the scrapes of different
+	// containers don't align. It is capped at the scrape interval.
+	ScrapeJitter time.Duration
+	// ScrapeSpread spreads the first scrapes of the containers over their whole scrape interval, in place of the
+	// jitter.
+	ScrapeSpread bool
+	// ScrapeMode decides whether the containers are scraped on a schedule or when the metrics are requested.
+	ScrapeMode ScrapeMode
+	// RequiredContainers are the containers that have to be scraped successfully before the server is ready, or nil
+	// if every container is required.
+	RequiredContainers map[string]bool
+	// ReadinessDropsOnFailure makes the server unready whenever the latest scrape of a required container failed,
+	// rather than staying ready once every required container has been scraped successfully.
+	ReadinessDropsOnFailure bool
+	// ScrapeTimeout is the timeout of on-demand scrapes when the request doesn't carry Prometheus' scrape timeout.
+	ScrapeTimeout time.Duration
+	// NativeHistogramClassicBuckets adds classic buckets to the native histograms of the containers, for Prometheus
+	// servers that don't support native histograms.
+	NativeHistogramClassicBuckets bool
+	// ContainerExtraLabels are the labels added to the metrics of each container along with the container label.
+	ContainerExtraLabels map[string]map[string]string
+	// ContainerMetricRelabelRules are the relabelling rules applied to the metrics of each container once they are
+	// labelled.
+	ContainerMetricRelabelRules map[string][]*relabel.Rule
+	// ContainerLimits are the limits the metrics of each container are held to.
+	ContainerLimits map[string]Limits
+	// TLSConfig are the TLS settings the server is served with, or nil to serve plain HTTP. They provide the
+	// certificate of the server themselves.
+	TLSConfig *tls.Config
+	// Authenticate wraps the handlers of the metrics, the telemetry and the admin endpoint so that they require
+	// credentials, or is nil to serve them to anyone.
+	Authenticate func(http.Handler) http.Handler
+}
+
 // Server is a wrapper around an HTTP server and have the functionality to scrape all containers within a pod and return the contents of the cache.
 type Server struct {
 	httpServer         HTTPServer
+	tls                bool
+	authenticate       func(http.Handler) http.Handler
+	mux                *http.ServeMux
+	probeServer        HTTPServer
+	probeMux           *http.ServeMux
 	cache              MetricCache
 	metricClient       MetricClient
-	containerToPortMap map[string]int
 	path               string
+	telemetryPath      string
+	adminPath          string
+	conflictLogLimiter *utils.LogLimiter
+	cacheReadMode      CacheReadMode
+	scheduler          *scheduler.Scheduler
+	scrapeMode         ScrapeMode
+	roundMu            sync.Mutex
+	round              *scrapeRound
+	states             *containerStates
+	typeTracker        *mutate.TypeTracker
+	// mu guards the settings that can be reloaded while the server is running, the context of the scrapes, and
+	// whether scraping has started or stopped.
+	mu       sync.RWMutex
+	settings settings
+	ctx      context.Context
+	cancel   context.CancelFunc
+	started  bool
+	stopped  bool
+	// ready latches once every required container has been scraped successfully.
+	ready bool
 }
 
 // NewServer instantiates a new server.
-func NewServer(metricPort int, cache MetricCache, client MetricClient, containerToPortMap map[string]int, endpoint string) *Server {
+func NewServer(opts Options, cache MetricCache, client MetricClient, targets map[string]utils.Target) *Server {
+	mux := http.NewServeMux()
+	probeMux := mux
+	var probeServer HTTPServer
+	if opts.ProbePort != 0 {
+		probeMux = http.NewServeMux()
+		probeServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", opts.ProbePort),
+			Handler: probeMux,
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		&http.Server{
-			Addr: fmt.Sprintf(":%d", metricPort),
+		httpServer: &http.Server{
+			Addr:      fmt.Sprintf(":%d", opts.MetricPort),
+			Handler:   mux,
+			TLSConfig: opts.TLSConfig,
 		},
-		cache,
-		client,
-		containerToPortMap,
-		endpoint,
+		tls:                opts.TLSConfig != nil,
+		authenticate:       opts.Authenticate,
+		mux:                mux,
+		probeServer:        probeServer,
+		probeMux:           probeMux,
+		cache:              cache,
+		metricClient:       client,
+		path:               opts.Endpoint,
+		telemetryPath:      opts.TelemetryEndpoint,
+		adminPath:          strings.TrimSuffix(opts.AdminEndpoint, "/"),
+		conflictLogLimiter: utils.NewLogLimiter(conflictLogInterval),
+		cacheReadMode:      opts.CacheReadMode,
+		scheduler:          scheduler.New(scheduler.RealClock{}, opts.ScrapeInterval, opts.ScrapeJitter, opts.ScrapeSpread),
+		scrapeMode:         opts.ScrapeMode,
+		states:             newContainerStates(),
+		typeTracker:        mutate.NewTypeTracker(),
+		settings:           newSettings(opts, targets),
+		ctx:                ctx,
+		cancel:             cancel,
 	}
 }
 
 // HandleMetrics is the handler for exposing metrics. It will fetch all the available metrics from cache,
-//invalidate all their entries on cache, and finally serve them to the metric path.
+// invalidate their entries on cache unless the cache read mode retains them, merge the metric families of all
+// containers by name, and finally serve them to the metric path. Families whose type conflicts between containers
+// are resolved with the configured policy. In the on-demand scrape mode the metrics are scraped from all containers
+// for the request instead of being read from the cache. The metrics are served in the text, OpenMetrics or protobuf
+// format according to the Accept header of the request. The container and exclude_container query parameters serve
+// the cached metrics of only the given containers, or of all containers but the given ones, without invalidating them
+// or scraping the containers, and requests for <metric path>/<container> are served the cached metrics of a single
+// container by HandleContainerMetrics.
 func (server *Server) HandleMetrics(writer http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != server.path {
+		server.HandleContainerMetrics(writer, r)
+		return
+	}
 	if r.Method != "GET" {
 		log.Warningf("Invalid http %s method for getting metrics from server.", r.Method)
 		return
 	}
 
-	metrics := make([]byte, 0)
-	for containerName := range server.containerToPortMap {
-		metric, ok := server.cache.GetAndInvalidate(containerName)
-		if ok {
-			metrics = append(metrics, metric...)
-		} else {
-			log.Errorf("Missing metric in container : %s", containerName)
-		}
+	settings := server.currentSettings()
+	query := r.URL.Query()
+	containerNames, err := selectContainers(query, settings.containerNames())
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var containerMetricFamilies []mutate.ContainerMetricFamilies
+	switch {
+	case filtersContainers(query):
+		// Like the metrics of a single container, the selected containers are neither scraped for the request nor
+		// taken away from Prometheus.
+		containerMetricFamilies = server.cachedMetricFamilies(containerNames, server.cache.Get)
+	case server.scrapeMode == ScrapeModeOnDemand && server.scrapeContext().Err() == nil:
+		// Once scraping has stopped, the final requests are served whatever was last scraped.
+		containerMetricFamilies = server.scrapeOnDemand(r)
+	default:
+		containerMetricFamilies = server.cachedMetricFamilies(containerNames, server.readCache)
+	}
+	server.writeMetrics(writer, r, settings, containerNames, containerMetricFamilies)
+}
+
+// writeMetrics merges the metric families of the containers along with their synthetic series, and writes them in
+// the format and encoding the request accepts.
+func (server *Server) writeMetrics(writer http.ResponseWriter, r *http.Request, settings settings, containerNames []string,
+	containerMetricFamilies []mutate.ContainerMetricFamilies) {
+	// The synthetic series go first, so that they win any type conflict with a family of the same name.
+	if synthetic := server.states.metricFamilies(settings.labelName, containerNames); synthetic != nil {
+		containerMetricFamilies = append([]mutate.ContainerMetricFamilies{{MetricFamilies: synthetic}}, containerMetricFamilies...)
+	}
+
+	// The conflicts between containers were resolved and reported when they were scraped. Those left are between the
+	// synthetic series and a container, or with a family whose owner changed its type since the container was last
+	// scraped, and are dropped until the next scrape.
+	mergedMetricFamilies, _ := mutate.MergeMetricFamilies(containerMetricFamilies, mutate.ConflictPolicyDrop)
+
+	// The exposition format is negotiated the way promhttp does, so that scrapers asking for OpenMetrics get the
+	// exemplars and those asking for protobuf get everything the containers exposed.
+	format := expfmt.NegotiateIncludingOpenMetrics(r.Header)
+	rawMetrics, err := parse.Marshal(mergedMetricFamilies, format)
+	if err != nil {
+		log.Errorf("Failed to marshal the merged metrics on path %s: %v", r.URL.Path, err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	metrics := rawMetrics.Bytes()
 
-	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Type", string(format))
 
 	encodingHeaders := r.Header.Get("Accept-Encoding")
 	parts := strings.Split(encodingHeaders, ",")
@@ -99,66 +283,283 @@ func (server *Server) HandleMetrics(writer http.ResponseWriter, r *http.Request)
 
 	if len(metrics) == 0 {
 		if _, err := writer.Write([]byte("")); err != nil {
-			log.Errorf("Failed to write empty metric on path %s: %v", server.path, err)
+			log.Errorf("Failed to write empty metric on path %s: %v", r.URL.Path, err)
 		}
 	} else {
 		if _, err := writer.Write(metrics); err != nil {
-			log.Errorf("Failed to write metrics data on path %s: %v", server.path, err)
+			log.Errorf("Failed to write metrics data on path %s: %v", r.URL.Path, err)
 		}
 	}
 }
 
-// ServeOnPort starts the server on the given port.
+// cachedMetricFamilies reads the metric families of the containers from the cache with the given read function.
+func (server *Server) cachedMetricFamilies(containerNames []string,
+	read func(containerName string) (map[string]*promclient.MetricFamily, bool)) []mutate.ContainerMetricFamilies {
+	containerMetricFamilies := make([]mutate.ContainerMetricFamilies, 0, len(containerNames))
+	for _, containerName := range containerNames {
+		metricFamilies, ok := read(containerName)
+		if ok {
+			containerMetricFamilies = append(containerMetricFamilies, mutate.ContainerMetricFamilies{
+				ContainerName:  containerName,
+				MetricFamilies: metricFamilies,
+			})
+		} else {
+			log.Errorf("Missing metric in container : %s", containerName)
+		}
+	}
+	return containerMetricFamilies
+}
+
+// readCache reads the metric families of the container from the cache according to the cache read mode.
+func (server *Server) readCache(containerName string) (map[string]*promclient.MetricFamily, bool) {
+	if server.cacheReadMode == CacheReadModeRetain {
+		return server.cache.Get(containerName)
+	}
+	return server.cache.GetAndInvalidate(containerName)
+}
+
+// forgetContainer drops everything kept about a container that is no longer scraped: its cached metrics, the state of
+// its latest scrape, the types of its metric families and the series of the sidecar's own metrics labelled with it.
+func (server *Server) forgetContainer(containerName string) {
+	server.cache.GetAndInvalidate(containerName)
+	server.states.forget(containerName)
+	server.typeTracker.Forget(containerName)
+	for _, policy := range []mutate.ConflictPolicy{mutate.ConflictPolicyDrop, mutate.ConflictPolicyRename, mutate.ConflictPolicyFail} {
+		telemetry.TypeConflicts.DeleteLabelValues(containerName, string(policy))
+	}
+	for _, limit := range []string{limitBodySize, limitSample, limitLabel, limitLabelNameLength, limitLabelValueLength} {
+		telemetry.ScrapeLimitsExceeded.DeleteLabelValues(containerName, limit)
+	}
+	telemetry.RelabelDroppedSeries.DeleteLabelValues(containerName)
+}
+
+// reportTypeConflicts counts the given type conflicts and logs each of them at most once per conflictLogInterval.
+func (server *Server) reportTypeConflicts(conflicts []mutate.TypeConflict) {
+	for _, conflict := range conflicts {
+		telemetry.TypeConflicts.WithLabelValues(conflict.ContainerName, string(conflict.Policy)).Inc()
+		if server.conflictLogLimiter.Allow(conflict.ContainerName + "/" + conflict.FamilyName) {
+			log.Warningf("Metric family %s of container %s has type %s but was already merged as %s, applying policy %s",
+				conflict.FamilyName, conflict.ContainerName, conflict.ConflictType, conflict.MergedType, conflict.Policy)
+		}
+	}
+}
+
+// ServeOnPort starts the server on the given port, along with the server of the probes when they have a port of their
+// own, and returns once both have been shut down or closed. If either fails, the other is closed.
 func (server *Server) ServeOnPort() error {
-	http.HandleFunc(server.path, server.HandleMetrics)
-	if err := server.httpServer.ListenAndServe(); err != nil {
+	server.registerHandlers()
+	probesServed := make(chan error, 1)
+	if server.probeServer != nil {
+		go func() {
+			err := server.probeServer.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				server.httpServer.Close()
+			}
+			probesServed <- err
+		}()
+	} else {
+		probesServed <- nil
+	}
+
+	listenAndServe := server.httpServer.ListenAndServe
+	if server.tls {
+		// The certificate comes from the TLS settings rather than from files given here.
+		listenAndServe = func() error { return server.httpServer.ListenAndServeTLS("", "") }
+	}
+	if err := listenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if server.probeServer != nil {
+			server.probeServer.Close()
+		}
+		<-probesServed
 		return fmt.Errorf("failed to start the server on the path %s: %v", server.path, err)
 	}
+	if err := <-probesServed; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to start the server of the probes: %v", err)
+	}
 	return nil
 }
 
+// registerHandlers registers the handlers of the server. The probes are left unauthenticated, since the kubelet
+// can't authenticate its requests, and are registered with the server of the probes when they have a port of their
+// own.
+func (server *Server) registerHandlers() {
+	authenticate := server.authenticate
+	if authenticate == nil {
+		authenticate = func(handler http.Handler) http.Handler { return handler }
+	}
+	metricsHandler := telemetry.InstrumentMetricsHandler(authenticate(http.HandlerFunc(server.HandleMetrics)))
+	server.mux.Handle(server.path, metricsHandler)
+	if containerPath := server.containerPath(); containerPath != server.path {
+		server.mux.Handle(containerPath, metricsHandler)
+	}
+	server.mux.Handle(server.telemetryPath, authenticate(telemetry.Handler()))
+	server.probeMux.HandleFunc(healthPath, server.HandleHealth)
+	server.probeMux.HandleFunc(readyPath, server.HandleReady)
+	if server.adminPath != "" {
+		server.mux.Handle(server.adminPath+"/", authenticate(http.HandlerFunc(server.HandleAdmin)))
+	}
+}
+
 // PopulateCacheForContainer updates the specified metrics on the metric cache.
-func (server *Server) PopulateCacheForContainer(labelName string, containerName string, port int) {
-	rawMetrics, err := server.metricClient.ScrapeRawMetrics(context.Background(), port, server.path)
+func (server *Server) PopulateCacheForContainer(ctx context.Context, labelName string, containerName string, target utils.Target) {
+	if _, err := server.scrapeContainer(ctx, labelName, containerName, target); err != nil {
+		log.Errorf("Failed to populate the cache for container %s: %v", containerName, err)
+	}
+}
+
+// scrapeContainer scrapes the metrics of a container, labels them with the container name, and records the outcome in
+// the state of the container and its metrics in the cache. The scrape of a container that is no longer scraped from
+// the given target is dropped, returning no metrics and no error.
+func (server *Server) scrapeContainer(ctx context.Context, labelName string, containerName string, target utils.Target) (map[string]*promclient.MetricFamily, error) {
+	start := server.states.now()
+	metricFamilyMap, err := server.scrapeAndLabel(ctx, labelName, containerName, target)
+	if limit, ok := exceededLimit(err); ok {
+		telemetry.ScrapeLimitsExceeded.WithLabelValues(containerName, limit).Inc()
+	}
+	// A scrape cancelled by the shutdown says nothing about the container, so it leaves the state as it was.
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return nil, err
+	}
+
+	// The outcome is recorded under mu, so that a container paused, removed or moved to another target while it was
+	// being scraped isn't brought back into the cache and the state once they have been cleared, nor overwritten with
+	// the metrics of its old target.
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	if !server.settings.isScraped(containerName, target) {
+		log.Debugf("Dropped the scrape of container %s, which is no longer scraped from %s", containerName, target.URL())
+		return nil, nil
+	}
+	if err == nil {
+		err = server.resolveTypeConflicts(containerName, metricFamilyMap)
+	}
+	server.states.recordScrape(containerName, start, parse.CountSamples(metricFamilyMap), err)
 	if err != nil {
-		log.Errorf("Failed to scrape metrics on path %s for container %s on port %d: %v", server.path, containerName, port, err)
-		return
+		return nil, err
 	}
-	metricFamilyMap, err := parse.Unmarshal(rawMetrics)
+	server.cache.Set(containerName, metricFamilyMap)
+	return metricFamilyMap, nil
+}
+
+// resolveTypeConflicts resolves the type conflicts of the freshly scraped metrics of the container with the other
+// containers, and reports them.
+func (server *Server) resolveTypeConflicts(containerName string, metricFamilyMap map[string]*promclient.MetricFamily) error {
+	conflicts, err := server.typeTracker.Resolve(containerName, metricFamilyMap, server.settings.conflictPolicy)
+	server.reportTypeConflicts(conflicts)
 	if err != nil {
-		log.Errorf("Failed to unmarshal the metrics on path %s: %v", server.path, err)
-		return
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonTypeConflict).Inc()
+		return fmt.Errorf("failed to merge the metrics of container %s: %w", containerName, err)
 	}
-	if err = mutate.AppendLabelToMetrics(labelName, containerName, metricFamilyMap); err != nil {
-		log.Errorf("Failed to append label %s to metrics on path %s: %v", labelName, server.path, err)
-		return
+	return nil
+}
+
+// scrapeAndLabel scrapes the metrics of a container and labels them with the container name.
+func (server *Server) scrapeAndLabel(ctx context.Context, labelName string, containerName string, target utils.Target) (map[string]*promclient.MetricFamily, error) {
+	rawMetrics, format, err := server.metricClient.ScrapeRawMetrics(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape metrics on %s: %w", target.URL(), err)
 	}
-	rawMetricsBuff, err := parse.Marshal(metricFamilyMap)
+	metricFamilyMap, err := parse.Unmarshal(rawMetrics, format)
 	if err != nil {
-		log.Errorf("Failed to marshal the metrics on path %s: %v", server.path, err)
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonParse).Inc()
+		return nil, fmt.Errorf("failed to unmarshal the metrics of %s: %w", target.URL(), err)
+	}
+	settings := server.currentSettings()
+	if settings.nativeHistogramClassicBuckets {
+		parse.AddClassicBuckets(metricFamilyMap)
+	}
+	if err = mutate.AppendLabelsToMetrics(labelName, containerName, settings.extraLabels[containerName], settings.labelCollisionPolicy, metricFamilyMap); err != nil {
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonLabel).Inc()
+		return nil, fmt.Errorf("failed to append labels to metrics of %s: %w", target.URL(), err)
+	}
+	if dropped := relabel.MetricFamilies(metricFamilyMap, settings.relabelRules[containerName]); dropped > 0 {
+		telemetry.RelabelDroppedSeries.WithLabelValues(containerName).Add(float64(dropped))
+	}
+	if err = settings.limits[containerName].check(metricFamilyMap); err != nil {
+		telemetry.ScrapeErrors.WithLabelValues(telemetry.ReasonLimit).Inc()
+		return nil, fmt.Errorf("the metrics of %s exceed their limits: %w", target.URL(), err)
+	}
+	return metricFamilyMap, nil
+}
+
+// Start starts scraping every container on its own schedule, so that the cache is populated for exposing metrics.
+// In the on-demand scrape mode nothing is scheduled, since the containers are scraped when the metrics are requested.
+// Scraping stops once the context is done, cancelling the scrapes in flight.
+func (server *Server) Start(ctx context.Context) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.cancel()
+	server.ctx, server.cancel = context.WithCancel(ctx)
+	server.started = true
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		server.stopScraping()
+	}(server.ctx)
+	if server.scrapeMode == ScrapeModeOnDemand {
 		return
 	}
-	server.cache.Set(containerName, rawMetricsBuff.Bytes())
+	for _, containerName := range server.settings.containerNames() {
+		server.schedule(containerName)
+	}
 }
 
-// Start starts the server for exposing metrics and listen on each port to scrape the container.
-func (server *Server) Start(internalMs int, containerLabelName string) {
-	ticker := time.NewTicker(time.Duration(internalMs) * time.Millisecond)
-	for container, port := range server.containerToPortMap {
-		c := container
-		p := port
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					server.PopulateCacheForContainer(containerLabelName, c, p)
-				}
+// schedule starts the scrape loop of the container with its current target and interval, unless scraping has
+// stopped. The caller must hold mu.
+func (server *Server) schedule(containerName string) {
+	if server.stopped {
+		return
+	}
+	ctx := server.ctx
+	target := server.settings.targets[containerName]
+	server.scheduler.ScheduleEvery(containerName, server.settings.interval(containerName), func() {
+		server.PopulateCacheForContainer(ctx, server.currentSettings().labelName, containerName, target)
+	})
+}
+
+// scrapeContext returns the context the scrapes of the server run in.
+func (server *Server) scrapeContext() context.Context {
+	server.mu.RLock()
+	defer server.mu.RUnlock()
+	return server.ctx
+}
+
+// stopScraping stops scheduling scrapes, cancels the scrapes in flight and waits for the scrape loops to finish.
+func (server *Server) stopScraping() {
+	server.mu.Lock()
+	server.stopped = true
+	server.cancel()
+	server.mu.Unlock()
+	server.scheduler.Stop()
+}
+
+// Shutdown stops scraping the containers and gracefully shuts down the underlying HTTP servers, letting the requests
+// in flight finish. If they don't finish before the context is done, the HTTP servers are closed.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.stopScraping()
+	var shutdownErr error
+	for _, httpServer := range server.httpServers() {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			httpServer.Close()
+			if shutdownErr == nil {
+				shutdownErr = fmt.Errorf("failed to shut down the server gracefully: %w", err)
 			}
-		}()
+		}
 	}
+	return shutdownErr
 }
 
-// Close is a wrapper function for the Close() function of http.Client.
+// Close stops scraping the containers and closes the underlying HTTP servers.
 func (server *Server) Close() {
-	server.httpServer.Close()
+	server.stopScraping()
+	for _, httpServer := range server.httpServers() {
+		httpServer.Close()
+	}
+}
+
+// httpServers returns the HTTP server of the metrics, and that of the probes when they have a port of their own.
+func (server *Server) httpServers() []HTTPServer {
+	if server.probeServer == nil {
+		return []HTTPServer{server.httpServer}
+	}
+	return []HTTPServer{server.httpServer, server.probeServer}
 }
@@ -3,12 +3,26 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/mutate"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/relabel"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/telemetry"
 	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/utils"
 	mock_server "github.com/thought-machine/prometheus-multiplexer-sidecar/pkg/server/mocks"
 )
@@ -20,42 +34,127 @@ const (
 	endpoint       = "/metrics"
 )
 
-var containerToPortMap = map[string]int{
-	"container1": 1,
-	"container2": 2,
-	"container3": 3,
+var opts = Options{
+	MetricPort:           metricPort,
+	Endpoint:             endpoint,
+	TelemetryEndpoint:    "/multiplexer/metrics",
+	TypeConflictPolicy:   mutate.ConflictPolicyDrop,
+	ContainerLabelName:   "container",
+	LabelCollisionPolicy: mutate.LabelCollisionPolicyRename,
+	ScrapeInterval:       time.Hour,
+	ScrapeJitter:         0,
+}
+
+var targets = map[string]utils.Target{
+	"container1": {Scheme: "http", Host: "localhost", Port: 1, Path: endpoint},
+	"container2": {Scheme: "http", Host: "localhost", Port: 2, Path: endpoint},
+	"container3": {Scheme: "http", Host: "localhost", Port: 3, Path: endpoint},
+}
+
+const mergedMetrics = `# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container1"} 1
+go_goroutines{container="container2"} 2
+go_goroutines{container="container3"} 3
+`
+
+// goroutinesMetricFamilies returns the metric families a container exposing go_goroutines would be cached with.
+func goroutinesMetricFamilies(containerName string, value float64) map[string]*promclient.MetricFamily {
+	return map[string]*promclient.MetricFamily{
+		"go_goroutines": {
+			Name: proto.String("go_goroutines"),
+			Help: proto.String("Number of goroutines that currently exist."),
+			Type: promclient.MetricType_GAUGE.Enum(),
+			Metric: []*promclient.Metric{
+				{
+					Label: []*promclient.LabelPair{
+						{
+							Name:  proto.String("container"),
+							Value: proto.String(containerName),
+						},
+					},
+					Gauge: &promclient.Gauge{
+						Value: proto.Float64(value),
+					},
+				},
+			},
+		},
+	}
 }
 
 func TestHandleMetrics(t *testing.T) {
 
 	testCases := []struct {
 		name           string
-		metricResult   []byte
-		ok             bool
+		metricResults  map[string]map[string]*promclient.MetricFamily
 		encodingType   string
 		expectedResult []byte
 	}{
 		{
 			"test expose with invalid metric cache",
-			nil,
-			false,
+			map[string]map[string]*promclient.MetricFamily{},
 			acceptEncoding,
 			[]byte(""),
 		},
 
 		{
 			"test expose with metric cache of gzip request",
-			[]byte("test"),
-			true,
+			map[string]map[string]*promclient.MetricFamily{
+				"container1": goroutinesMetricFamilies("container1", 1),
+				"container2": goroutinesMetricFamilies("container2", 2),
+				"container3": goroutinesMetricFamilies("container3", 3),
+			},
 			acceptEncoding,
-			utils.CompressDataToGzip([]byte("testtesttest")),
+			utils.CompressDataToGzip([]byte(mergedMetrics)),
 		},
 		{
 			"test expose with metric cache of non-gzip request",
-			[]byte("test"),
-			true,
+			map[string]map[string]*promclient.MetricFamily{
+				"container1": goroutinesMetricFamilies("container1", 1),
+				"container2": goroutinesMetricFamilies("container2", 2),
+				"container3": goroutinesMetricFamilies("container3", 3),
+			},
 			"compress",
-			[]byte("testtesttest"),
+			[]byte(mergedMetrics),
+		},
+		{
+			"test expose with a missing container",
+			map[string]map[string]*promclient.MetricFamily{
+				"container1": goroutinesMetricFamilies("container1", 1),
+				"container3": goroutinesMetricFamilies("container3", 3),
+			},
+			"compress",
+			[]byte(`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container1"} 1
+go_goroutines{container="container3"} 3
+`),
+		},
+		{
+			"test expose with a type conflict between containers",
+			map[string]map[string]*promclient.MetricFamily{
+				"container1": goroutinesMetricFamilies("container1", 1),
+				"container2": {
+					"go_goroutines": {
+						Name: proto.String("go_goroutines"),
+						Type: promclient.MetricType_UNTYPED.Enum(),
+						Metric: []*promclient.Metric{
+							{
+								Untyped: &promclient.Untyped{
+									Value: proto.Float64(2),
+								},
+							},
+						},
+					},
+				},
+				"container3": goroutinesMetricFamilies("container3", 3),
+			},
+			"compress",
+			[]byte(`# HELP go_goroutines Number of goroutines that currently exist.
+# TYPE go_goroutines gauge
+go_goroutines{container="container1"} 1
+go_goroutines{container="container3"} 3
+`),
 		},
 	}
 	for _, tc := range testCases {
@@ -67,9 +166,10 @@ func TestHandleMetrics(t *testing.T) {
 			ctr := gomock.NewController(t)
 			defer ctr.Finish()
 			mockCache := mock_server.NewMockMetricCache(ctr)
-			mockCache.EXPECT().GetAndInvalidate(gomock.Any()).Return(tc.metricResult, tc.ok)
-			mockCache.EXPECT().GetAndInvalidate(gomock.Any()).Return(tc.metricResult, tc.ok)
-			mockCache.EXPECT().GetAndInvalidate(gomock.Any()).Return(tc.metricResult, tc.ok)
+			for containerName := range targets {
+				metricFamilies, ok := tc.metricResults[containerName]
+				mockCache.EXPECT().GetAndInvalidate(containerName).Return(metricFamilies, ok)
+			}
 			mw := mock_server.NewMockResponseWriter(ctr)
 			mw.EXPECT().Header().Return(header)
 			if tc.encodingType == acceptEncoding {
@@ -78,47 +178,430 @@ func TestHandleMetrics(t *testing.T) {
 			mw.EXPECT().WriteHeader(http.StatusOK)
 			mw.EXPECT().Write(tc.expectedResult)
 
-			server := NewServer(metricPort, mockCache, client, containerToPortMap, endpoint)
+			server := NewServer(opts, mockCache, client, targets)
 			server.HandleMetrics(mw, req)
 		})
 	}
 }
 
+func TestHandleMetricsNegotiatesFormat(t *testing.T) {
+	testCases := []struct {
+		name                string
+		accept              string
+		expectedContentType string
+	}{
+		{
+			"test expose the text format without an Accept header",
+			"",
+			string(expfmt.FmtText),
+		},
+		{
+			"test expose the OpenMetrics format",
+			"application/openmetrics-text;version=0.0.1,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			string(expfmt.FmtOpenMetrics),
+		},
+		{
+			"test expose the delimited protobuf format",
+			"application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3",
+			string(expfmt.FmtProtoDelim),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mockCache := mock_server.NewMockMetricCache(ctr)
+			for containerName, target := range targets {
+				mockCache.EXPECT().GetAndInvalidate(containerName).Return(goroutinesMetricFamilies(containerName, float64(target.Port)), true)
+			}
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Accept", tc.accept)
+			recorder := httptest.NewRecorder()
+
+			server := NewServer(opts, mockCache, client.NewClient(), targets)
+			server.HandleMetrics(recorder, req)
+
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, tc.expectedContentType, recorder.Header().Get("Content-Type"))
+			// Whatever the format, the response holds the same metrics.
+			metricFamilies, err := parse.Unmarshal(recorder.Body, expfmt.Format(tc.expectedContentType))
+			require.NoError(t, err)
+			rawMetrics, err := parse.Marshal(metricFamilies, expfmt.FmtText)
+			require.NoError(t, err)
+			assert.Equal(t, mergedMetrics, rawMetrics.String())
+		})
+	}
+}
+
+func TestHandleMetricsWithRetainedCache(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	for containerName, target := range targets {
+		value := float64(target.Port)
+		mockCache.EXPECT().Get(containerName).Return(goroutinesMetricFamilies(containerName, value), true).Times(2)
+	}
+
+	retainOpts := opts
+	retainOpts.CacheReadMode = CacheReadModeRetain
+	server := NewServer(retainOpts, mockCache, client.NewClient(), targets)
+
+	// Every replica scraping the sidecar within the same interval gets the complete response.
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", path, nil)
+		mw := mock_server.NewMockResponseWriter(ctr)
+		mw.EXPECT().Header().Return(http.Header{})
+		mw.EXPECT().WriteHeader(http.StatusOK)
+		mw.EXPECT().Write([]byte(mergedMetrics))
+		server.HandleMetrics(mw, req)
+	}
+}
+
 func TestPopulateCacheForContainer(t *testing.T) {
+	dropGoMetrics, err := relabel.Compile([]relabel.Config{
+		{SourceLabels: []string{"__name__"}, Separator: ";", Regex: "go_.*", Replacement: "$1", Action: relabel.Drop},
+	})
+	require.NoError(t, err)
+
 	testCases := []struct {
 		name          string
 		labelName     string
 		containerName string
-		port          int
+		target        utils.Target
+		extraLabels   map[string]string
+		relabelRules  []*relabel.Rule
 		metricBuff    *bytes.Buffer
-		expectedCache []byte
+		expectedCache map[string]*promclient.MetricFamily
 	}{
 		{
 			"test correct cache update",
 			"multiplexer",
 			"container1",
-			1,
+			targets["container1"],
+			nil,
+			nil,
 			bytes.NewBuffer([]byte(`# TYPE new_metric untyped
 new_metric 22222
 `)),
-			[]byte(`# TYPE new_metric untyped
-new_metric{multiplexer="container1"} 22222
-`),
+			map[string]*promclient.MetricFamily{
+				"new_metric": {
+					Name: proto.String("new_metric"),
+					Type: promclient.MetricType_UNTYPED.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{
+								{
+									Name:  proto.String("multiplexer"),
+									Value: proto.String("container1"),
+								},
+							},
+							Untyped: &promclient.Untyped{
+								Value: proto.Float64(22222),
+							},
+						},
+					},
+				},
+			},
+		},
+		{
+			"test extra labels and relabelling rules are applied",
+			"multiplexer",
+			"container1",
+			targets["container1"],
+			map[string]string{"team": "payments"},
+			dropGoMetrics,
+			bytes.NewBuffer([]byte(`# TYPE go_goroutines gauge
+go_goroutines 3
+# TYPE new_metric untyped
+new_metric 22222
+`)),
+			map[string]*promclient.MetricFamily{
+				"new_metric": {
+					Name: proto.String("new_metric"),
+					Type: promclient.MetricType_UNTYPED.Enum(),
+					Metric: []*promclient.Metric{
+						{
+							Label: []*promclient.LabelPair{
+								{
+									Name:  proto.String("multiplexer"),
+									Value: proto.String("container1"),
+								},
+								{
+									Name:  proto.String("team"),
+									Value: proto.String("payments"),
+								},
+							},
+							Untyped: &promclient.Untyped{
+								Value: proto.Float64(22222),
+							},
+						},
+					},
+				},
+			},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
+			containerOpts := opts
+			containerOpts.ContainerExtraLabels = map[string]map[string]string{tc.containerName: tc.extraLabels}
+			containerOpts.ContainerMetricRelabelRules = map[string][]*relabel.Rule{tc.containerName: tc.relabelRules}
 
 			ctr := gomock.NewController(t)
 			defer ctr.Finish()
 			mc := mock_server.NewMockMetricClient(ctr)
-			mc.EXPECT().ScrapeRawMetrics(context.Background(), tc.port, endpoint).Return(tc.metricBuff, nil)
+			mc.EXPECT().ScrapeRawMetrics(context.Background(), tc.target).Return(tc.metricBuff, expfmt.FmtText, nil)
 			mockCache := mock_server.NewMockMetricCache(ctr)
 			mockCache.EXPECT().Set(tc.containerName, tc.expectedCache)
 
-			server := NewServer(metricPort, mockCache, mc, containerToPortMap, endpoint)
-			server.PopulateCacheForContainer(tc.labelName, tc.containerName, tc.port)
+			server := NewServer(containerOpts, mockCache, mc, targets)
+			server.PopulateCacheForContainer(context.Background(), tc.labelName, tc.containerName, tc.target)
+		})
+	}
+}
+
+func TestPopulateCacheForContainerWithoutMetrics(t *testing.T) {
+	testCases := []struct {
+		name       string
+		format     expfmt.Format
+		metricBuff *bytes.Buffer
+	}{
+		{"test an empty text response", expfmt.FmtText, bytes.NewBuffer(nil)},
+		{"test an empty protobuf response", expfmt.FmtProtoDelim, bytes.NewBuffer(nil)},
+		{"test an OpenMetrics response with only # EOF", expfmt.FmtOpenMetrics, bytes.NewBufferString("# EOF\n")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			mc := mock_server.NewMockMetricClient(ctr)
+			mc.EXPECT().ScrapeRawMetrics(context.Background(), targets["container1"]).Return(tc.metricBuff, tc.format, nil)
+			mockCache := mock_server.NewMockMetricCache(ctr)
+			mockCache.EXPECT().Set("container1", map[string]*promclient.MetricFamily{})
+
+			server := NewServer(opts, mockCache, mc, targets)
+			server.PopulateCacheForContainer(context.Background(), "container", "container1", targets["container1"])
+
+			// A container without metrics is up, unlike a container that failed to be scraped.
+			rawMetrics, err := parse.Marshal(server.states.metricFamilies("container", []string{"container1"}), expfmt.FmtText)
+			require.NoError(t, err)
+			assert.Contains(t, rawMetrics.String(), `up{container="container1"} 1`)
+			assert.Contains(t, rawMetrics.String(), `scrape_samples_scraped{container="container1"} 0`)
+		})
+	}
+}
+
+func TestPopulateCacheForContainerFailsOnTypeConflict(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	mc := mock_server.NewMockMetricClient(ctr)
+	mc.EXPECT().ScrapeRawMetrics(gomock.Any(), targets["container1"]).DoAndReturn(
+		func(context.Context, utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+			return bytes.NewBufferString("# TYPE requests gauge\nrequests 1\n"), expfmt.FmtText, nil
+		})
+	mc.EXPECT().ScrapeRawMetrics(gomock.Any(), targets["container2"]).DoAndReturn(
+		func(context.Context, utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+			return bytes.NewBufferString("# TYPE requests counter\nrequests 2\n"), expfmt.FmtText, nil
+		}).Times(2)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	mockCache.EXPECT().Set("container1", gomock.Any())
+
+	failOpts := opts
+	failOpts.TypeConflictPolicy = mutate.ConflictPolicyFail
+	server := NewServer(failOpts, mockCache, mc, targets)
+	conflicts := telemetry.TypeConflicts.WithLabelValues("container2", string(mutate.ConflictPolicyFail))
+	conflictsBefore := testutil.ToFloat64(conflicts)
+
+	server.PopulateCacheForContainer(context.Background(), "container", "container1", targets["container1"])
+	server.PopulateCacheForContainer(context.Background(), "container", "container2", targets["container2"])
+	server.PopulateCacheForContainer(context.Background(), "container", "container2", targets["container2"])
+
+	// The scrapes of the later container fail, but the conflict is only counted once.
+	state, ok := server.states.get("container2")
+	require.True(t, ok)
+	assert.False(t, state.up)
+	assert.ErrorContains(t, state.lastError, "the types of metric families requests conflict with other containers")
+	assert.Equal(t, conflictsBefore+1, testutil.ToFloat64(conflicts))
+}
+
+func TestStart(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	var wg sync.WaitGroup
+	wg.Add(len(targets))
+	mc := mock_server.NewMockMetricClient(ctr)
+	mockCache := mock_server.NewMockMetricCache(ctr)
+	for containerName, target := range targets {
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).Return(bytes.NewBufferString("new_metric 1\n"), expfmt.FmtText, nil)
+		mockCache.EXPECT().Set(containerName, gomock.Any()).Do(func(string, map[string]*promclient.MetricFamily) { wg.Done() })
+	}
+
+	// Without jitter every container is scraped straight away, each by its own scrape loop.
+	server := NewServer(opts, mockCache, mc, targets)
+	server.Start(context.Background())
+	wg.Wait()
+	server.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	scraping := make(chan struct{}, len(targets))
+	mc := mock_server.NewMockMetricClient(ctr)
+	for _, target := range targets {
+		mc.EXPECT().ScrapeRawMetrics(gomock.Any(), target).DoAndReturn(
+			func(ctx context.Context, _ utils.Target) (*bytes.Buffer, expfmt.Format, error) {
+				scraping <- struct{}{}
+				<-ctx.Done()
+				return nil, expfmt.FmtUnknown, ctx.Err()
+			})
+	}
+
+	shutdownOpts := opts
+	shutdownOpts.MetricPort = 0
+	server := NewServer(shutdownOpts, mock_server.NewMockMetricCache(ctr), mc, targets)
+	served := make(chan error)
+	go func() {
+		served <- server.ServeOnPort()
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	server.Start(ctx)
+	for range targets {
+		<-scraping
+	}
+
+	// Cancelling the context cancels the scrapes in flight, which leave the state of the containers untouched.
+	cancel()
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assert.NoError(t, <-served)
+	for containerName := range targets {
+		_, ok := server.states.get(containerName)
+		assert.False(t, ok)
+	}
+
+	// Once scraping has stopped, a reload schedules nothing.
+	server.Reload(opts, targets)
+}
+
+func TestRegisterHandlersAuthenticates(t *testing.T) {
+	authOpts := opts
+	authOpts.AdminEndpoint = "/admin"
+	authOpts.Authenticate = func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	server := NewServer(authOpts, mock_server.NewMockMetricCache(ctr), mock_server.NewMockMetricClient(ctr), targets)
+	server.registerHandlers()
+
+	testCases := []struct {
+		name          string
+		path          string
+		authenticated bool
+	}{
+		{"authenticates the metrics", endpoint, true},
+		{"authenticates the metrics of a container", endpoint + "/container1", true},
+		{"authenticates the telemetry", "/multiplexer/metrics", true},
+		{"authenticates the admin endpoint", "/admin/containers", true},
+		{"leaves the liveness probe open", healthPath, false},
+		{"leaves the readiness probe open", readyPath, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			server.mux.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+			assert.Equal(t, tc.authenticated, w.Code == http.StatusUnauthorized)
+		})
+	}
+}
+
+func TestRegisterHandlersProbePort(t *testing.T) {
+	probeOpts := opts
+	probeOpts.ProbePort = 13435
+	ctr := gomock.NewController(t)
+	defer ctr.Finish()
+	server := NewServer(probeOpts, mock_server.NewMockMetricCache(ctr), mock_server.NewMockMetricClient(ctr), targets)
+	server.registerHandlers()
+
+	testCases := []struct {
+		name   string
+		mux    *http.ServeMux
+		path   string
+		served bool
+	}{
+		{"serves the liveness probe on the probe port", server.probeMux, healthPath, true},
+		{"serves the readiness probe on the probe port", server.probeMux, readyPath, true},
+		{"doesn't serve the metrics on the probe port", server.probeMux, endpoint, false},
+		{"doesn't serve the liveness probe on the metric port", server.mux, healthPath, false},
+		{"doesn't serve the readiness probe on the metric port", server.mux, readyPath, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, pattern := tc.mux.Handler(httptest.NewRequest("GET", tc.path, nil))
+			assert.Equal(t, tc.served, pattern != "")
+		})
+	}
+}
+
+func TestServeOnPortWithProbePort(t *testing.T) {
+	testCases := []struct {
+		name        string
+		probeErr    error
+		expectedErr string
+	}{
+		{"serves until both servers are shut down", nil, ""},
+		{"closes the metrics server once the probe server fails", errors.New("address already in use"), "failed to start the server of the probes"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctr := gomock.NewController(t)
+			defer ctr.Finish()
+			probeOpts := opts
+			probeOpts.ProbePort = 13435
+			server := NewServer(probeOpts, mock_server.NewMockMetricCache(ctr), mock_server.NewMockMetricClient(ctr), targets)
+
+			// Each server serves until it is shut down or closed.
+			newHTTPServer := func(err error) *mock_server.MockHTTPServer {
+				httpServer := mock_server.NewMockHTTPServer(ctr)
+				stopped := make(chan struct{})
+				var once sync.Once
+				stop := func() { once.Do(func() { close(stopped) }) }
+				httpServer.EXPECT().ListenAndServe().DoAndReturn(func() error {
+					if err != nil {
+						return err
+					}
+					<-stopped
+					return http.ErrServerClosed
+				})
+				httpServer.EXPECT().Shutdown(gomock.Any()).DoAndReturn(func(context.Context) error {
+					stop()
+					return nil
+				}).AnyTimes()
+				httpServer.EXPECT().Close().DoAndReturn(func() error {
+					stop()
+					return nil
+				}).AnyTimes()
+				return httpServer
+			}
+			server.httpServer = newHTTPServer(nil)
+			server.probeServer = newHTTPServer(tc.probeErr)
+
+			served := make(chan error)
+			go func() {
+				served <- server.ServeOnPort()
+			}()
+			if tc.probeErr == nil {
+				assert.NoError(t, server.Shutdown(context.Background()))
+			}
+			err := <-served
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
 		})
 	}
 }
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// The names of the series the sidecar adds for every container, mirroring the ones Prometheus adds for every target.
+const (
+	upMetricName              = "up"
+	scrapeDurationMetricName  = "scrape_duration_seconds"
+	samplesScrapedMetricName  = "scrape_samples_scraped"
+	lastSuccessTimeMetricName = "scrape_last_success_timestamp_seconds"
+	exceededLimitMetricName   = "scrape_exceeded_limit"
+)
+
+// containerState is the outcome of the latest scrape of a container.
+type containerState struct {
+	up             bool
+	scrapeDuration time.Duration
+	samples        int
+	lastSuccess    time.Time
+	lastError      error
+}
+
+// containerStates keeps the state of every container that has been scraped at least once.
+type containerStates struct {
+	mu     sync.RWMutex
+	states map[string]containerState
+	now    func() time.Time
+}
+
+func newContainerStates() *containerStates {
+	return &containerStates{
+		states: make(map[string]containerState),
+		now:    time.Now,
+	}
+}
+
+// recordScrape records the outcome of a scrape of the container that started at the given time.
+func (s *containerStates) recordScrape(containerName string, start time.Time, samples int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	state := s.states[containerName]
+	state.up = err == nil
+	state.scrapeDuration = now.Sub(start)
+	state.samples = samples
+	state.lastError = err
+	if err == nil {
+		state.lastSuccess = now
+	}
+	s.states[containerName] = state
+}
+
+// get returns the state of the container, if it has been scraped.
+func (s *containerStates) get(containerName string) (containerState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.states[containerName]
+	return state, ok
+}
+
+// forget drops the state of a container that is no longer scraped.
+func (s *containerStates) forget(containerName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, containerName)
+}
+
+// metricFamilies returns the synthetic series describing the latest scrape of each of the given containers, labelled
+// with the container label.
+func (s *containerStates) metricFamilies(labelName string, containerNames []string) map[string]*promclient.MetricFamily {
+	up := newGaugeFamily(upMetricName, "1 if the latest scrape of the container succeeded, 0 otherwise.")
+	duration := newGaugeFamily(scrapeDurationMetricName, "Duration of the latest scrape of the container.")
+	samples := newGaugeFamily(samplesScrapedMetricName, "Number of samples the latest scrape of the container exposed.")
+	lastSuccess := newGaugeFamily(lastSuccessTimeMetricName, "Unix time of the latest successful scrape of the container.")
+	limitExceeded := newGaugeFamily(exceededLimitMetricName, "1 for the limit the latest scrape of the container exceeded, if it exceeded one.")
+
+	for _, containerName := range containerNames {
+		state, ok := s.get(containerName)
+		if !ok {
+			continue
+		}
+		var upValue, lastSuccessValue float64
+		if state.up {
+			upValue = 1
+		}
+		if !state.lastSuccess.IsZero() {
+			lastSuccessValue = float64(state.lastSuccess.UnixNano()) / float64(time.Second)
+		}
+		addGauge(up, labelName, containerName, upValue)
+		addGauge(duration, labelName, containerName, state.scrapeDuration.Seconds())
+		addGauge(samples, labelName, containerName, float64(state.samples))
+		addGauge(lastSuccess, labelName, containerName, lastSuccessValue)
+		if limit, ok := exceededLimit(state.lastError); ok {
+			addGauge(limitExceeded, labelName, containerName, 1)
+			m := limitExceeded.Metric[len(limitExceeded.Metric)-1]
+			m.Label = append(m.Label, &promclient.LabelPair{
+				Name:  proto.String("limit"),
+				Value: proto.String(limit),
+			})
+		}
+	}
+
+	if len(up.Metric) == 0 {
+		return nil
+	}
+	metricFamilies := map[string]*promclient.MetricFamily{
+		upMetricName:              up,
+		scrapeDurationMetricName:  duration,
+		samplesScrapedMetricName:  samples,
+		lastSuccessTimeMetricName: lastSuccess,
+	}
+	// The series is only exposed while a container fails a limit, explaining why it is down.
+	if len(limitExceeded.Metric) != 0 {
+		metricFamilies[exceededLimitMetricName] = limitExceeded
+	}
+	return metricFamilies
+}
+
+func newGaugeFamily(name string, help string) *promclient.MetricFamily {
+	return &promclient.MetricFamily{
+		Name: proto.String(name),
+		Help: proto.String(help),
+		Type: promclient.MetricType_GAUGE.Enum(),
+	}
+}
+
+func addGauge(mf *promclient.MetricFamily, labelName string, containerName string, value float64) {
+	mf.Metric = append(mf.Metric, &promclient.Metric{
+		Label: []*promclient.LabelPair{
+			{
+				Name:  proto.String(labelName),
+				Value: proto.String(containerName),
+			},
+		},
+		Gauge: &promclient.Gauge{
+			Value: proto.Float64(value),
+		},
+	})
+}
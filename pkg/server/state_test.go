@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	promclient "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/client"
+	"github.com/thought-machine/prometheus-multiplexer-sidecar/internal/pkg/parse"
+)
+
+func TestContainerStates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	states := newContainerStates()
+	states.now = func() time.Time { return now }
+
+	assert.Nil(t, states.metricFamilies("container", []string{"container1"}), "containers that were never scraped have no series")
+
+	states.recordScrape("container1", now.Add(-250*time.Millisecond), 42, nil)
+	states.recordScrape("container2", now.Add(-2*time.Second), 7, nil)
+	now = now.Add(time.Minute)
+	states.recordScrape("container2", now.Add(-time.Second), 0, errors.New("connection refused"))
+
+	state, ok := states.get("container2")
+	require.True(t, ok)
+	assert.False(t, state.up)
+	assert.EqualError(t, state.lastError, "connection refused")
+	assert.Equal(t, time.Unix(1000, 0), state.lastSuccess)
+
+	metricFamilies := states.metricFamilies("container", []string{"container1", "container2", "container3"})
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	// The series are named like those Prometheus adds for every target, so that the same alerting rules work per
+	// container.
+	assert.ElementsMatch(t, []string{"up", "scrape_duration_seconds", "scrape_samples_scraped", "scrape_last_success_timestamp_seconds"}, names)
+
+	rawMetrics, err := parse.Marshal(metricFamilies, expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP scrape_duration_seconds Duration of the latest scrape of the container.
+# TYPE scrape_duration_seconds gauge
+scrape_duration_seconds{container="container1"} 0.25
+scrape_duration_seconds{container="container2"} 1
+# HELP scrape_last_success_timestamp_seconds Unix time of the latest successful scrape of the container.
+# TYPE scrape_last_success_timestamp_seconds gauge
+scrape_last_success_timestamp_seconds{container="container1"} 1000
+scrape_last_success_timestamp_seconds{container="container2"} 1000
+# HELP scrape_samples_scraped Number of samples the latest scrape of the container exposed.
+# TYPE scrape_samples_scraped gauge
+scrape_samples_scraped{container="container1"} 42
+scrape_samples_scraped{container="container2"} 0
+# HELP up 1 if the latest scrape of the container succeeded, 0 otherwise.
+# TYPE up gauge
+up{container="container1"} 1
+up{container="container2"} 0
+`, rawMetrics.String())
+}
+
+func TestContainerStatesReportExceededLimits(t *testing.T) {
+	now := time.Unix(1000, 0)
+	states := newContainerStates()
+	states.now = func() time.Time { return now }
+
+	states.recordScrape("container1", now, 0, fmt.Errorf("failed to scrape metrics: %w", client.ErrBodySizeLimit))
+	states.recordScrape("container2", now, 0, &limitError{limitSample, errors.New("too many samples")})
+	states.recordScrape("container3", now, 0, errors.New("connection refused"))
+
+	metricFamilies := states.metricFamilies("container", []string{"container1", "container2", "container3"})
+	rawMetrics, err := parse.Marshal(map[string]*promclient.MetricFamily{
+		exceededLimitMetricName: metricFamilies[exceededLimitMetricName],
+	}, expfmt.FmtText)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP scrape_exceeded_limit 1 for the limit the latest scrape of the container exceeded, if it exceeded one.
+# TYPE scrape_exceeded_limit gauge
+scrape_exceeded_limit{container="container1",limit="body_size_limit"} 1
+scrape_exceeded_limit{container="container2",limit="sample_limit"} 1
+`, rawMetrics.String())
+
+	states.recordScrape("container1", now, 1, nil)
+	states.recordScrape("container2", now, 1, nil)
+	assert.NotContains(t, states.metricFamilies("container", []string{"container1", "container2"}), exceededLimitMetricName)
+}